@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
 	"github.com/admirallarimda/tgbotbase"
@@ -11,7 +13,8 @@ import (
 
 type answerHandler struct {
 	tgbotbase.BaseHandler
-	engine quest.QuestEngine
+	engine   quest.QuestEngine
+	sessions *authoringSessions
 }
 
 func (h *answerHandler) Name() string {
@@ -22,6 +25,10 @@ func (h *answerHandler) HandleOne(msg tgbotapi.Message) {
 	userID := tgbotbase.UserID(msg.From.ID)
 	chatID := msg.Chat.ID
 	logger := log.WithFields(log.Fields{"userID": userID, "userName": msg.From.UserName, "message": msg.Text})
+	if h.sessions.Claimed(userID, msg.MessageID) {
+		logger.Debug("User is authoring a stage, skipping")
+		return
+	}
 	logger.Debug("Incoming answer")
 	res := h.engine.CheckAnswer(userID, msg.Text)
 	if !res.Active {
@@ -29,7 +36,15 @@ func (h *answerHandler) HandleOne(msg tgbotapi.Message) {
 		return
 	}
 
-	if !res.Correct {
+	if res.Cooldown > 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, cooldownText(res.Cooldown))
+	} else if res.Pending {
+		if res.Submission != nil {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Ответ отправлен организаторам на проверку")
+		} else {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Твой ответ уже на проверке, дождись решения организаторов")
+		}
+	} else if !res.Correct {
 		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Ответ неверный!")
 	} else {
 		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Правильно!")
@@ -41,11 +56,15 @@ func (h *answerHandler) HandleOne(msg tgbotapi.Message) {
 	}
 }
 
+func cooldownText(wait time.Duration) string {
+	return fmt.Sprintf("Слишком много неверных ответов. Попробуй снова через %s", wait.Round(time.Second))
+}
+
 func (h *answerHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
 	h.OutMsgCh = outCh
 	return tgbotbase.NewHandlerTrigger(regexp.MustCompile("^[^/].*"), nil)
 }
 
-func NewAnswerHandler(engine quest.QuestEngine) tgbotbase.IncomingMessageHandler {
-	return &answerHandler{engine: engine}
+func NewAnswerHandler(engine quest.QuestEngine, sessions *authoringSessions) tgbotbase.IncomingMessageHandler {
+	return &answerHandler{engine: engine, sessions: sessions}
 }
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+type authoringStep int
+
+const (
+	stepQuestion authoringStep = iota
+	stepPicture
+	stepAnswers
+	stepOptions
+)
+
+// correctMark starts correct options of a choice stage sent by an author
+const correctMark = "*"
+
+// authoringSession collects a stage sent by an owner step by step
+type authoringSession struct {
+	questID string
+	stageID string
+	step    authoringStep
+	// old is set when an existing stage is edited
+	old *quest.Stage
+
+	question string
+	pic      []byte
+	picRef   string
+	picID    string
+}
+
+// authoringSessions are shared with the answer handler so that messages of authors are not taken as answers,
+// both handlers get every message and the first one to claim it decides who owns it
+type authoringSessions struct {
+	mutex    sync.Mutex
+	sessions map[tgbotbase.UserID]*authoringSession
+	// claimed keeps the last message of a user taken by a session, so that the answer handler skips it
+	// even if the session has been already finished by the time the answer handler sees the message
+	claimed map[tgbotbase.UserID]int
+}
+
+func newAuthoringSessions() *authoringSessions {
+	return &authoringSessions{
+		sessions: make(map[tgbotbase.UserID]*authoringSession, 0),
+		claimed:  make(map[tgbotbase.UserID]int, 0)}
+}
+
+// Claimed tells whether the message belongs to an authoring session
+func (s *authoringSessions) Claimed(userID tgbotbase.UserID, messageID int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, claimed := s.claimLocked(userID, messageID)
+	return claimed
+}
+
+// claim returns the session the message belongs to, nil if there is no session in progress
+func (s *authoringSessions) claim(userID tgbotbase.UserID, messageID int) *authoringSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, _ := s.claimLocked(userID, messageID)
+	return session
+}
+
+// claimLocked returns the session in progress and whether the message belongs to authoring,
+// a message which has finished a session stays claimed though the session is gone
+func (s *authoringSessions) claimLocked(userID tgbotbase.UserID, messageID int) (*authoringSession, bool) {
+	session := s.sessions[userID]
+	if id, found := s.claimed[userID]; found && id == messageID {
+		return session, true
+	}
+	if session == nil {
+		delete(s.claimed, userID)
+		return nil, false
+	}
+	s.claimed[userID] = messageID
+	return session, true
+}
+
+func (s *authoringSessions) set(userID tgbotbase.UserID, session *authoringSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session == nil {
+		delete(s.sessions, userID)
+		return
+	}
+	s.sessions[userID] = session
+}
+
+const authoringUsage = `Usage:
+/newquest <quest> [title] - create a quest
+/addstage <quest> <stage> - add a stage
+/editstage <quest> <stage> - replace a stage
+/delstage <quest> <stage> - delete a stage
+/publish <quest> [public|hidden|invite] - make changes live as a new version
+/versions <quest> - list published versions
+/rollback <quest> <version> - make a previous version live
+/cancel - stop editing a stage`
+
+type authoringHandler struct {
+	tgbotbase.BaseHandler
+	engine   quest.QuestEngine
+	storage  quest.QuestStorage
+	staff    quest.Staff
+	sessions *authoringSessions
+	loc      *time.Location
+}
+
+func (h *authoringHandler) Name() string {
+	return "authoring handler"
+}
+
+func (h *authoringHandler) HandleOne(msg tgbotapi.Message) {
+	userID := tgbotbase.UserID(msg.From.ID)
+	if !h.staff.IsOwner(userID) {
+		return
+	}
+	chatID := msg.Chat.ID
+	args := strings.Fields(msg.CommandArguments())
+	switch msg.Command() {
+	case "newquest":
+		h.newQuest(chatID, args)
+	case "addstage", "editstage":
+		h.startStage(chatID, userID, args, msg.Command() == "editstage")
+	case "delstage":
+		h.deleteStage(chatID, args)
+	case "publish":
+		h.publish(chatID, args)
+	case "versions":
+		h.versions(chatID, args)
+	case "rollback":
+		h.rollback(chatID, args)
+	case "cancel":
+		if session := h.sessions.claim(userID, msg.MessageID); session != nil {
+			h.sessions.set(userID, nil)
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Editing cancelled, nothing has been saved")
+		}
+	default:
+		if session := h.sessions.claim(userID, msg.MessageID); session != nil {
+			h.continueStage(chatID, userID, session, msg)
+		}
+	}
+}
+
+// questExists checks both live and stored quests since a new quest has no stages to be loaded by the engine
+func (h *authoringHandler) questExists(questID string) (*quest.Quest, bool) {
+	q, err := h.storage.LoadQuest(questID)
+	if err != nil {
+		log.WithFields(log.Fields{"quest": questID, "error": err}).Warn("Unable to load quest for authoring")
+		return nil, false
+	}
+	_, live := h.engine.GetQuestInfo(questID)
+	return q, live || len(q.StageIDs()) > 0 || q.Info().Title != ""
+}
+
+func (h *authoringHandler) newQuest(chatID int64, args []string) {
+	if len(args) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID := args[0]
+	if len(questID) > quest.MaxQuestIDLen {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest ID must not be longer than %d bytes", quest.MaxQuestIDLen))
+		return
+	}
+	if _, exists := h.questExists(questID); exists {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' already exists", questID))
+		return
+	}
+	title := strings.Join(args[1:], " ")
+	if title == "" {
+		title = questID
+	}
+	q := quest.NewQuest()
+	q.SetInfo(quest.QuestInfo{Title: title, Visibility: quest.VisibilityHidden, Ranking: quest.RankFirst})
+	if err := h.storage.StoreQuest(*quest.NewQuestRecord(questID, q)); err != nil {
+		log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to store new quest")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to create quest: %s", err))
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' created. Add stages with /addstage %s <stage>", questID, questID))
+}
+
+func (h *authoringHandler) startStage(chatID int64, userID tgbotbase.UserID, args []string, edit bool) {
+	if len(args) != 2 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID, stageID := args[0], args[1]
+	q, exists := h.questExists(questID)
+	if !exists {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' not found, create it with /newquest", questID))
+		return
+	}
+	session := &authoringSession{questID: questID, stageID: stageID, step: stepQuestion}
+	stage, found := q.Stage(stageID)
+	if edit {
+		if !found {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Stage '%s' not found in '%s'", stageID, questID))
+			return
+		}
+		session.old = &stage
+	} else if found {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Stage '%s' already exists, use /editstage", stageID))
+		return
+	}
+	h.sessions.set(userID, session)
+
+	text := "Send the question text"
+	if edit {
+		text = fmt.Sprintf("Current question:\n%s\n\nSend a new question text or /keep", stage.Question())
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, text)
+}
+
+func (h *authoringHandler) continueStage(chatID int64, userID tgbotbase.UserID, session *authoringSession, msg tgbotapi.Message) {
+	keep := msg.Command() == "keep" && session.old != nil
+	keepHint := ""
+	if session.old != nil {
+		keepHint = ", /keep to leave it unchanged"
+	}
+
+	switch session.step {
+	case stepQuestion:
+		if keep {
+			session.question = session.old.Question()
+		} else if msg.Text != "" && !msg.IsCommand() {
+			session.question = msg.Text
+		} else {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Send the question text, /cancel to stop")
+			return
+		}
+		session.step = stepPicture
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Send a picture, /nopic for a stage without a picture%s", keepHint))
+	case stepPicture:
+		if keep {
+			session.pic = session.old.Picture()
+			session.picRef = session.old.PictureRef()
+			session.picID = session.old.PictureID()
+		} else if msg.Photo != nil && len(*msg.Photo) > 0 {
+			// the last size is the largest one
+			photos := *msg.Photo
+			session.picID = photos[len(photos)-1].FileID
+		} else if msg.Command() != "nopic" {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Send a picture or /nopic, /cancel to stop")
+			return
+		}
+		session.step = stepAnswers
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, answersPrompt(session, keepHint))
+	case stepAnswers:
+		var stage quest.Stage
+		if keep {
+			stage = quest.NewStage(session.question, session.old.Answers())
+			stage.SetType(session.old.Type())
+			if session.old.Type() == quest.StageChoice {
+				stage.SetOptions(session.old.Options(), session.old.ShuffleOptions())
+			}
+		} else if msg.Command() == "options" {
+			session.step = stepOptions
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Send options one per line, mark correct ones with %s at the start", correctMark))
+			return
+		} else if msg.Command() == "moderated" {
+			stage = quest.NewStage(session.question, nil)
+			stage.SetType(quest.StageModerated)
+		} else if answers := answerLines(msg.Text); len(answers) > 0 && !msg.IsCommand() {
+			stage = quest.NewStage(session.question, answers)
+		} else {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Send answers one per line, /options or /moderated, /cancel to stop")
+			return
+		}
+		h.finishStage(chatID, userID, session, stage)
+	case stepOptions:
+		options, answers := optionLines(msg.Text)
+		if msg.IsCommand() || len(options) < 2 || len(answers) == 0 {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Send at least two options one per line and mark correct ones with %s, /cancel to stop", correctMark))
+			return
+		}
+		// an edited choice stage keeps shuffling its options
+		shuffle := session.old != nil && session.old.Type() == quest.StageChoice && session.old.ShuffleOptions()
+		stage := quest.NewStage(session.question, answers)
+		stage.SetType(quest.StageChoice)
+		stage.SetOptions(options, shuffle)
+		h.finishStage(chatID, userID, session, stage)
+	}
+}
+
+// answersPrompt shows options of an edited choice stage since they are kept only with /keep
+// and answers sent as text turn the stage into a text one
+func answersPrompt(session *authoringSession, keepHint string) string {
+	text := fmt.Sprintf("Send answers one per line, /options for a choice stage, /moderated for a stage judged by organizers%s", keepHint)
+	if session.old == nil || session.old.Type() != quest.StageChoice {
+		return text
+	}
+	correct := make(map[string]bool, 0)
+	for _, a := range session.old.Answers() {
+		correct[a] = true
+	}
+	lines := make([]string, 0, len(session.old.Options()))
+	for _, opt := range session.old.Options() {
+		if correct[strings.ToLower(opt)] {
+			opt = correctMark + opt
+		}
+		lines = append(lines, opt)
+	}
+	return fmt.Sprintf("The stage is a choice between:\n%s\n\n/keep leaves these options as they are, check that they still fit the question; "+
+		"/options replaces them; answers sent as text make it a text stage without buttons.\n\n%s", strings.Join(lines, "\n"), text)
+}
+
+func (h *authoringHandler) finishStage(chatID int64, userID tgbotbase.UserID, session *authoringSession, stage quest.Stage) {
+	stage.AddPicture(session.pic)
+	stage.SetPictureRef(session.picRef)
+	stage.SetPictureID(session.picID)
+	h.sessions.set(userID, nil)
+	h.saveStage(chatID, session, stage)
+}
+
+func answerLines(text string) []string {
+	answers := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			answers = append(answers, line)
+		}
+	}
+	return answers
+}
+
+// optionLines returns options of a choice stage and the correct ones among them
+func optionLines(text string) (options []string, answers []string) {
+	for _, line := range answerLines(text) {
+		if strings.HasPrefix(line, correctMark) {
+			line = strings.TrimSpace(strings.TrimPrefix(line, correctMark))
+			if line == "" {
+				continue
+			}
+			answers = append(answers, line)
+		}
+		options = append(options, line)
+	}
+	return options, answers
+}
+
+func (h *authoringHandler) saveStage(chatID int64, session *authoringSession, stage quest.Stage) {
+	logger := log.WithFields(log.Fields{"quest": session.questID, "stage": session.stageID})
+	// an edited stage is replaced by the same write, so it never disappears if saving fails
+	if err := h.storage.StoreStage(session.questID, quest.NewStageRecord(session.stageID, stage)); err != nil {
+		logger.WithField("error", err).Error("Unable to store stage")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to save stage: %s", err))
+		return
+	}
+	logger.Info("Stage has been saved")
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Stage '%s' saved. Send /publish %s to make changes live", session.stageID, session.questID))
+}
+
+func (h *authoringHandler) deleteStage(chatID int64, args []string) {
+	if len(args) != 2 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID, stageID := args[0], args[1]
+	q, exists := h.questExists(questID)
+	if !exists {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' not found", questID))
+		return
+	}
+	if _, found := q.Stage(stageID); !found {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Stage '%s' not found in '%s'", stageID, questID))
+		return
+	}
+	if err := h.storage.DeleteStage(questID, stageID); err != nil {
+		log.WithFields(log.Fields{"quest": questID, "stage": stageID, "error": err}).Error("Unable to delete stage")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to delete stage: %s", err))
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Stage '%s' deleted. Send /publish %s to make changes live", stageID, questID))
+}
+
+// publish makes the draft a new version, players in progress keep the version they started
+func (h *authoringHandler) publish(chatID int64, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID := args[0]
+	q, exists := h.questExists(questID)
+	if !exists || len(q.StageIDs()) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' has no stages", questID))
+		return
+	}
+	if len(args) == 2 {
+		visibility, err := quest.ParseVisibility(args[1])
+		if err != nil {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, err.Error())
+			return
+		}
+		info := q.Info()
+		info.Visibility = visibility
+
+		// a quest without stages stores only its info
+		infoOnly := quest.NewQuest()
+		infoOnly.SetInfo(info)
+		if err := h.storage.StoreQuest(*quest.NewQuestRecord(questID, infoOnly)); err != nil {
+			log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to store quest info")
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to publish quest: %s", err))
+			return
+		}
+	}
+	v, issues, err := h.engine.PublishQuest(questID)
+	problems := ""
+	for _, i := range issues {
+		problems += "\n" + i.String()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to publish quest")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to publish quest: %s%s", err, problems))
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' published as version %d with %d stages (%s)%s", questID, v.Number, len(v.Quest.StageIDs()), v.Quest.Info().Visibility, problems))
+}
+
+func (h *authoringHandler) versions(chatID int64, args []string) {
+	if len(args) != 1 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID := args[0]
+	versions, current, err := h.engine.ListVersions(questID)
+	if err != nil {
+		log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to list versions")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to list versions: %s", err))
+		return
+	}
+	if len(versions) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Quest '%s' has never been published", questID))
+		return
+	}
+	text := fmt.Sprintf("Versions of '%s':", questID)
+	for _, v := range versions {
+		mark := ""
+		if v.Number == current {
+			mark = " (live)"
+		}
+		text = fmt.Sprintf("%s\n%d: published %s, %d stages%s", text, v.Number, v.Published.In(h.loc).Format("02.01.2006 15:04"), len(v.Quest.StageIDs()), mark)
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, text)
+}
+
+func (h *authoringHandler) rollback(chatID int64, args []string) {
+	if len(args) != 2 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	questID := args[0]
+	number, err := strconv.Atoi(args[1])
+	if err != nil {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, authoringUsage)
+		return
+	}
+	v, err := h.engine.RollbackQuest(questID, number)
+	if err != nil {
+		log.WithFields(log.Fields{"quest": questID, "version": number, "error": err}).Error("Unable to roll back quest")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to roll back quest: %s", err))
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Version %d of '%s' is live again, players in progress keep their versions", v.Number, questID))
+}
+
+func (h *authoringHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	// any message may be a part of a stage, including pictures without text
+	return tgbotbase.NewHandlerTrigger(regexp.MustCompile(""), []string{"newquest", "addstage", "editstage", "delstage", "publish", "versions", "rollback", "cancel", "keep", "nopic", "options", "moderated"})
+}
+
+func newAuthoringHandler(engine quest.QuestEngine, storage quest.QuestStorage, staff quest.Staff, sessions *authoringSessions, loc *time.Location) tgbotbase.IncomingMessageHandler {
+	return &authoringHandler{engine: engine, storage: storage, staff: staff, sessions: sessions, loc: loc}
+}
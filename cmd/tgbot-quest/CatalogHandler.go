@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const catalogStartPrefix = "start:"
+
+// catalogMessages describes public quests in as many messages as Telegram limits require,
+// buttons to start quests are attached to the last one
+func catalogMessages(engine quest.QuestEngine, chatID int64) []tgbotapi.Chattable {
+	quests := engine.ListQuests()
+	if len(quests) == 0 {
+		return []tgbotapi.Chattable{tgbotapi.NewMessage(chatID, "Сейчас нет открытых квестов")}
+	}
+
+	entries := make([]string, 0, len(quests))
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(quests))
+	for _, q := range quests {
+		// entries start with a line break so that quests are separated by an empty line
+		entry := "\n" + q.Title()
+		if q.Info.Difficulty != "" {
+			entry = fmt.Sprintf("%s (сложность: %s)", entry, q.Info.Difficulty)
+		}
+		if q.Info.Description != "" {
+			entry = fmt.Sprintf("%s\n%s", entry, q.Info.Description)
+		}
+		entries = append(entries, entry)
+		button := tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Начать: %s", q.Title()), catalogStartPrefix+q.ID)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(button))
+	}
+	texts := quest.SplitMessage("Доступные квесты:", entries)
+	res := make([]tgbotapi.Chattable, 0, len(texts))
+	for i, text := range texts {
+		msg := tgbotapi.NewMessage(chatID, text)
+		if i == len(texts)-1 {
+			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		}
+		res = append(res, msg)
+	}
+	return res
+}
+
+type catalogHandler struct {
+	tgbotbase.BaseHandler
+	engine quest.QuestEngine
+}
+
+func (h *catalogHandler) Name() string {
+	return "catalog"
+}
+
+func (h *catalogHandler) HandleOne(msg tgbotapi.Message) {
+	for _, out := range catalogMessages(h.engine, msg.Chat.ID) {
+		h.OutMsgCh <- out
+	}
+}
+
+func (h *catalogHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"quests"})
+}
+
+func newCatalogHandler(engine quest.QuestEngine) tgbotbase.IncomingMessageHandler {
+	return &catalogHandler{engine: engine}
+}
+
+type catalogStartHandler struct {
+	tgbotbase.BaseHandler
+	engine  quest.QuestEngine
+	names   *sync.Map
+	answers callbackAnswerer
+}
+
+func (h *catalogStartHandler) Name() string {
+	return "catalog start"
+}
+
+func (h *catalogStartHandler) HandleOne(query tgbotapi.CallbackQuery) {
+	// the result is sent as messages, the button is answered at once
+	h.answers.AnswerCallback(query, "")
+	if query.Message == nil {
+		return
+	}
+	userID := tgbotbase.UserID(query.From.ID)
+	chatID := query.Message.Chat.ID
+	questID := strings.TrimPrefix(query.Data, catalogStartPrefix)
+	log.WithFields(log.Fields{"userID": userID, "userName": query.From.UserName, "quest": questID}).Debug("Incoming start from catalog")
+	h.names.Store(query.From.ID, query.From.UserName)
+	startQuest(h.OutMsgCh, h.engine, chatID, userID, questID)
+}
+
+func (h *catalogStartHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(regexp.MustCompile("^"+catalogStartPrefix), nil)
+}
+
+func newCatalogStartHandler(engine quest.QuestEngine, usernames *sync.Map, answers callbackAnswerer) tgbotbase.IncomingCallbackHandler {
+	return &catalogStartHandler{engine: engine, names: usernames, answers: answers}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+type choiceHandler struct {
+	tgbotbase.BaseHandler
+	engine  quest.QuestEngine
+	answers callbackAnswerer
+}
+
+func (h *choiceHandler) Name() string {
+	return "choice handler"
+}
+
+func (h *choiceHandler) HandleOne(query tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		h.answers.AnswerCallback(query, "")
+		return
+	}
+	userID := tgbotbase.UserID(query.From.ID)
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+	logger := log.WithFields(log.Fields{"userID": userID, "userName": query.From.UserName, "data": query.Data})
+	if quest.IsTriedChoice(query.Data) {
+		logger.Debug("Already tried option, skipping")
+		h.answers.AnswerCallback(query, "Этот вариант уже был")
+		return
+	}
+	choice, ok := quest.ParseChoiceData(query.Data)
+	if !ok {
+		logger.Debug("Button of an older version of the bot, disabling buttons")
+		h.answers.AnswerCallback(query, "Этот вопрос уже неактуален")
+		h.OutMsgCh <- tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, quest.EmptyKeyboard())
+		return
+	}
+
+	logger.Debug("Incoming choice")
+	res, ok := h.engine.CheckChoice(userID, choice)
+	if !res.Active {
+		logger.Debug("No Active quests, skipping")
+		h.answers.AnswerCallback(query, "Нет активного квеста")
+		return
+	}
+	if !ok {
+		logger.Debug("Option of an outdated question, disabling buttons")
+		h.answers.AnswerCallback(query, "Этот вопрос уже неактуален")
+		h.OutMsgCh <- tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, quest.EmptyKeyboard())
+		return
+	}
+
+	h.answers.AnswerCallback(query, "")
+	if res.Cooldown > 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, cooldownText(res.Cooldown))
+		return
+	}
+
+	if !res.Correct {
+		if keyboard := h.engine.GetCurrentKeyboard(userID); keyboard != nil {
+			h.OutMsgCh <- tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, *keyboard)
+		}
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Ответ неверный!")
+		return
+	}
+
+	h.OutMsgCh <- tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, quest.EmptyKeyboard())
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Правильно!")
+	if res.Finished {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Это был последний вопрос. Ты молодец!")
+	} else {
+		h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+	}
+}
+
+func (h *choiceHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(regexp.MustCompile("^choice:"), nil)
+}
+
+func NewChoiceHandler(engine quest.QuestEngine, answers callbackAnswerer) tgbotbase.IncomingCallbackHandler {
+	return &choiceHandler{engine: engine, answers: answers}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const inviteUsage = "Usage: /invite <quest> [max uses, 0 - unlimited] [lifetime, e.g. 48h, - for none] [team]"
+
+type inviteHandler struct {
+	tgbotbase.BaseHandler
+	engine quest.QuestEngine
+	staff  quest.Staff
+	loc    *time.Location
+	// botName is the username of the bot used in deep links
+	botName string
+}
+
+func (h *inviteHandler) Name() string {
+	return "invite handler"
+}
+
+func (h *inviteHandler) HandleOne(msg tgbotapi.Message) {
+	userID := tgbotbase.UserID(msg.From.ID)
+	if !h.staff.IsStaff(userID) {
+		return
+	}
+	chatID := msg.Chat.ID
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, inviteUsage)
+		return
+	}
+
+	questID := args[0]
+	if !h.staff.CanManage(userID, questID) {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("You do not run quest '%s'", questID))
+		return
+	}
+	var maxUses int64
+	var ttl time.Duration
+	var team string
+	var err error
+	if len(args) > 1 {
+		if maxUses, err = strconv.ParseInt(args[1], 10, 64); err != nil || maxUses < 0 {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, inviteUsage)
+			return
+		}
+	}
+	// a lifetime is either positive or explicitly absent, zero or negative ones are mistakes rather than 'forever'
+	if len(args) > 2 && args[2] != "-" {
+		if ttl, err = time.ParseDuration(args[2]); err != nil || ttl <= 0 {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, inviteUsage)
+			return
+		}
+	}
+	if len(args) > 3 {
+		team = strings.Join(args[3:], " ")
+	}
+
+	inv, err := h.engine.CreateInvite(questID, team, maxUses, ttl)
+	if err != nil {
+		log.WithFields(log.Fields{"quest": questID, "error": err}).Warn("Unable to create invite")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to create invite: %s", err))
+		return
+	}
+	text := fmt.Sprintf("Invite for '%s': %s\nDeep link: https://t.me/%s?start=%s", inv.QuestID, inv.Code, h.botName, inv.Code)
+	if !inv.Expires.IsZero() {
+		text = fmt.Sprintf("%s\nExpires at %s", text, inv.Expires.In(h.loc).Format("02.01.2006 15:04 MST"))
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, text)
+}
+
+func (h *inviteHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"invite"})
+}
+
+func newInviteHandler(engine quest.QuestEngine, staff quest.Staff, loc *time.Location, botName string) tgbotbase.IncomingMessageHandler {
+	return &inviteHandler{engine: engine, staff: staff, loc: loc, botName: botName}
+}
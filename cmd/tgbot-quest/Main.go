@@ -1,59 +1,208 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/config"
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/metrics"
 	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
 	"github.com/admirallarimda/tgbotbase"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/gcfg.v1"
+	"gopkg.in/telegram-bot-api.v4"
 	"math/rand"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-type config struct {
-	tgbotbase.Config
-	Redis tgbotbase.RedisConfig
-	Owner struct {
-		ID int
+var argConfig = flag.String("config", "", "Path to the configuration, bot.cfg by default (env QUEST_CONFIG)")
+var argCheckConfig = flag.Bool("check-config", false, "Validate the configuration and exit")
+
+// readConfig reads and validates the configuration, the bot exits listing all problems if there are any
+func readConfig() config.Config {
+	filename := *argConfig
+	if filename == "" {
+		filename = os.Getenv("QUEST_CONFIG")
+	}
+	if filename == "" {
+		filename = "bot.cfg"
+	}
+	cfg, err := config.ReadFile(filename)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"file": filename}).Error("Configuration cannot be used")
+		fmt.Fprintf(os.Stderr, "tgbot-quest: %s\n", err)
+		os.Exit(2)
 	}
+
+	log.WithFields(log.Fields{"file": filename, "storage": cfg.Storage.Backend, "blobs": cfg.Blobs.Backend, "sinks": cfg.Events.Sink}).Info("Configuration has been successfully read")
+	return cfg
 }
 
-func readGcfg(filename string) config {
-	log.WithFields(log.Fields{"file": filename}).Info("Reading configuration")
+func userIDs(ids []int) []tgbotbase.UserID {
+	res := make([]tgbotbase.UserID, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, tgbotbase.UserID(id))
+	}
+	return res
+}
 
-	var cfg config
+func newStaff(cfg config.Config) quest.Staff {
+	staff := quest.NewStaff(userIDs(cfg.Owner.ID))
+	for name, org := range cfg.Organizer {
+		if len(org.ID) == 0 || len(org.Quest) == 0 {
+			log.WithFields(log.Fields{"organizer": name}).Warn("Organizer group without members or quests, skipping")
+			continue
+		}
+		staff.AddOrganizers(userIDs(org.ID), org.Quest, org.Chat)
+		log.WithFields(log.Fields{"organizer": name, "members": org.ID, "quests": org.Quest}).Info("Organizers have been configured")
+	}
+	return staff
+}
 
-	err := gcfg.ReadFileInto(&cfg, filename)
+// newStorages creates storages of the configured backend, the pool is nil unless Redis is needed
+func newStorages(cfg config.Config, pool tgbotbase.RedisPool) quest.Storages {
+	storages, err := cfg.NewStorages(pool)
 	if err != nil {
-		log.WithFields(log.Fields{"file": filename, "error": err}).Error("Could not correctly parse configuration")
-		panic(err)
+		log.WithFields(log.Fields{"backend": cfg.Storage.Backend, "blobs": cfg.Blobs.Backend, "error": err}).Panic("Unable to open storage")
+	}
+	return storages
+}
+
+// newEventPublisher composes sinks enabled in the configuration, telegram is used if nothing is set,
+// stats, metrics and moderation sinks are always added
+func newEventPublisher(cfg config.Config, sender quest.Sender, pool tgbotbase.RedisPool, notifications quest.OwnerNotifications, usernames *sync.Map, stats quest.StatsSink, metricsSink quest.EventSink) quest.EventPublisher {
+	names := cfg.Events.Sink
+	if len(names) == 0 {
+		names = []string{"telegram"}
 	}
 
-	log.WithFields(log.Fields{"file": filename, "cfg": cfg}).Info("Configuration has been successfully read")
-	return cfg
+	// stored events are loaded before any sink is created so that the telegram sink continues numbering attempts
+	var history []quest.Event
+	var redisSink quest.RedisEventSink
+	for _, name := range names {
+		if name != "redis" || redisSink != nil {
+			continue
+		}
+		redisSink = quest.NewRedisEventSink(pool)
+		events, err := redisSink.LoadEvents()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Unable to load stored events, stats start from scratch")
+		} else {
+			history = events
+			stats.Replay(events)
+		}
+	}
+
+	sinks := []quest.EventSink{stats, metricsSink, quest.NewModerationSink(sender, notifications, usernames)}
+	for _, name := range names {
+		switch name {
+		case "telegram":
+			digest := time.Duration(cfg.Events.DigestSeconds) * time.Second
+			sinks = append(sinks, quest.NewTelegramSink(sender, notifications, usernames, digest, history))
+		case "redis":
+			sinks = append(sinks, redisSink)
+		case "log":
+			sinks = append(sinks, quest.NewLogSink())
+		case "webhook":
+			sinks = append(sinks, quest.NewWebhookSink(cfg.Events.WebhookURL))
+		default:
+			log.WithFields(log.Fields{"sink": name}).Panic("Unknown event sink")
+		}
+	}
+	return quest.NewEventPublisher(quest.PublisherConfig{QueueSize: cfg.Events.QueueSize}, sinks...)
+}
+
+// sendValidationReport tells owners about quests which have not been loaded or have problems
+func sendValidationReport(sender quest.Sender, staff quest.Staff, report quest.ValidationReport) {
+	if len(report.Issues) == 0 && len(report.Failures) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"report": report.String()}).Warn("Quests have validation problems")
+	lines := strings.Split(report.String(), "\n")
+	for _, msg := range quest.SplitMessage(lines[0], lines[1:]) {
+		for _, owner := range staff.Owners() {
+			if err := sender.Send(tgbotapi.NewMessage(int64(owner), msg)); err != nil {
+				log.WithFields(log.Fields{"owner": owner, "error": err}).Error("Unable to send validation report")
+			}
+		}
+	}
 }
 
 func main() {
 	log.SetLevel(log.DebugLevel)
 	log.Info("Starting daily budget bot")
 
-	cfg := readGcfg("bot.cfg")
+	flag.Parse()
+	cfg := readConfig()
+	if *argCheckConfig {
+		fmt.Println("Configuration is valid")
+		return
+	}
+	engineCfg, err := cfg.EngineConfig()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Panic("Engine configuration has not been validated")
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Panic("Timezone has not been validated")
+	}
 	botCfg := tgbotbase.Config{TGBot: cfg.TGBot, Proxy_SOCKS5: cfg.Proxy_SOCKS5}
 	tgbot := tgbotbase.NewBot(botCfg)
+	tgAPI := newTelegramAPI(botCfg)
 
 	rand.Seed(int64(time.Now().Second()))
 
 	var usernames sync.Map
 
-	pool := tgbotbase.NewRedisPool(cfg.Redis)
-	resmon := quest.NewTGResultMonitor(tgbot, []tgbotbase.UserID{tgbotbase.UserID(cfg.Owner.ID)}, &usernames)
-	engine := quest.NewQuestEngine(pool, resmon)
+	staff := newStaff(cfg)
+	var pool tgbotbase.RedisPool
+	if cfg.NeedsRedis() {
+		pool = tgbotbase.NewRedisPool(cfg.Redis)
+	}
+	storages := newStorages(cfg, pool)
+	registry := metrics.NewRegistry()
+	status := &botStatus{}
+	gate := &handlerGate{}
+	observer := newHandlerObserver(registry, status, gate)
+	stats := quest.NewStatsSink(&usernames)
+	notifications := quest.NewOwnerNotifications(storages.State, staff)
+	events := newEventPublisher(cfg, tgAPI, pool, notifications, &usernames, stats, quest.NewMetricsSink(registry))
+	engine := quest.NewQuestEngine(engineCfg, storages, events)
+	registerBotMetrics(registry, engine, events, tgAPI)
+	sendValidationReport(tgAPI, staff, engine.Validation())
+	sessions := newAuthoringSessions()
 
-	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(NewStartHandler(engine, &usernames)))
-	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(NewAnswerHandler(engine)))
-	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(newStatsHandler(resmon)))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(NewStartHandler(engine, &usernames))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newCatalogHandler(engine))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(NewAnswerHandler(engine, sessions))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newPlayerHandler(engine, stats, loc))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newSwitchHandler(engine))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newStatsHandler(stats, engine, staff))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newPendingHandler(engine, staff, &usernames))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newInviteHandler(engine, staff, loc, tgAPI.Username()))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newNotifyHandler(notifications))))
+	tgbot.AddHandler(tgbotbase.NewIncomingMessageDealer(observer.messages(newAuthoringHandler(engine, storages.Quests, staff, sessions, loc))))
+	tgbot.AddHandler(tgbotbase.NewIncomingCallbackDealer(observer.callbacks(NewModerationHandler(engine, staff, tgAPI))))
+	tgbot.AddHandler(tgbotbase.NewIncomingCallbackDealer(observer.callbacks(NewChoiceHandler(engine, tgAPI))))
+	tgbot.AddHandler(tgbotbase.NewIncomingCallbackDealer(observer.callbacks(newCatalogStartHandler(engine, &usernames, tgAPI))))
+	tgbot.AddHandler(tgbotbase.NewIncomingCallbackDealer(observer.callbacks(newSwitchCallbackHandler(engine, tgAPI))))
 
-	tgbot.Start()
+	var server *http.Server
+	if cfg.HTTP.Listen != "" {
+		tgAPI.watch(telegramCheckInterval, status)
+		server = startStatusServer(cfg.HTTP.Listen, registry, status, pool)
+	}
 
-	log.Info("Daily budget bot has stopped")
+	// the shutdown exits the process, polling is not stopped as tgbotbase cannot stop it
+	shutdown := newShutdown(tgAPI, gate, status, engine, events, staff, cfg.ShutdownTimeout(), server)
+	shutdown.watch()
+	status.setPolling(true)
+	tgbot.Start()
+	log.Error("Polling of updates has stopped")
+	shutdown.stop()
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+type moderationHandler struct {
+	tgbotbase.BaseHandler
+	engine  quest.QuestEngine
+	staff   quest.Staff
+	answers callbackAnswerer
+}
+
+func (h *moderationHandler) Name() string {
+	return "moderation handler"
+}
+
+// HandleOne checks the user who has pressed the button rather than the chat, so members of an organizers'
+// group chat who are not staff of the quest see submissions but cannot moderate them
+func (h *moderationHandler) HandleOne(query tgbotapi.CallbackQuery) {
+	userID := tgbotbase.UserID(query.From.ID)
+	logger := log.WithFields(log.Fields{"userID": userID, "userName": query.From.UserName, "data": query.Data})
+	if !h.staff.IsStaff(userID) {
+		logger.Warn("Moderation decision from non-staff, skipping")
+		h.answers.AnswerCallback(query, "Only organizers can moderate answers")
+		return
+	}
+	id, approved, ok := quest.ParseModerationData(query.Data)
+	if !ok {
+		logger.Warn("Malformed moderation data")
+		h.answers.AnswerCallback(query, "")
+		return
+	}
+	logger.Debug("Incoming moderation decision")
+
+	sub, res, err := h.engine.ResolveSubmission(id, quest.Decision{
+		Approved:  approved,
+		Moderator: query.From.UserName,
+		Authorize: func(sub quest.Submission) bool {
+			return h.staff.CanManage(userID, sub.QuestID)
+		}})
+	if err == quest.ErrNotAuthorized {
+		logger.WithField("quest", sub.QuestID).Warn("Moderation decision from organizer of another quest, skipping")
+		h.answers.AnswerCallback(query, "You do not organize this quest")
+		return
+	}
+	if err == quest.ErrSubmissionResolved {
+		// the button belongs to a copy of the submission sent to another moderator
+		decision := "Already resolved"
+		if r, found := h.engine.Resolution(id); found {
+			decision = fmt.Sprintf("Already %s by %s", r.Verb(), r.Moderator)
+		}
+		logger.Debug("Submission has been already resolved")
+		h.answers.AnswerCallback(query, decision)
+		h.closeSubmission(query, decision)
+		return
+	}
+	decision := "Rejected"
+	if approved {
+		decision = "Approved"
+	}
+	if err != nil {
+		decision = fmt.Sprintf("Not applied: %s", err)
+	}
+	h.answers.AnswerCallback(query, decision)
+	h.closeSubmission(query, fmt.Sprintf("%s by %s", decision, query.From.UserName))
+	if err != nil {
+		return
+	}
+
+	chatID := int64(sub.UserID)
+	if !res.Correct {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Организаторы не приняли ответ, попробуй ещё раз")
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Организаторы приняли ответ!")
+	if res.Finished {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Это был последний вопрос. Ты молодец!")
+	} else {
+		h.OutMsgCh <- h.engine.GetCurrentQuestion(sub.UserID)
+	}
+}
+
+// closeSubmission appends the outcome to the submission message removing its buttons
+func (h *moderationHandler) closeSubmission(query tgbotapi.CallbackQuery, outcome string) {
+	if query.Message == nil {
+		return
+	}
+	text := fmt.Sprintf("%s\n\n%s", query.Message.Text, outcome)
+	h.OutMsgCh <- tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+}
+
+func (h *moderationHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(regexp.MustCompile("^mod:"), nil)
+}
+
+func NewModerationHandler(engine quest.QuestEngine, staff quest.Staff, answers callbackAnswerer) tgbotbase.IncomingCallbackHandler {
+	return &moderationHandler{engine: engine, staff: staff, answers: answers}
+}
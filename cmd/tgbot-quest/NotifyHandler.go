@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const notifyUsage = `Usage:
+/notify - show current settings
+/notify on <event...|all> - subscribe to events
+/notify off <event...|all> - unsubscribe from events
+/notify quests <quest...|all> - limit notifications to quests
+/notify chat here|dm - send notifications to this chat or to direct messages
+/notify streak <N> - report every N wrong answers in a row
+Events: start, finish, abandon, solved, wrong, timeout`
+
+type notifyHandler struct {
+	tgbotbase.BaseHandler
+	notifications quest.OwnerNotifications
+}
+
+func (h *notifyHandler) Name() string {
+	return "notify handler"
+}
+
+func (h *notifyHandler) HandleOne(msg tgbotapi.Message) {
+	owner := tgbotbase.UserID(msg.From.ID)
+	if !h.notifications.Staff().IsStaff(owner) {
+		return
+	}
+	chatID := msg.Chat.ID
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, h.notifications.Get(owner).String())
+		return
+	}
+
+	change, err := notifyChange(args, chatID)
+	if err != nil {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("%s\n\n%s", err, notifyUsage))
+		return
+	}
+	settings, err := h.notifications.Update(owner, change)
+	if err != nil {
+		log.WithFields(log.Fields{"owner": owner, "error": err}).Error("Unable to store notification settings")
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Unable to store settings: %s", err))
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, settings.String())
+}
+
+// notifyChange parses arguments of /notify into a change of settings
+func notifyChange(args []string, chatID int64) (func(s *quest.NotifySettings), error) {
+	cmd, params := args[0], args[1:]
+	switch cmd {
+	case "on", "off":
+		events, err := parseNotifyEvents(params)
+		if err != nil {
+			return nil, err
+		}
+		return func(s *quest.NotifySettings) {
+			for _, e := range events {
+				s.SetEvent(e, cmd == "on")
+			}
+		}, nil
+	case "quests":
+		if len(params) == 0 {
+			return nil, fmt.Errorf("No quests specified")
+		}
+		quests := params
+		if len(params) == 1 && params[0] == "all" {
+			quests = nil
+		}
+		return func(s *quest.NotifySettings) {
+			s.Quests = quests
+		}, nil
+	case "chat":
+		if len(params) != 1 || (params[0] != "here" && params[0] != "dm") {
+			return nil, fmt.Errorf("Chat should be 'here' or 'dm'")
+		}
+		chat := chatID
+		if params[0] == "dm" {
+			chat = 0
+		}
+		return func(s *quest.NotifySettings) {
+			s.ChatID = chat
+		}, nil
+	case "streak":
+		if len(params) != 1 {
+			return nil, fmt.Errorf("No streak length specified")
+		}
+		n, err := strconv.Atoi(params[0])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Streak length should be a positive number")
+		}
+		return func(s *quest.NotifySettings) {
+			s.WrongStreak = n
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown setting '%s'", cmd)
+}
+
+func parseNotifyEvents(params []string) ([]quest.NotifyEvent, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("No events specified")
+	}
+	if len(params) == 1 && params[0] == "all" {
+		return quest.AllNotifyEvents, nil
+	}
+	events := make([]quest.NotifyEvent, 0, len(params))
+	for _, p := range params {
+		e, err := quest.ParseNotifyEvent(p)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (h *notifyHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"notify"})
+}
+
+func newNotifyHandler(notifications quest.OwnerNotifications) tgbotbase.IncomingMessageHandler {
+	return &notifyHandler{notifications: notifications}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func username(names *sync.Map, userID tgbotbase.UserID) string {
+	val, found := names.Load(int(userID))
+	if !found {
+		return strconv.Itoa(int(userID))
+	}
+	return val.(string)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+type pendingHandler struct {
+	tgbotbase.BaseHandler
+	engine quest.QuestEngine
+	staff  quest.Staff
+	names  *sync.Map
+}
+
+func (h *pendingHandler) Name() string {
+	return "pending handler"
+}
+
+func (h *pendingHandler) HandleOne(msg tgbotapi.Message) {
+	userID := tgbotbase.UserID(msg.From.ID)
+	if !h.staff.IsStaff(userID) {
+		return
+	}
+	chatID := msg.Chat.ID
+	subs := make([]quest.Submission, 0)
+	for _, sub := range h.engine.PendingSubmissions() {
+		if h.staff.CanManage(userID, sub.QuestID) {
+			subs = append(subs, sub)
+		}
+	}
+	if len(subs) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "No pending answers")
+		return
+	}
+	for _, sub := range subs {
+		out := tgbotapi.NewMessage(chatID, quest.FormatSubmission(sub, username(h.names, sub.UserID)))
+		out.ReplyMarkup = quest.ModerationKeyboard(sub)
+		h.OutMsgCh <- out
+	}
+}
+
+func (h *pendingHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"pending"})
+}
+
+func newPendingHandler(engine quest.QuestEngine, staff quest.Staff, usernames *sync.Map) tgbotbase.IncomingMessageHandler {
+	return &pendingHandler{engine: engine, staff: staff, names: usernames}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const noActiveQuestText = "У тебя нет активного квеста. Список квестов: /quests"
+
+// playerHandler serves commands which players use during a quest
+type playerHandler struct {
+	tgbotbase.BaseHandler
+	engine quest.QuestEngine
+	stats  quest.StatsSink
+	// loc is the timezone of times shown to players
+	loc *time.Location
+}
+
+func (h *playerHandler) Name() string {
+	return "player commands"
+}
+
+func (h *playerHandler) HandleOne(msg tgbotapi.Message) {
+	userID := tgbotbase.UserID(msg.From.ID)
+	chatID := msg.Chat.ID
+	log.WithFields(log.Fields{"userID": userID, "userName": msg.From.UserName, "command": msg.Command()}).Debug("Incoming player command")
+	switch msg.Command() {
+	case "repeat":
+		h.repeat(chatID, userID)
+	case "status":
+		h.status(chatID, userID)
+	case "skip":
+		h.skip(chatID, userID)
+	case "quit":
+		h.quit(chatID, userID)
+	case "history":
+		h.history(chatID, userID)
+	}
+}
+
+func (h *playerHandler) repeat(chatID int64, userID tgbotbase.UserID) {
+	if _, err := h.engine.GetStatus(userID); err != nil {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, noActiveQuestText)
+		return
+	}
+	h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+}
+
+func (h *playerHandler) status(chatID int64, userID tgbotbase.UserID) {
+	status, err := h.engine.GetStatus(userID)
+	if err != nil {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, noActiveQuestText)
+		return
+	}
+	text := fmt.Sprintf("Квест: %s", status.Title)
+	if status.Team != "" {
+		text = fmt.Sprintf("%s\nКоманда: %s", text, status.Team)
+	}
+	text = fmt.Sprintf("%s\nВопрос %d из %d\nВремя в игре: %s\nОшибок: %d",
+		text, status.Stage, status.StagesTotal, time.Since(status.Started).Round(time.Second), status.Mistakes)
+	if status.Skipped > 0 {
+		text = fmt.Sprintf("%s\nПропущено вопросов: %d (штраф %s)", text, status.Skipped, status.SkipPenalty*time.Duration(status.Skipped))
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, text)
+}
+
+func (h *playerHandler) skip(chatID int64, userID tgbotbase.UserID) {
+	res, err := h.engine.SkipStage(userID)
+	switch err {
+	case nil:
+	case quest.ErrSkipNotAllowed:
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "В этом квесте нельзя пропускать вопросы")
+		return
+	default:
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, noActiveQuestText)
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Вопрос пропущен")
+	if res.Finished {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Это был последний вопрос. Квест завершён!")
+	} else {
+		h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+	}
+}
+
+func (h *playerHandler) quit(chatID int64, userID tgbotbase.UserID) {
+	if err := h.engine.QuitQuest(userID); err != nil {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, noActiveQuestText)
+		return
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Ты покинул квест. Начать другой можно командой /quests")
+}
+
+var attemptResultText = map[quest.AttemptResult]string{
+	quest.AttemptInProgress: "в процессе",
+	quest.AttemptFinished:   "пройдена",
+	quest.AttemptAbandoned:  "брошена",
+	quest.AttemptRestarted:  "начата заново"}
+
+func (h *playerHandler) history(chatID int64, userID tgbotbase.UserID) {
+	attempts := h.stats.GetHistory(userID)
+	if len(attempts) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, "Ты ещё не проходил квесты. Список квестов: /quests")
+		return
+	}
+	text := "Твои попытки:"
+	for _, a := range attempts {
+		title := a.QuestID
+		if info, found := h.engine.GetQuestInfo(a.QuestID); found && info.Title != "" {
+			title = info.Title
+		}
+		text = fmt.Sprintf("%s\n\n%s, попытка %d: %s\nНачата: %s", text, title, a.Number, attemptResultText[a.Result], a.Started.In(h.loc).Format("02.01.2006 15:04"))
+		if a.Result == quest.AttemptFinished {
+			text = fmt.Sprintf("%s\nВремя: %s, ошибок: %d", text, a.Spent().Round(time.Second), a.Mistakes)
+		}
+	}
+	h.OutMsgCh <- tgbotapi.NewMessage(chatID, text)
+}
+
+func (h *playerHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"repeat", "status", "skip", "quit", "history"})
+}
+
+func newPlayerHandler(engine quest.QuestEngine, stats quest.StatsSink, loc *time.Location) tgbotbase.IncomingMessageHandler {
+	return &playerHandler{engine: engine, stats: stats, loc: loc}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// handlerGate lets updates reach handlers until the shutdown closes it, the shutdown waits
+// for handlers which have already started; tgbotbase keeps polling but nothing is handled anymore
+type handlerGate struct {
+	mutex    sync.RWMutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// enter returns false once the gate is closed, leave must be called after a successful enter
+func (g *handlerGate) enter() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.closed {
+		return false
+	}
+	g.inFlight.Add(1)
+	return true
+}
+
+func (g *handlerGate) leave() {
+	g.inFlight.Done()
+}
+
+// close stops new updates and waits for handlers in progress
+func (g *handlerGate) close() {
+	g.mutex.Lock()
+	g.closed = true
+	g.mutex.Unlock()
+	g.inFlight.Wait()
+}
+
+// shutdown stops the bot in order so that accepted answers, queued events and progress of players are not lost
+type shutdown struct {
+	sender  quest.Sender
+	gate    *handlerGate
+	status  *botStatus
+	engine  quest.QuestEngine
+	events  quest.EventPublisher
+	staff   quest.Staff
+	timeout time.Duration
+	// server is closed after the drain if the status server is enabled
+	server *http.Server
+
+	signals chan os.Signal
+	once    sync.Once
+}
+
+func newShutdown(sender quest.Sender, gate *handlerGate, status *botStatus, engine quest.QuestEngine, events quest.EventPublisher, staff quest.Staff, timeout time.Duration, server *http.Server) *shutdown {
+	return &shutdown{
+		sender:  sender,
+		gate:    gate,
+		status:  status,
+		engine:  engine,
+		events:  events,
+		staff:   staff,
+		timeout: timeout,
+		server:  server,
+		signals: make(chan os.Signal, 2)}
+}
+
+// watch stops the bot on SIGINT or SIGTERM, the second signal exits immediately
+func (s *shutdown) watch() {
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-s.signals
+		log.WithFields(log.Fields{"signal": sig}).Info("Stopping, no more updates are accepted")
+		go s.stop()
+
+		sig = <-s.signals
+		log.WithFields(log.Fields{"signal": sig}).Error("Second signal during shutdown, exiting without saving")
+		os.Exit(1)
+	}()
+}
+
+// stop drains the bot and exits the process, it runs once even if polling stops on its own during a signal
+func (s *shutdown) stop() {
+	s.once.Do(func() {
+		s.status.setPolling(false)
+		code := s.finish()
+		if s.server != nil {
+			s.server.Close()
+		}
+		log.WithFields(log.Fields{"code": code}).Info("Daily budget bot has stopped")
+		os.Exit(code)
+	})
+}
+
+// finish returns the exit code of the drain or 1 if it has not finished in time
+func (s *shutdown) finish() int {
+	done := make(chan int, 1)
+	go func() {
+		done <- s.drain()
+	}()
+	select {
+	case code := <-done:
+		return code
+	case <-time.After(s.timeout):
+		log.WithFields(log.Fields{"timeout": s.timeout}).Error("Shutdown has not finished in time, exiting")
+		return 1
+	}
+}
+
+func (s *shutdown) drain() int {
+	// handlers in progress finish their answers before progress is saved and their events are published
+	s.gate.close()
+
+	code := 0
+	text := "Bot is stopping"
+	saved, err := s.engine.Flush()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to save progress of players")
+		text = fmt.Sprintf("%s, progress of players has NOT been saved: %s", text, err)
+		code = 1
+	} else if saved > 0 {
+		text = fmt.Sprintf("%s, progress of %d active quests has been saved", text, saved)
+	}
+	// the sinks deliver everything the engine has published, digests of notifications are sent on close
+	s.events.Close()
+
+	// organizers are told as well: their players cannot answer until the bot is back
+	sent := make(map[int64]bool)
+	for _, member := range s.staff.Members() {
+		chat := s.staff.DefaultChat(member)
+		if chat == 0 {
+			chat = int64(member)
+		}
+		if sent[chat] {
+			continue
+		}
+		sent[chat] = true
+		if err := s.sender.Send(tgbotapi.NewMessage(chat, text)); err != nil {
+			log.WithFields(log.Fields{"chat": chat, "error": err}).Error("Unable to tell staff about the shutdown")
+		}
+	}
+	return code
+}
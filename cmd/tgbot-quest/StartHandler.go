@@ -25,13 +25,52 @@ func (h *startHandler) HandleOne(msg tgbotapi.Message) {
 	chatID := msg.Chat.ID
 	log.WithFields(log.Fields{"userID": userID, "userName": msg.From.UserName, "message": msg.Text}).Debug("Incoming start")
 	h.names.Store(msg.From.ID, msg.From.UserName)
-	questID := msg.CommandArguments()
-	err := h.engine.StartQuest(userID, questID)
+	payload := msg.CommandArguments()
+	if payload == "" {
+		for _, out := range catalogMessages(h.engine, chatID) {
+			h.OutMsgCh <- out
+		}
+		return
+	}
+
+	// deep links deliver either an invite code or a quest ID
+	questID, err := h.engine.StartQuestByInvite(userID, payload)
+	if err == quest.ErrInviteNotFound {
+		startQuest(h.OutMsgCh, h.engine, chatID, userID, payload)
+		return
+	}
+	if err == quest.ErrQuestActive {
+		h.OutMsgCh <- restartQuestion(chatID, questID)
+		return
+	}
 	if err != nil {
-		h.OutMsgCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Я не смог стартовать квест с именем '%s'", questID))
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, startErrorText(payload, err))
+		return
+	}
+	h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+}
+
+func startQuest(outCh chan<- tgbotapi.Chattable, engine quest.QuestEngine, chatID int64, userID tgbotbase.UserID, questID string) {
+	err := engine.StartQuest(userID, questID)
+	if err == quest.ErrQuestActive {
+		outCh <- restartQuestion(chatID, questID)
+	} else if err != nil {
+		outCh <- tgbotapi.NewMessage(chatID, startErrorText(questID, err))
 	} else {
-		h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+		outCh <- engine.GetCurrentQuestion(userID)
+	}
+}
+
+func startErrorText(payload string, err error) string {
+	switch err {
+	case quest.ErrInviteExpired:
+		return "Срок действия приглашения истёк"
+	case quest.ErrInviteUsedUp:
+		return "Это приглашение уже использовано"
+	case quest.ErrInviteRequired:
+		return "Этот квест доступен только по приглашению"
 	}
+	return fmt.Sprintf("Я не смог стартовать квест с именем '%s'", payload)
 }
 
 func (h *startHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
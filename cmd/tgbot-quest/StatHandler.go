@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
 	"github.com/admirallarimda/tgbotbase"
 	"gopkg.in/telegram-bot-api.v4"
@@ -8,7 +10,9 @@ import (
 
 type statHandler struct {
 	tgbotbase.BaseHandler
-	resmon quest.ResultMonitor
+	stats  quest.StatsSink
+	engine quest.QuestEngine
+	staff  quest.Staff
 }
 
 func (h *statHandler) Name() string {
@@ -16,7 +20,21 @@ func (h *statHandler) Name() string {
 }
 
 func (h *statHandler) HandleOne(msg tgbotapi.Message) {
-	h.resmon.SendStats(msg.CommandArguments())
+	userID := tgbotbase.UserID(msg.From.ID)
+	questID := msg.CommandArguments()
+	if !h.staff.CanManage(userID, questID) {
+		if h.staff.IsStaff(userID) {
+			h.OutMsgCh <- tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("You do not run quest '%s'", questID))
+		}
+		return
+	}
+	policy := quest.RankFirst
+	if info, found := h.engine.GetQuestInfo(questID); found {
+		policy = info.Ranking
+	}
+	for _, text := range h.stats.Report(questID, policy) {
+		h.OutMsgCh <- tgbotapi.NewMessage(msg.Chat.ID, text)
+	}
 }
 
 func (h *statHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
@@ -24,6 +42,6 @@ func (h *statHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotba
 	return tgbotbase.NewHandlerTrigger(nil, []string{"stats"})
 }
 
-func newStatsHandler(monitor quest.ResultMonitor) tgbotbase.IncomingMessageHandler {
-	return &statHandler{resmon: monitor}
+func newStatsHandler(stats quest.StatsSink, engine quest.QuestEngine, staff quest.Staff) tgbotbase.IncomingMessageHandler {
+	return &statHandler{stats: stats, engine: engine, staff: staff}
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/metrics"
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// telegramCheckInterval is how often getMe is called, the bot is not ready after telegramStaleAfter
+// without an answer from Telegram
+const (
+	telegramCheckInterval = 30 * time.Second
+	telegramStaleAfter    = 3 * telegramCheckInterval
+	redisPingTimeout      = 2 * time.Second
+)
+
+// botStatus tells readiness probes what the bot is doing, tgbotbase does not expose its polling
+// so the bot is considered polling from Start until the shutdown begins while Telegram answers getMe
+type botStatus struct {
+	polling      int32
+	lastUpdate   int64
+	lastTelegram int64
+}
+
+func (s *botStatus) setPolling(polling bool) {
+	var v int32
+	if polling {
+		v = 1
+	}
+	atomic.StoreInt32(&s.polling, v)
+}
+
+func (s *botStatus) isPolling() bool {
+	return atomic.LoadInt32(&s.polling) == 1
+}
+
+func (s *botStatus) updated(t time.Time) {
+	atomic.StoreInt64(&s.lastUpdate, t.UnixNano())
+}
+
+func (s *botStatus) reached(t time.Time) {
+	atomic.StoreInt64(&s.lastTelegram, t.UnixNano())
+}
+
+// sinceTelegram returns how long Telegram has not answered
+func (s *botStatus) sinceTelegram() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastTelegram)))
+}
+
+// handlerObserver measures how long handlers take and remembers the last handled update,
+// updates which come after the gate is closed by the shutdown are ignored
+type handlerObserver struct {
+	latency *metrics.Histogram
+	status  *botStatus
+	gate    *handlerGate
+}
+
+func newHandlerObserver(reg *metrics.Registry, status *botStatus, gate *handlerGate) *handlerObserver {
+	return &handlerObserver{
+		latency: reg.NewHistogram("tgbot_quest_handler_duration_seconds", "Time spent by handlers on an incoming message or callback.", metrics.DefaultBuckets, "handler"),
+		status:  status,
+		gate:    gate}
+}
+
+func (o *handlerObserver) observe(handler string, started time.Time) {
+	o.latency.Observe(time.Since(started).Seconds(), handler)
+	o.status.updated(started)
+}
+
+func (o *handlerObserver) messages(h tgbotbase.IncomingMessageHandler) tgbotbase.IncomingMessageHandler {
+	return &observedMessageHandler{IncomingMessageHandler: h, observer: o}
+}
+
+func (o *handlerObserver) callbacks(h tgbotbase.IncomingCallbackHandler) tgbotbase.IncomingCallbackHandler {
+	return &observedCallbackHandler{IncomingCallbackHandler: h, observer: o}
+}
+
+type observedMessageHandler struct {
+	tgbotbase.IncomingMessageHandler
+	observer *handlerObserver
+}
+
+func (h *observedMessageHandler) HandleOne(msg tgbotapi.Message) {
+	if !h.observer.gate.enter() {
+		log.WithFields(log.Fields{"handler": h.Name(), "chat": msg.Chat.ID}).Debug("Bot is stopping, message is ignored")
+		return
+	}
+	defer h.observer.gate.leave()
+	defer h.observer.observe(h.Name(), time.Now())
+	h.IncomingMessageHandler.HandleOne(msg)
+}
+
+type observedCallbackHandler struct {
+	tgbotbase.IncomingCallbackHandler
+	observer *handlerObserver
+}
+
+func (h *observedCallbackHandler) HandleOne(query tgbotapi.CallbackQuery) {
+	if !h.observer.gate.enter() {
+		log.WithFields(log.Fields{"handler": h.Name(), "query": query.ID}).Debug("Bot is stopping, callback is ignored")
+		return
+	}
+	defer h.observer.gate.leave()
+	defer h.observer.observe(h.Name(), time.Now())
+	h.IncomingCallbackHandler.HandleOne(query)
+}
+
+// registerBotMetrics adds metrics which are collected from the engine and the publisher on scrape
+func registerBotMetrics(reg *metrics.Registry, engine quest.QuestEngine, events quest.EventPublisher, tgAPI *telegramAPI) {
+	reg.NewGaugeFunc("tgbot_quest_active_players", "Users with at least one quest in progress.", nil, func(emit func(float64, ...string)) {
+		emit(float64(engine.ActivePlayers()))
+	})
+	reg.NewCounterFunc("tgbot_quest_events_published_total", "Events published by the engine.", nil, func(emit func(float64, ...string)) {
+		emit(float64(events.Metrics().Published))
+	})
+	reg.NewCounterFunc("tgbot_quest_events_dropped_total", "Events dropped because the queue of a sink was full.", []string{"sink"}, func(emit func(float64, ...string)) {
+		sinks := events.Metrics().Sinks
+		for _, name := range sinkNames(sinks) {
+			emit(float64(sinks[name].Dropped), name)
+		}
+	})
+	reg.NewCounterFunc("tgbot_quest_events_blocked_total", "Events which have waited for a full queue of a sink instead of being dropped.", []string{"sink"}, func(emit func(float64, ...string)) {
+		sinks := events.Metrics().Sinks
+		for _, name := range sinkNames(sinks) {
+			emit(float64(sinks[name].Blocked), name)
+		}
+	})
+	reg.NewCounterFunc("tgbot_quest_outgoing_errors_total", "Events sinks have failed to deliver, including messages Telegram has rejected.", []string{"sink"}, func(emit func(float64, ...string)) {
+		sinks := events.Metrics().Sinks
+		for _, name := range sinkNames(sinks) {
+			emit(float64(sinks[name].Failed), name)
+		}
+	})
+	reg.NewCounterFunc("tgbot_quest_telegram_send_errors_total", "Messages of notifications, moderation, validation reports and shutdown Telegram has rejected; replies of handlers are sent by tgbotbase and are not counted.", nil, func(emit func(float64, ...string)) {
+		emit(float64(tgAPI.Failures()))
+	})
+}
+
+// sinkNames keeps series of sinks in the same order between scrapes
+func sinkNames(sinks map[string]quest.SinkMetrics) []string {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pingRedis does not let a hanging connection hold the probe longer than the timeout
+func pingRedis(client *redis.Client, timeout time.Duration) error {
+	res := make(chan error, 1)
+	go func() {
+		res <- client.Ping().Err()
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no answer to PING in %s", timeout)
+	}
+}
+
+// startStatusServer serves probes and metrics in the background, Redis is checked only if the pool is set
+func startStatusServer(addr string, reg *metrics.Registry, status *botStatus, pool tgbotbase.RedisPool) *http.Server {
+	var client *redis.Client
+	if pool != nil {
+		client = pool.GetConnByName("quest")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := true
+		text := "telegram: polling"
+		if !status.isPolling() {
+			ready = false
+			text = "telegram: not polling"
+		} else if since := status.sinceTelegram(); since > telegramStaleAfter {
+			ready = false
+			text = fmt.Sprintf("telegram: no answer to getMe for %s", since.Round(time.Second))
+		}
+		if last := atomic.LoadInt64(&status.lastUpdate); last > 0 {
+			text = fmt.Sprintf("%s, last update %s ago", text, time.Since(time.Unix(0, last)).Round(time.Second))
+		}
+		if client != nil {
+			if err := pingRedis(client, redisPingTimeout); err != nil {
+				ready = false
+				text = fmt.Sprintf("%s\nredis: %s", text, err)
+			} else {
+				text += "\nredis: ok"
+			}
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, text)
+	})
+	mux.Handle("/metrics", reg.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.WithFields(log.Fields{"addr": addr}).Info("Status server has been started")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"addr": addr, "error": err}).Error("Status server has failed")
+		}
+	}()
+	return server
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	restartPrefix  = "restart:"
+	continuePrefix = "continue:"
+	switchPrefix   = "switch:"
+)
+
+// restartQuestion asks a player who starts a quest in progress whether the progress should be dropped
+func restartQuestion(chatID int64, questID string) tgbotapi.Chattable {
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Ты уже проходишь квест '%s'. Начать заново? Весь прогресс будет потерян", questID))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Начать заново", restartPrefix+questID),
+		tgbotapi.NewInlineKeyboardButtonData("Продолжить", continuePrefix+questID)))
+	return msg
+}
+
+type switchHandler struct {
+	tgbotbase.BaseHandler
+	engine quest.QuestEngine
+}
+
+func (h *switchHandler) Name() string {
+	return "switch"
+}
+
+func (h *switchHandler) HandleOne(msg tgbotapi.Message) {
+	userID := tgbotbase.UserID(msg.From.ID)
+	chatID := msg.Chat.ID
+	if questID := msg.CommandArguments(); questID != "" {
+		switchQuest(h.OutMsgCh, h.engine, chatID, userID, questID)
+		return
+	}
+
+	active := h.engine.ListActiveQuests(userID)
+	if len(active) == 0 {
+		h.OutMsgCh <- tgbotapi.NewMessage(chatID, noActiveQuestText)
+		return
+	}
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(active))
+	for _, status := range active {
+		text := fmt.Sprintf("%s (вопрос %d из %d)", status.Title, status.Stage, status.StagesTotal)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, switchPrefix+status.QuestID)))
+	}
+	out := tgbotapi.NewMessage(chatID, "Выбери квест, который хочешь продолжить:")
+	out.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	h.OutMsgCh <- out
+}
+
+func (h *switchHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(nil, []string{"switch"})
+}
+
+func newSwitchHandler(engine quest.QuestEngine) tgbotbase.IncomingMessageHandler {
+	return &switchHandler{engine: engine}
+}
+
+type switchCallbackHandler struct {
+	tgbotbase.BaseHandler
+	engine  quest.QuestEngine
+	answers callbackAnswerer
+}
+
+func (h *switchCallbackHandler) Name() string {
+	return "switch callback"
+}
+
+func (h *switchCallbackHandler) HandleOne(query tgbotapi.CallbackQuery) {
+	// the result is sent as messages, the button is answered at once
+	h.answers.AnswerCallback(query, "")
+	if query.Message == nil {
+		return
+	}
+	userID := tgbotbase.UserID(query.From.ID)
+	chatID := query.Message.Chat.ID
+	log.WithFields(log.Fields{"userID": userID, "userName": query.From.UserName, "data": query.Data}).Debug("Incoming switch callback")
+	h.OutMsgCh <- tgbotapi.NewEditMessageReplyMarkup(chatID, query.Message.MessageID, quest.EmptyKeyboard())
+
+	switch {
+	case strings.HasPrefix(query.Data, restartPrefix):
+		questID := strings.TrimPrefix(query.Data, restartPrefix)
+		if err := h.engine.RestartQuest(userID, questID); err != nil {
+			h.OutMsgCh <- tgbotapi.NewMessage(chatID, startErrorText(questID, err))
+			return
+		}
+		h.OutMsgCh <- h.engine.GetCurrentQuestion(userID)
+	case strings.HasPrefix(query.Data, continuePrefix):
+		switchQuest(h.OutMsgCh, h.engine, chatID, userID, strings.TrimPrefix(query.Data, continuePrefix))
+	case strings.HasPrefix(query.Data, switchPrefix):
+		switchQuest(h.OutMsgCh, h.engine, chatID, userID, strings.TrimPrefix(query.Data, switchPrefix))
+	}
+}
+
+func (h *switchCallbackHandler) Init(outCh chan<- tgbotapi.Chattable, srvCh chan<- tgbotbase.ServiceMsg) tgbotbase.HandlerTrigger {
+	h.OutMsgCh = outCh
+	return tgbotbase.NewHandlerTrigger(regexp.MustCompile("^("+restartPrefix+"|"+continuePrefix+"|"+switchPrefix+")"), nil)
+}
+
+func newSwitchCallbackHandler(engine quest.QuestEngine, answers callbackAnswerer) tgbotbase.IncomingCallbackHandler {
+	return &switchCallbackHandler{engine: engine, answers: answers}
+}
+
+func switchQuest(outCh chan<- tgbotapi.Chattable, engine quest.QuestEngine, chatID int64, userID tgbotbase.UserID, questID string) {
+	if err := engine.SwitchQuest(userID, questID); err != nil {
+		outCh <- tgbotapi.NewMessage(chatID, fmt.Sprintf("Квест '%s' не начат", questID))
+		return
+	}
+	outCh <- engine.GetCurrentQuestion(userID)
+}
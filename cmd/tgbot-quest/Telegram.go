@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// telegramAPI calls Bot API methods which tgbotbase does not expose, updates are still polled by tgbotbase
+type telegramAPI struct {
+	api *tgbotapi.BotAPI
+
+	failed uint64
+}
+
+func newTelegramAPI(cfg tgbotbase.Config) *telegramAPI {
+	transport := &http.Transport{}
+	if proxy := cfg.Proxy_SOCKS5; proxy.Server != "" {
+		proxyURL := &url.URL{Scheme: "socks5", Host: proxy.Server}
+		if proxy.User != "" {
+			proxyURL.User = url.UserPassword(proxy.User, proxy.Pass)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	api, err := tgbotapi.NewBotAPIWithClient(cfg.TGBot.Token, &http.Client{Transport: transport})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Panic("Unable to connect to Telegram")
+	}
+	log.WithFields(log.Fields{"bot": api.Self.UserName}).Info("Connected to Telegram")
+	return &telegramAPI{api: api}
+}
+
+// Username returns the username of the bot obtained from getMe on start
+func (t *telegramAPI) Username() string {
+	return t.api.Self.UserName
+}
+
+// Send delivers the message through the Bot API, rejected messages are counted for /metrics
+// and are logged by the caller
+func (t *telegramAPI) Send(msg tgbotapi.Chattable) error {
+	if _, err := t.api.Send(msg); err != nil {
+		atomic.AddUint64(&t.failed, 1)
+		return err
+	}
+	return nil
+}
+
+// Failures returns the number of messages Send has not delivered
+func (t *telegramAPI) Failures() uint64 {
+	return atomic.LoadUint64(&t.failed)
+}
+
+// watch calls getMe every interval and tells the status when Telegram has answered last
+func (t *telegramAPI) watch(interval time.Duration, status *botStatus) {
+	status.reached(time.Now())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := t.api.GetMe(); err != nil {
+				log.WithFields(log.Fields{"error": err}).Warn("Telegram has not answered getMe")
+				continue
+			}
+			status.reached(time.Now())
+		}
+	}()
+}
+
+// AnswerCallback stops the progress indicator on the pressed button, the text is shown as a toast if set
+func (t *telegramAPI) AnswerCallback(query tgbotapi.CallbackQuery, text string) {
+	if _, err := t.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		log.WithFields(log.Fields{"query": query.ID, "error": err}).Warn("Unable to answer callback query")
+	}
+}
+
+// callbackAnswerer is implemented by telegramAPI, handlers of buttons must answer every pressed button
+type callbackAnswerer interface {
+	AnswerCallback(query tgbotapi.CallbackQuery, text string)
+}
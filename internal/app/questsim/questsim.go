@@ -0,0 +1,254 @@
+// questsim plays a quest in the terminal against the real engine without touching the bot state
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+var argQuest = flag.String("quest", "", "ID of the quest (defaults to the file name for -file)")
+var argFile = flag.String("file", "", "Path to a JSON quest definition, Redis is used if not set")
+var argRedis = flag.String("redis", "127.0.0.1:6379", "Address of Redis to load the quest from")
+var argPass = flag.String("pass", "", "Password of Redis")
+var argPublished = flag.Bool("published", false, "Play the live version from Redis instead of the draft")
+var argScript = flag.String("script", "", "Path to a file with '<stage>: <answer>' lines, the quest is played without prompts")
+var argVerbose = flag.Bool("v", false, "Log engine internals")
+
+// simUser is the only player of the simulation
+const simUser = tgbotbase.UserID(1)
+
+func main() {
+	flag.Parse()
+	log.SetLevel(log.WarnLevel)
+	if *argVerbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	questID, q, err := loadQuest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load quest: %s\n", err)
+		os.Exit(2)
+	}
+	issues := quest.ValidateQuest(questID, q)
+	for _, i := range issues {
+		fmt.Fprintln(os.Stderr, i)
+	}
+	if quest.HasErrors(issues) {
+		os.Exit(2)
+	}
+
+	storages := quest.NewMemoryStorages()
+	storages.Quests.StoreQuest(*quest.NewQuestRecord(questID, q))
+	engine := quest.NewQuestEngine(quest.EngineConfig{}, storages, quest.NewNopEventPublisher())
+	if err := engine.StartQuest(simUser, questID); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to start quest: %s\n", err)
+		os.Exit(2)
+	}
+
+	if *argScript != "" {
+		err = runScript(engine, *argScript)
+	} else {
+		err = runInteractive(engine)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func loadQuest() (string, quest.Quest, error) {
+	if *argFile != "" {
+		data, err := ioutil.ReadFile(*argFile)
+		if err != nil {
+			return "", quest.Quest{}, err
+		}
+		var q quest.Quest
+		if err := json.Unmarshal(data, &q); err != nil {
+			return "", quest.Quest{}, err
+		}
+		questID := *argQuest
+		if questID == "" {
+			questID = strings.TrimSuffix(filepath.Base(*argFile), filepath.Ext(*argFile))
+		}
+		return questID, q, nil
+	}
+
+	if *argQuest == "" {
+		return "", quest.Quest{}, errors.New("Either -quest or -file must be set")
+	}
+	pool := tgbotbase.NewRedisPool(tgbotbase.RedisConfig{Server: *argRedis, Pass: *argPass})
+	if *argPublished {
+		versions := quest.NewRedisVersionStorage(pool, nil)
+		_, current, err := versions.ListVersions(*argQuest)
+		if err != nil {
+			return "", quest.Quest{}, err
+		}
+		v, err := versions.LoadVersion(*argQuest, current)
+		if err != nil {
+			return "", quest.Quest{}, err
+		}
+		return *argQuest, v.Quest, nil
+	}
+	q, err := quest.NewRedisQuestStorage(pool, nil).LoadQuest(*argQuest)
+	if err != nil {
+		return "", quest.Quest{}, err
+	}
+	return *argQuest, *q, nil
+}
+
+// question returns the text of the current question with its options
+func question(engine quest.QuestEngine) string {
+	var text string
+	switch msg := engine.GetCurrentQuestion(simUser).(type) {
+	case tgbotapi.MessageConfig:
+		text = msg.Text
+	case tgbotapi.PhotoConfig:
+		text = "[picture]\n" + msg.Caption
+	}
+	if keyboard := engine.GetCurrentKeyboard(simUser); keyboard != nil {
+		for _, row := range keyboard.InlineKeyboard {
+			for _, button := range row {
+				text += "\n  * " + button.Text
+			}
+		}
+	}
+	return text
+}
+
+// answer sends the answer to the engine approving it on behalf of organizers if the stage is moderated
+func answer(engine quest.QuestEngine, text string, approve func(sub quest.Submission) bool) (quest.AnswerResult, error) {
+	res := engine.CheckAnswer(simUser, text)
+	if res.Cooldown > 0 {
+		return res, fmt.Errorf("Answers are blocked by the rate limit for %s", res.Cooldown)
+	}
+	if !res.Pending || res.Submission == nil {
+		return res, nil
+	}
+	_, res, err := engine.ResolveSubmission(res.Submission.ID, quest.Decision{Approved: approve(*res.Submission), Moderator: "questsim"})
+	return res, err
+}
+
+func runInteractive(engine quest.QuestEngine) error {
+	in := bufio.NewScanner(os.Stdin)
+	readLine := func(prompt string) (string, bool) {
+		fmt.Print(prompt)
+		if !in.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(in.Text()), true
+	}
+	approve := func(sub quest.Submission) bool {
+		reply, _ := readLine(fmt.Sprintf("Moderated answer '%s', approve? [y/n] ", sub.Answer))
+		return strings.HasPrefix(strings.ToLower(reply), "y")
+	}
+
+	fmt.Println("Commands: /skip, /status, /quit")
+	mistakes, skipped := 0, 0
+	for {
+		status, err := engine.GetStatus(simUser)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n[%d/%d] stage '%s'\n%s\n", status.Stage, status.StagesTotal, status.StageID, question(engine))
+		line, ok := readLine("> ")
+		if !ok || line == "/quit" {
+			return errors.New("Quest has not been finished")
+		}
+
+		var res quest.AnswerResult
+		switch line {
+		case "/status":
+			fmt.Printf("Started %s, mistakes %d, skipped %d\n", status.Started, status.Mistakes, status.Skipped)
+			continue
+		case "/skip":
+			res, err = engine.SkipStage(simUser)
+			if err == nil {
+				skipped++
+				fmt.Println("Skipped")
+			}
+		default:
+			res, err = answer(engine, line, approve)
+			if err == nil && res.Correct {
+				fmt.Println("Correct")
+			} else if err == nil {
+				mistakes++
+				fmt.Println("Wrong answer")
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if res.Finished {
+			fmt.Printf("Quest finished: %d mistakes, %d skipped\n", mistakes, skipped)
+			return nil
+		}
+	}
+}
+
+// runScript plays the quest with answers from the file, answers of a stage are tried in their order
+func runScript(engine quest.QuestEngine, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	answers := make(map[string][]string, 0)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: line must look like '<stage>: <answer>'", path, n+1)
+		}
+		stageID := strings.TrimSpace(parts[0])
+		answers[stageID] = append(answers[stageID], strings.TrimSpace(parts[1]))
+	}
+
+	approveAll := func(sub quest.Submission) bool {
+		return true
+	}
+	mistakes, skipped := 0, 0
+	for {
+		status, err := engine.GetStatus(simUser)
+		if err != nil {
+			return err
+		}
+		stageAnswers := answers[status.StageID]
+		if len(stageAnswers) == 0 {
+			return fmt.Errorf("Stuck at stage '%s' (%d of %d): no more answers in the script", status.StageID, status.Stage, status.StagesTotal)
+		}
+		answers[status.StageID] = stageAnswers[1:]
+
+		var res quest.AnswerResult
+		if stageAnswers[0] == "/skip" {
+			res, err = engine.SkipStage(simUser)
+			skipped++
+		} else {
+			res, err = answer(engine, stageAnswers[0], approveAll)
+			if !res.Correct {
+				mistakes++
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Stuck at stage '%s': %s", status.StageID, err)
+		}
+		if res.Finished {
+			fmt.Printf("Quest completed: %d stages, %d mistakes, %d skipped\n", status.StagesTotal, mistakes, skipped)
+			return nil
+		}
+	}
+}
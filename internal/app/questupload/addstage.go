@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	log "github.com/sirupsen/logrus"
+)
+
+const timeFormat = "20060102150405.000"
+
+// addStage stores a single stage and non-empty quest info into the draft
+func addStage(a *app, args []string) int {
+	flags := newFlagSet("add-stage", "-quest <id> -question <text> [-answers <a;b>] [flags]")
+	argQuest := flags.String("quest", "", "ID of the target quest")
+	argStage := flags.String("stage", "", "ID of the target stage (optional)")
+	argPic := flags.String("pic", "", "Path or HTTP(S) URL of the picture which will be attached to a question, large pictures are scaled down (optional)")
+	argQuestion := flags.String("question", "", "Question itself")
+	argAnswers := flags.String("answers", "", "Semicolon (;)-split list of answers (optional for moderated stages)")
+	argType := flags.String("type", "text", "Type of the stage: text, moderated or choice")
+	argOptions := flags.String("options", "", "Semicolon (;)-split list of options for a choice stage, answers are the correct ones")
+	argTitle := flags.String("title", "", "Title of the quest shown in the catalog (optional)")
+	argDescription := flags.String("description", "", "Description of the quest shown in the catalog (optional)")
+	argDifficulty := flags.String("difficulty", "", "Difficulty of the quest shown in the catalog (optional)")
+	argVisibility := flags.String("visibility", "", "Visibility of the quest: public, hidden or invite (optional)")
+	argSkipPenalty := flags.Duration("skip-penalty", -1, "Allow players to skip stages with the given time penalty, e.g. 10m (optional)")
+	argRanking := flags.String("ranking", "", "Which attempt counts for the ranking on replays: first, best or last (optional)")
+	argRateLimit := flags.String("rate-limit", "", "Limit of wrong answers per stage as <max wrong>/<window>/<cooldown>, e.g. 5/1m/10m (optional)")
+	argShuffle := flags.Bool("shuffle", false, "Shuffle options of a choice stage for every player")
+	argPublish := flags.Bool("publish", false, "Publish the draft as a new version after the upload, the bot picks it up on the next start or /publish")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+
+	stageType, err := quest.ParseStageType(*argType)
+	if err != nil {
+		return fail(exitUsage, "%s", err)
+	}
+	if (*argQuest == "") || (*argQuestion == "") || (*argAnswers == "" && stageType != quest.StageModerated) {
+		flags.Usage()
+		return fail(exitUsage, "-quest, -question and -answers (except for moderated stages) must be set")
+	}
+	if *argStage == "" {
+		*argStage = time.Now().Format(timeFormat)
+	}
+
+	answers := []string{}
+	if *argAnswers != "" {
+		answers = strings.Split(*argAnswers, ";")
+	}
+
+	visibility := quest.Visibility("")
+	if *argVisibility != "" {
+		if visibility, err = quest.ParseVisibility(*argVisibility); err != nil {
+			return fail(exitUsage, "%s", err)
+		}
+	}
+
+	ranking := quest.RankingPolicy("")
+	if *argRanking != "" {
+		if ranking, err = quest.ParseRankingPolicy(*argRanking); err != nil {
+			return fail(exitUsage, "%s", err)
+		}
+	}
+
+	rateLimit, err := quest.ParseRateLimit(*argRateLimit)
+	if err != nil {
+		return fail(exitUsage, "%s", err)
+	}
+
+	q := quest.NewQuest()
+	q.SetInfo(quest.QuestInfo{
+		Title:       *argTitle,
+		Description: *argDescription,
+		Difficulty:  *argDifficulty,
+		Visibility:  visibility,
+		AllowSkip:   *argSkipPenalty >= 0,
+		SkipPenalty: *argSkipPenalty,
+		Ranking:     ranking,
+		RateLimit:   rateLimit})
+	stage := quest.NewStage(*argQuestion, answers)
+	stage.SetType(stageType)
+	if stageType == quest.StageChoice {
+		if *argOptions == "" {
+			return fail(exitUsage, "-options must be set for a choice stage")
+		}
+		stage.SetOptions(strings.Split(*argOptions, ";"), *argShuffle)
+	}
+	if *argPic != "" {
+		data, err := readMedia(*argPic)
+		if err != nil {
+			return fail(exitProblems, "Unable to read picture '%s': %s", *argPic, err)
+		}
+		log.WithFields(log.Fields{"pic": *argPic, "bytes_read": len(data)}).Debug("Picture has been read")
+		pic, err := preparePhoto(data)
+		if err != nil {
+			return fail(exitProblems, "Picture '%s' cannot be sent as a Telegram photo: %s", *argPic, err)
+		}
+		stage.AddPicture(pic)
+	}
+	q.AddStage(*argStage, stage)
+
+	storages, err := a.openStorages()
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	if err := storages.Quests.StoreQuest(*quest.NewQuestRecord(*argQuest, q)); err != nil {
+		return fail(exitStorage, "Unable to store quest '%s': %s", *argQuest, err)
+	}
+
+	result := struct {
+		Quest   string `json:"quest"`
+		Stage   string `json:"stage"`
+		Version int    `json:"version,omitempty"`
+	}{Quest: *argQuest, Stage: *argStage}
+	if *argPublish {
+		code, version := publish(storages, *argQuest)
+		if code != exitOK {
+			return code
+		}
+		result.Version = version
+	}
+
+	if a.json {
+		return printJSON(result)
+	}
+	fmt.Printf("Stage '%s' of quest '%s' has been stored\n", result.Stage, result.Quest)
+	if result.Version > 0 {
+		fmt.Printf("Quest '%s' has been published as version %d\n", result.Quest, result.Version)
+	}
+	return exitOK
+}
+
+// publish validates the draft and stores it as a new version, problems are printed
+func publish(storages quest.Storages, questID string) (int, int) {
+	draft, err := storages.Quests.LoadQuest(questID)
+	if err != nil {
+		return fail(exitStorage, "Unable to load draft of '%s': %s", questID, err), 0
+	}
+	issues := quest.ValidateQuest(questID, *draft)
+	if storages.Blobs != nil {
+		issues = append(issues, quest.ValidatePictures(questID, *draft, storages.Blobs)...)
+	}
+	if quest.HasErrors(issues) {
+		for _, i := range issues {
+			fmt.Fprintln(os.Stderr, i)
+		}
+		return fail(exitProblems, "Quest '%s' has errors and has not been published", questID), 0
+	}
+	v, err := storages.Versions.PublishVersion(questID, *draft)
+	if err != nil {
+		return fail(exitStorage, "Unable to publish quest '%s': %s", questID, err), 0
+	}
+	return exitOK, v.Number
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Telegram limits for photos, see https://core.telegram.org/bots/api#sendphoto
+const (
+	maxPhotoBytes = 10 * 1024 * 1024
+	// maxPhotoSides is the limit of width and height together
+	maxPhotoSides  = 10000
+	maxPhotoAspect = 20
+	// maxSourceBytes is the largest source which is read before resizing
+	maxSourceBytes = 50 * 1024 * 1024
+	// maxSourcePixels is the largest picture which is decoded, a small file may declare huge dimensions
+	maxSourcePixels = 50 * 1000 * 1000
+	downloadTimeout = time.Minute
+)
+
+// readMedia reads the whole file or downloads it if the source is an HTTP(S) URL
+func readMedia(source string) ([]byte, error) {
+	var r io.Reader
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		client := http.Client{Timeout: downloadTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Download failed with %s", resp.Status)
+		}
+		if resp.ContentLength > maxSourceBytes {
+			return nil, fmt.Errorf("Source of %d bytes exceeds the limit of %d", resp.ContentLength, maxSourceBytes)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSourceBytes {
+		return nil, fmt.Errorf("Source exceeds the limit of %d bytes", maxSourceBytes)
+	}
+	return data, nil
+}
+
+// preparePhoto checks that the data is a picture Telegram accepts as a photo, pictures which are too large
+// are scaled down and compressed to JPEG, fitting pictures are returned as they are
+func preparePhoto(data []byte) ([]byte, error) {
+	mime := http.DetectContentType(data)
+	switch mime {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return nil, fmt.Errorf("Unsupported picture type '%s', JPEG, PNG or GIF is expected", mime)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed %s picture: %s", mime, err)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return nil, fmt.Errorf("Picture has no pixels")
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, fmt.Errorf("Picture of %dx%d exceeds the limit of %d pixels", cfg.Width, cfg.Height, maxSourcePixels)
+	}
+	long, short := cfg.Width, cfg.Height
+	if short > long {
+		long, short = short, long
+	}
+	if long > short*maxPhotoAspect {
+		return nil, fmt.Errorf("Picture of %dx%d is too narrow, the aspect ratio must be at most %d:1", cfg.Width, cfg.Height, maxPhotoAspect)
+	}
+	if len(data) <= maxPhotoBytes && cfg.Width+cfg.Height <= maxPhotoSides {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed %s picture: %s", mime, err)
+	}
+	flat := flatten(img)
+	factor := 1.0
+	if sides := cfg.Width + cfg.Height; sides > maxPhotoSides {
+		factor = float64(maxPhotoSides) / float64(sides)
+	}
+	// every attempt makes the picture smaller until it fits into the size limit
+	for quality := 90; ; {
+		width, height := int(float64(cfg.Width)*factor), int(float64(cfg.Height)*factor)
+		if width < 1 || height < 1 {
+			return nil, fmt.Errorf("Picture cannot be compressed to %d bytes", maxPhotoBytes)
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scale(flat, width, height), &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{"width": width, "height": height, "quality": quality, "bytes": buf.Len()}).Debug("Picture has been compressed")
+		if buf.Len() <= maxPhotoBytes {
+			return buf.Bytes(), nil
+		}
+		if quality > 70 {
+			quality -= 10
+		} else {
+			factor *= 0.75
+		}
+	}
+}
+
+// flatten puts the picture on white background as JPEG has no transparency
+func flatten(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Over)
+	return rgba
+}
+
+// scale resizes the picture averaging source pixels which fall into every target pixel
+func scale(rgba *image.RGBA, width, height int) image.Image {
+	bounds := rgba.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*bounds.Dy()/height, (y+1)*bounds.Dy()/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*bounds.Dx()/width, (x+1)*bounds.Dx()/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := rgba.RGBAAt(sx, sy)
+					r, g, b = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 0xff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func pngOf(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader returns only the signature and the header of a PNG declaring the size, it is enough for DecodeConfig
+func pngHeader(width, height uint32) []byte {
+	// 8 bits per sample, grayscale, default compression, filter and interlace
+	chunk := []byte{'I', 'H', 'D', 'R', 0, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(chunk[4:], width)
+	binary.BigEndian.PutUint32(chunk[8:], height)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(chunk)-4))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestPreparePhoto(t *testing.T) {
+	small := pngOf(t, 40, 30)
+	tests := []struct {
+		name string
+		data []byte
+		// err is a part of the expected error, mime is the type of the result otherwise
+		err       string
+		mime      string
+		unchanged bool
+	}{
+		{name: "text", data: []byte("just text"), err: "Unsupported picture type"},
+		{name: "truncated", data: small[:20], err: "Malformed"},
+		{name: "fitting", data: small, mime: "image/png", unchanged: true},
+		{name: "too narrow", data: pngOf(t, 2100, 100), err: "too narrow"},
+		{name: "too large sides", data: pngOf(t, 9600, 960), mime: "image/jpeg"},
+		{name: "decompression bomb", data: pngHeader(60000, 60000), err: "exceeds the limit of 50000000 pixels"},
+	}
+	for _, tt := range tests {
+		res, err := preparePhoto(tt.data)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want '%s'", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+			continue
+		}
+		if mime := http.DetectContentType(res); mime != tt.mime {
+			t.Errorf("%s: result is %s, want %s", tt.name, mime, tt.mime)
+		}
+		if unchanged := bytes.Equal(res, tt.data); unchanged != tt.unchanged {
+			t.Errorf("%s: picture returned unchanged is %v, want %v", tt.name, unchanged, tt.unchanged)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(res))
+		if err != nil || cfg.Width+cfg.Height > maxPhotoSides || len(res) > maxPhotoBytes {
+			t.Errorf("%s: result %dx%d of %d bytes does not fit Telegram limits (%v)", tt.name, cfg.Width, cfg.Height, len(res), err)
+		}
+	}
+}
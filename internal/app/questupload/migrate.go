@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+)
+
+// migrate converts quests from the legacy Redis layout, it returns the exit code
+func migrate(a *app, args []string) int {
+	flags := newFlagSet("migrate", "[-cleanup] [-dry-run]")
+	cleanup := flags.Bool("cleanup", false, "Delete legacy keys of converted quests")
+	dryRun := flags.Bool("dry-run", false, "Only report what would be converted")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+
+	pool := a.redisPool()
+	blobs, err := a.cfg.NewBlobStore(pool)
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	if blobs == nil {
+		blobs = quest.NewRedisBlobStore(pool)
+	}
+	report, err := quest.MigrateRedisSchema(pool, blobs, *cleanup, *dryRun)
+	code := exitOK
+	if err != nil {
+		code = fail(exitStorage, "Migration has been interrupted: %s", err)
+	} else if len(report.Failures) > 0 {
+		code = exitProblems
+	}
+
+	if a.json {
+		if printJSON(struct {
+			Quests            []string            `json:"quests"`
+			Stages            int                 `json:"stages"`
+			Failures          []map[string]string `json:"failures"`
+			Warnings          []string            `json:"warnings"`
+			RemovedKeys       int                 `json:"removed_keys"`
+			RenamedVersions   int                 `json:"renamed_versions"`
+			OffloadedQuests   int                 `json:"offloaded_quests"`
+			OffloadedVersions int                 `json:"offloaded_versions"`
+			DryRun            bool                `json:"dry_run"`
+		}{report.Quests, report.Stages, failures(report.Failures), report.Warnings,
+			report.RemovedKeys, report.RenamedVersions, report.OffloadedQuests, report.OffloadedVersions, *dryRun}) != exitOK {
+			return exitStorage
+		}
+		return code
+	}
+	fmt.Println(report)
+	return code
+}
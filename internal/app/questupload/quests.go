@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+)
+
+// importQuest replaces the draft with a JSON definition, e.g. one written by export
+func importQuest(a *app, args []string) int {
+	flags := newFlagSet("import", "-file <quest.json> [-quest <id>] [-publish]")
+	argFile := flags.String("file", "", "Path to the JSON definition, - for stdin")
+	argQuest := flags.String("quest", "", "ID of the quest (defaults to the file name)")
+	argPublish := flags.Bool("publish", false, "Publish the draft as a new version after the import")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *argFile == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	questID := *argQuest
+	if questID == "" && *argFile != "-" {
+		questID = strings.TrimSuffix(filepath.Base(*argFile), filepath.Ext(*argFile))
+	}
+	if questID == "" {
+		return fail(exitUsage, "-quest must be set for stdin")
+	}
+
+	var data []byte
+	var err error
+	if *argFile == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*argFile)
+	}
+	if err != nil {
+		return fail(exitUsage, "%s", err)
+	}
+	var q quest.Quest
+	if err := json.Unmarshal(data, &q); err != nil {
+		return fail(exitProblems, "Malformed definition '%s': %s", *argFile, err)
+	}
+	issues := quest.ValidateQuest(questID, q)
+	for _, i := range issues {
+		fmt.Fprintln(os.Stderr, i)
+	}
+	if quest.HasErrors(issues) {
+		return fail(exitProblems, "Quest '%s' has errors and has not been imported", questID)
+	}
+
+	storages, err := a.openStorages()
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	if err := storages.Quests.ReplaceQuest(*quest.NewQuestRecord(questID, q)); err != nil {
+		return fail(exitStorage, "Unable to store quest '%s': %s", questID, err)
+	}
+
+	result := struct {
+		Quest   string `json:"quest"`
+		Stages  int    `json:"stages"`
+		Version int    `json:"version,omitempty"`
+	}{Quest: questID, Stages: len(q.StageIDs())}
+	if *argPublish {
+		code, version := publish(storages, questID)
+		if code != exitOK {
+			return code
+		}
+		result.Version = version
+	}
+	if a.json {
+		return printJSON(result)
+	}
+	fmt.Printf("Quest '%s' with %d stages has been imported\n", result.Quest, result.Stages)
+	if result.Version > 0 {
+		fmt.Printf("Quest '%s' has been published as version %d\n", result.Quest, result.Version)
+	}
+	return exitOK
+}
+
+// exportQuest writes the JSON definition which can be imported back or played by questsim
+func exportQuest(a *app, args []string) int {
+	flags := newFlagSet("export", "-quest <id> [-published] [-inline] [-o <file>]")
+	argQuest := flags.String("quest", "", "ID of the quest")
+	argPublished := flags.Bool("published", false, "Export the live version instead of the draft")
+	argInline := flags.Bool("inline", false, "Put pictures into the definition instead of refs to the blob store")
+	argOut := flags.String("o", "", "Path to the output file, stdout by default")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *argQuest == "" {
+		flags.Usage()
+		return exitUsage
+	}
+
+	q, _, err := a.loadQuest(*argQuest, *argPublished)
+	if err != nil {
+		return fail(exitCode(err), "%s", err)
+	}
+	if *argInline {
+		storages, _ := a.openStorages()
+		if q, err = quest.InlinePictures(q, storages.Blobs); err != nil {
+			return fail(exitStorage, "%s", err)
+		}
+	}
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	if *argOut == "" {
+		fmt.Println(string(data))
+		return exitOK
+	}
+	if err := ioutil.WriteFile(*argOut, data, 0644); err != nil {
+		return fail(exitUsage, "%s", err)
+	}
+	return exitOK
+}
+
+type questListEntry struct {
+	Quest      string           `json:"quest"`
+	Title      string           `json:"title,omitempty"`
+	Visibility quest.Visibility `json:"visibility,omitempty"`
+	// Stages is a number of stages of the draft
+	Stages int `json:"stages"`
+	// Version is the current published version, 0 if the quest is not published
+	Version  int `json:"version"`
+	Versions int `json:"versions"`
+}
+
+// listQuests shows drafts and published quests together
+func listQuests(a *app, args []string) int {
+	flags := newFlagSet("list", "")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	storages, err := a.openStorages()
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	drafts, draftFailures, err := storages.Quests.LoadAll()
+	if err != nil {
+		return fail(exitStorage, "Unable to load quests: %s", err)
+	}
+	published, versionFailures, err := storages.Versions.LoadCurrentVersions()
+	if err != nil {
+		return fail(exitStorage, "Unable to load published quests: %s", err)
+	}
+
+	entries := make(map[string]*questListEntry, len(drafts))
+	for _, rec := range drafts {
+		info := rec.Quest().Info()
+		entries[rec.ID()] = &questListEntry{
+			Quest:      rec.ID(),
+			Title:      info.Title,
+			Visibility: info.Visibility,
+			Stages:     len(rec.Quest().StageIDs())}
+	}
+	for _, v := range published {
+		e, found := entries[v.QuestID]
+		if !found {
+			info := v.Quest.Info()
+			e = &questListEntry{Quest: v.QuestID, Title: info.Title, Visibility: info.Visibility}
+			entries[v.QuestID] = e
+		}
+		e.Version = v.Number
+		versions, _, err := storages.Versions.ListVersions(v.QuestID)
+		if err != nil {
+			return fail(exitStorage, "Unable to list versions of '%s': %s", v.QuestID, err)
+		}
+		e.Versions = len(versions)
+	}
+	list := make([]questListEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Quest < list[j].Quest
+	})
+	brokenQuests := append(draftFailures, versionFailures...)
+
+	code := exitOK
+	if len(brokenQuests) > 0 {
+		code = exitProblems
+	}
+	if a.json {
+		if printJSON(struct {
+			Quests   []questListEntry    `json:"quests"`
+			Failures []map[string]string `json:"failures"`
+		}{list, failures(brokenQuests)}) != exitOK {
+			return exitStorage
+		}
+		return code
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEST\tTITLE\tVISIBILITY\tSTAGES\tVERSION")
+	for _, e := range list {
+		version := "draft"
+		if e.Version > 0 {
+			version = fmt.Sprintf("%d of %d", e.Version, e.Versions)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", e.Quest, e.Title, e.Visibility, e.Stages, version)
+	}
+	w.Flush()
+	for _, f := range brokenQuests {
+		fmt.Fprintf(os.Stderr, "Quest '%s' cannot be loaded: %s\n", f.QuestID, f.Err)
+	}
+	return code
+}
+
+// showQuest prints the quest with all stages and answers
+func showQuest(a *app, args []string) int {
+	flags := newFlagSet("show", "-quest <id> [-published]")
+	argQuest := flags.String("quest", "", "ID of the quest")
+	argPublished := flags.Bool("published", false, "Show the live version instead of the draft")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *argQuest == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	q, version, err := a.loadQuest(*argQuest, *argPublished)
+	if err != nil {
+		return fail(exitCode(err), "%s", err)
+	}
+	if a.json {
+		return printJSON(q)
+	}
+
+	info := q.Info()
+	fmt.Printf("Quest '%s'", *argQuest)
+	if version > 0 {
+		fmt.Printf(", version %d", version)
+	}
+	fmt.Printf("\nTitle: %s\nDescription: %s\nDifficulty: %s\nVisibility: %s\nRanking: %s\n",
+		info.Title, info.Description, info.Difficulty, info.Visibility, info.Ranking)
+	if info.AllowSkip {
+		fmt.Printf("Skipping allowed with penalty %s\n", info.SkipPenalty)
+	}
+	if info.RateLimit.Enabled() {
+		fmt.Printf("Rate limit: %s\n", info.RateLimit)
+	}
+	for _, stageID := range q.StageIDs() {
+		stage, _ := q.Stage(stageID)
+		fmt.Printf("\nStage '%s' (%s)\n  %s\n", stageID, stage.Type(), strings.Replace(stage.Question(), "\n", "\n  ", -1))
+		switch {
+		case stage.PictureID() != "":
+			fmt.Printf("  Picture: Telegram file %s\n", stage.PictureID())
+		case stage.PictureRef() != "":
+			fmt.Printf("  Picture: %s\n", stage.PictureRef())
+		case stage.Picture() != nil:
+			fmt.Printf("  Picture: %d bytes inline\n", len(stage.Picture()))
+		}
+		if stage.Type() == quest.StageChoice {
+			fmt.Printf("  Options: %s (shuffled: %t)\n", strings.Join(stage.Options(), "; "), stage.ShuffleOptions())
+		}
+		if stage.Type() != quest.StageModerated {
+			fmt.Printf("  Answers: %s\n", strings.Join(stage.Answers(), "; "))
+		}
+	}
+	return exitOK
+}
+
+// removeQuest deletes a stage or the whole draft, published versions stay live
+func removeQuest(a *app, args []string) int {
+	flags := newFlagSet("rm", "-quest <id> [-stage <id>]")
+	argQuest := flags.String("quest", "", "ID of the quest")
+	argStage := flags.String("stage", "", "ID of the stage, the whole draft is removed if not set")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	if *argQuest == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	q, _, err := a.loadQuest(*argQuest, false)
+	if err != nil {
+		return fail(exitCode(err), "%s", err)
+	}
+	storages, _ := a.openStorages()
+
+	if *argStage != "" {
+		if _, found := q.Stage(*argStage); !found {
+			return fail(exitProblems, "Stage '%s' of quest '%s' not found", *argStage, *argQuest)
+		}
+		if err := storages.Quests.DeleteStage(*argQuest, *argStage); err != nil {
+			return fail(exitStorage, "Unable to remove stage: %s", err)
+		}
+	} else if err := storages.Quests.DeleteQuest(*argQuest); err != nil {
+		return fail(exitStorage, "Unable to remove quest: %s", err)
+	}
+
+	if a.json {
+		return printJSON(map[string]string{"quest": *argQuest, "stage": *argStage})
+	}
+	if *argStage != "" {
+		fmt.Printf("Stage '%s' of quest '%s' has been removed\n", *argStage, *argQuest)
+	} else {
+		fmt.Printf("Draft of quest '%s' has been removed, published versions are kept\n", *argQuest)
+	}
+	return exitOK
+}
@@ -1,60 +1,273 @@
+// questupload manages quests in the storage of the bot
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/config"
 	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
 	"github.com/admirallarimda/tgbotbase"
 	log "github.com/sirupsen/logrus"
-	"os"
-	"strings"
-	"time"
 )
 
-var argQuest = flag.String("quest", "", "ID of the target quest")
-var argStage = flag.String("stage", "", "ID of the target stage (optional)")
-var argPic = flag.String("pic", "", "Path/URL of the picture which will be attached to a question (optional)")
-var argQuestion = flag.String("question", "", "Question itself")
-var argAnswers = flag.String("answers", "", "Semicolon (;)-split list of answers")
+const usage = `Usage: questupload [-config bot.cfg] [-redis host:port] [-pass password] [-json] <command> [flags]
 
-const timeFormat = "20060102150405.000"
+Commands:
+  import     replace a draft with a JSON definition
+  export     write a quest as a JSON definition
+  list       list quests with their versions
+  show       show a quest with its stages
+  add-stage  add or replace a single stage of a draft
+  rm         remove a stage or a whole draft
+  validate   check quests for problems
+  stats      show results of players from the event log
+  migrate    convert quests from the legacy Redis layout
 
-func main() {
-	log.SetLevel(log.DebugLevel)
-	flag.Parse()
+Run 'questupload <command> -h' for flags of the command.
+
+The storage is configured by bot.cfg of the bot. Redis address and password are taken
+from flags, then from QUEST_REDIS_SERVER and QUEST_REDIS_PASS, then from bot.cfg;
+other QUEST_* overrides of the bot apply as well.
+
+Exit codes: 0 success, 1 the command found problems, 2 usage error, 3 storage error.
+`
+
+const (
+	exitOK       = 0
+	exitProblems = 1
+	exitUsage    = 2
+	exitStorage  = 3
+)
+
+const defaultRedisServer = "127.0.0.1:6379"
+
+var argConfig = flag.String("config", "", "Path to bot.cfg, ./bot.cfg is used if it exists (env QUEST_CONFIG)")
+var argRedis = flag.String("redis", "", "Address of Redis (env QUEST_REDIS_SERVER)")
+var argPass = flag.String("pass", "", "Password of Redis (env QUEST_REDIS_PASS)")
+var argJSON = flag.Bool("json", false, "Print results as JSON")
+var argVerbose = flag.Bool("v", false, "Log internals")
+
+type command func(a *app, args []string) int
+
+var commands = map[string]command{
+	"import":    importQuest,
+	"export":    exportQuest,
+	"list":      listQuests,
+	"show":      showQuest,
+	"add-stage": addStage,
+	"rm":        removeQuest,
+	"validate":  validate,
+	"stats":     stats,
+	"migrate":   migrate}
 
-	if (*argQuest == "") || (*argQuestion == "") || (*argAnswers == "") {
+// app holds what is shared by commands, the storage is opened only by commands which need it
+type app struct {
+	cfg      config.Config
+	json     bool
+	pool     tgbotbase.RedisPool
+	storages *quest.Storages
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr, "\nGlobal flags:")
 		flag.PrintDefaults()
-		log.Panic("One of mandatory arguments is not set")
 	}
+	flag.CommandLine.Parse(withLegacyCommand(os.Args[1:]))
+
+	log.SetLevel(log.WarnLevel)
+	if *argVerbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	cmd, found := commands[flag.Arg(0)]
+	if !found {
+		if flag.Arg(0) != "" {
+			fmt.Fprintf(os.Stderr, "questupload: unknown command '%s'\n\n", flag.Arg(0))
+		}
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "questupload: %s\n", err)
+		os.Exit(exitUsage)
+	}
+	a := &app{cfg: cfg, json: *argJSON}
+	os.Exit(cmd(a, flag.Args()[1:]))
+}
+
+// withLegacyCommand inserts 'add-stage' before the first flag which is not a global one
+// as the uploader used to be a single command and its flags still work
+func withLegacyCommand(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") || args[i] == "--" {
+			return args
+		}
+		parts := strings.SplitN(strings.TrimLeft(args[i], "-"), "=", 2)
+		if parts[0] == "" || parts[0] == "h" || parts[0] == "help" {
+			return args
+		}
+		f := flag.CommandLine.Lookup(parts[0])
+		if f == nil {
+			fmt.Fprintln(os.Stderr, "questupload: flags without a command are deprecated, use 'questupload add-stage'")
+			return append(append(append([]string{}, args[:i]...), "add-stage"), args[i:]...)
+		}
+		// values of non-boolean global flags may be the next argument
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); len(parts) == 1 && !(ok && b.IsBoolFlag()) {
+			i++
+		}
+	}
+	return args
+}
+
+// readConfig reads bot.cfg if there is one, overrides from the environment are applied by the config
+// and flags win over both
+func readConfig() (config.Config, error) {
+	var cfg config.Config
+	path := firstSet(*argConfig, os.Getenv("QUEST_CONFIG"))
+	if path == "" {
+		if _, err := os.Stat("bot.cfg"); err == nil {
+			path = "bot.cfg"
+		}
+	}
+	if path != "" {
+		var err error
+		if cfg, err = config.ReadFile(path); err != nil {
+			return cfg, err
+		}
+	} else {
+		cfg.ApplyEnv()
+	}
+	cfg.Redis.Server = firstSet(*argRedis, cfg.Redis.Server, defaultRedisServer)
+	cfg.Redis.Pass = firstSet(*argPass, cfg.Redis.Pass)
+	return cfg, cfg.ValidateStorage()
+}
 
-	if *argStage == "" {
-		*argStage = time.Now().Format(timeFormat)
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
 	}
+	return ""
+}
 
-	answers := strings.Split(*argAnswers, ";")
+func (a *app) redisPool() tgbotbase.RedisPool {
+	if a.pool == nil {
+		a.pool = tgbotbase.NewRedisPool(a.cfg.Redis)
+	}
+	return a.pool
+}
 
-	q := quest.NewQuest()
-	stage := quest.NewStage(*argQuestion, answers)
-	if *argPic != "" {
-		if (*argPic)[:4] == "http" {
-			log.WithField("pic", *argPic).Panic("HTTP will be handled later")
+func (a *app) openStorages() (quest.Storages, error) {
+	if a.storages == nil {
+		var pool tgbotbase.RedisPool
+		if a.cfg.NeedsRedis() {
+			pool = a.redisPool()
 		}
-		f, err := os.Open(*argPic)
+		storages, err := a.cfg.NewStorages(pool)
 		if err != nil {
-			log.WithFields(log.Fields{"pic": *argPic, "error": err}).Panic("Error on file open")
+			return quest.Storages{}, err
 		}
-		b := make([]byte, 1024*1024)
-		n, err := f.Read(b)
+		a.storages = &storages
+	}
+	return *a.storages, nil
+}
+
+// loadQuest returns the draft or the current published version of the quest
+func (a *app) loadQuest(questID string, published bool) (quest.Quest, int, error) {
+	storages, err := a.openStorages()
+	if err != nil {
+		return quest.Quest{}, 0, err
+	}
+	if !published {
+		q, err := storages.Quests.LoadQuest(questID)
 		if err != nil {
-			log.WithFields(log.Fields{"pic": *argPic, "error": err}).Panic("Error on file reading")
+			return quest.Quest{}, 0, err
+		}
+		// storages return an empty draft for unknown quests
+		if len(q.StageIDs()) == 0 {
+			return quest.Quest{}, 0, notFoundError(questID)
 		}
-		log.WithFields(log.Fields{"pic": *argPic, "bytes_read": n}).Debug("File has been read")
-		stage.AddPicture(b[:n])
+		return *q, 0, nil
+	}
+	_, current, err := storages.Versions.ListVersions(questID)
+	if err != nil {
+		return quest.Quest{}, 0, err
+	}
+	if current == 0 {
+		return quest.Quest{}, 0, notFoundError(questID)
 	}
-	q.AddStage(*argStage, stage)
+	v, err := storages.Versions.LoadVersion(questID, current)
+	if err != nil {
+		return quest.Quest{}, 0, err
+	}
+	return v.Quest, v.Number, nil
+}
 
-	cfg := tgbotbase.RedisConfig{"127.0.0.1:6379", ""}
-	pool := tgbotbase.NewRedisPool(cfg)
-	storage := quest.NewRedisQuestStorage(pool)
-	storage.StoreQuest(*quest.NewQuestRecord(*argQuest, q))
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("Quest '%s' not found or has no stages", string(e))
+}
+
+// exitCode tells missing quests, which are problems of the input, from storage failures
+func exitCode(err error) int {
+	if _, ok := err.(notFoundError); ok {
+		return exitProblems
+	}
+	return exitStorage
+}
+
+// fail prints the error and returns the exit code
+func fail(code int, format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "questupload: "+format+"\n", args...)
+	return code
+}
+
+// newFlagSet creates flags of a command which exit with the usage code on errors
+func newFlagSet(name string, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: questupload %s %s\n", name, synopsis)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "questupload: unexpected arguments %v\n", flags.Args())
+		flags.Usage()
+		return false
+	}
+	return true
+}
+
+func printJSON(v interface{}) int {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	fmt.Println(string(data))
+	return exitOK
+}
+
+// failures makes load failures printable as JSON as errors are not marshalled
+func failures(fs []quest.LoadFailure) []map[string]string {
+	res := make([]map[string]string, 0, len(fs))
+	for _, f := range fs {
+		res = append(res, map[string]string{"quest": f.QuestID, "error": f.Err.Error()})
+	}
+	return res
 }
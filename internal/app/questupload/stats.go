@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+)
+
+// stats replays the event log kept in Redis and prints results of players
+func stats(a *app, args []string) int {
+	flags := newFlagSet("stats", "[-quest <id>] [-ranking first|best|last]")
+	argQuest := flags.String("quest", "", "ID of the quest (optional, all quests by default)")
+	argRanking := flags.String("ranking", "", "Which attempt counts for the ranking, the policy of the quest by default")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+	var policy quest.RankingPolicy
+	if *argRanking != "" {
+		var err error
+		if policy, err = quest.ParseRankingPolicy(*argRanking); err != nil {
+			return fail(exitUsage, "%s", err)
+		}
+	}
+
+	events, err := quest.NewRedisEventSink(a.redisPool()).LoadEvents()
+	if err != nil {
+		return fail(exitStorage, "Unable to load events: %s", err)
+	}
+	sink := quest.NewStatsSink(&sync.Map{})
+	sink.Replay(events)
+
+	questIDs := []string{*argQuest}
+	if *argQuest == "" {
+		seen := make(map[string]bool, 0)
+		questIDs = questIDs[:0]
+		for _, e := range events {
+			if !seen[e.QuestID] {
+				seen[e.QuestID] = true
+				questIDs = append(questIDs, e.QuestID)
+			}
+		}
+		sort.Strings(questIDs)
+	}
+
+	summaries := make([]quest.QuestStats, 0, len(questIDs))
+	for _, questID := range questIDs {
+		questPolicy := policy
+		if questPolicy == "" {
+			questPolicy = a.rankingPolicy(questID)
+		}
+		summary, found := sink.Summary(questID, questPolicy)
+		if !found {
+			return fail(exitProblems, "Quest '%s' has not been played", questID)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if a.json {
+		return printJSON(summaries)
+	}
+	for i, s := range summaries {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Quest '%s': %d players, %d attempts", s.QuestID, s.Players, s.Attempts)
+		for _, result := range []quest.AttemptResult{quest.AttemptFinished, quest.AttemptInProgress, quest.AttemptAbandoned, quest.AttemptRestarted} {
+			if n := s.Results[result]; n > 0 {
+				fmt.Printf(", %d %s", n, result)
+			}
+		}
+		fmt.Println()
+		if len(s.Ranking) == 0 {
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "#\tUSER\tTIME\tMISTAKES\tSKIPPED\tFINISHED")
+		for n, r := range s.Ranking {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\n", n+1, r.Username, r.Spent, r.Mistakes, r.Skipped, r.Finished.Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+	}
+	return exitOK
+}
+
+// rankingPolicy returns the policy of the live version, the draft's one or the default
+func (a *app) rankingPolicy(questID string) quest.RankingPolicy {
+	for _, published := range []bool{true, false} {
+		if q, _, err := a.loadQuest(questID, published); err == nil && q.Info().Ranking != "" {
+			return q.Info().Ranking
+		}
+	}
+	return quest.RankFirst
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+)
+
+// validate checks stored quests and prints the report, it returns the exit code
+func validate(a *app, args []string) int {
+	flags := newFlagSet("validate", "[-quest <id>] [-published]")
+	questID := flags.String("quest", "", "ID of the quest to check (optional, all quests by default)")
+	published := flags.Bool("published", false, "Check live versions instead of drafts")
+	if !parseFlags(flags, args) {
+		return exitUsage
+	}
+
+	storages, err := a.openStorages()
+	if err != nil {
+		return fail(exitStorage, "%s", err)
+	}
+	report := quest.ValidationReport{Blobs: storages.Blobs}
+	if *published {
+		versions, failures, err := storages.Versions.LoadCurrentVersions()
+		if err != nil {
+			return fail(exitStorage, "Unable to load published quests: %s", err)
+		}
+		report.Failures = failures
+		for _, v := range versions {
+			if *questID == "" || v.QuestID == *questID {
+				report.Add(v.QuestID, v.Quest)
+			}
+		}
+	} else if *questID != "" {
+		q, _, err := a.loadQuest(*questID, false)
+		if err != nil {
+			report.Failures = append(report.Failures, quest.LoadFailure{QuestID: *questID, Err: err})
+		} else {
+			report.Add(*questID, q)
+		}
+	} else {
+		drafts, failures, err := storages.Quests.LoadAll()
+		if err != nil {
+			return fail(exitStorage, "Unable to load quests: %s", err)
+		}
+		report.Failures = failures
+		for _, rec := range drafts {
+			report.Add(rec.ID(), rec.Quest())
+		}
+	}
+
+	code := exitOK
+	if len(report.Failures) > 0 {
+		code = exitStorage
+	} else if report.HasErrors() {
+		code = exitProblems
+	}
+	if a.json {
+		issues := report.Issues
+		if issues == nil {
+			issues = []quest.Issue{}
+		}
+		if printJSON(struct {
+			Checked  int                 `json:"checked"`
+			Issues   []quest.Issue       `json:"issues"`
+			Failures []map[string]string `json:"failures"`
+		}{report.Checked, issues, failures(report.Failures)}) != exitOK {
+			return exitStorage
+		}
+		return code
+	}
+	fmt.Println(report)
+	return code
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/gcfg.v1"
+)
+
+// Config is the content of bot.cfg, it is shared by the bot and the tools so that they find quests in the same place
+type Config struct {
+	tgbotbase.Config
+	Redis tgbotbase.RedisConfig
+	Owner struct {
+		ID []int
+	}
+	// Organizer subsections describe groups of organizers running particular quests
+	Organizer map[string]*struct {
+		ID    []int
+		Quest []string
+		// Chat is a group chat for notifications of the organizers
+		Chat int64
+	}
+	Storage struct {
+		// Backend is one of redis (default), file or memory
+		Backend string
+		// Dir is a directory of the file backend
+		Dir string
+	}
+	// Blobs configures where pictures are kept, the storage backend keeps them if it is not set
+	Blobs struct {
+		// Backend is one of redis, file, s3 or memory
+		Backend   string
+		Dir       string
+		Endpoint  string
+		Bucket    string
+		Region    string
+		AccessKey string
+		SecretKey string
+		Prefix    string
+	}
+	Events struct {
+		QueueSize int
+		// Sink lists enabled sinks: telegram, redis, log, webhook; stats are always collected
+		Sink []string
+		// DigestSeconds is a period of sending collected notifications to owners, 0 sends them immediately
+		DigestSeconds int
+		WebhookURL    string
+	}
+	// Monitor is the section of event buffering before sinks were introduced, Events replaces it
+	Monitor struct {
+		QueueSize     int
+		DigestSeconds int
+	}
+	Engine struct {
+		// RateLimit applies to quests without their own limit, e.g. 5/1m/10m
+		RateLimit string
+		// Timezone is an IANA name like Europe/Moscow for times shown in chats, the local one by default
+		Timezone string
+		// BlobCacheMB limits memory for pictures loaded from the blob store
+		BlobCacheMB int
+	}
+	// HTTP serves /healthz, /readyz and /metrics if Listen is set, e.g. 127.0.0.1:9090
+	HTTP struct {
+		Listen string
+	}
+	Shutdown struct {
+		// TimeoutSeconds limits draining events and saving progress on SIGINT or SIGTERM
+		TimeoutSeconds int
+	}
+}
+
+// envOverrides keep secrets out of bot.cfg, a set variable wins over the file
+var envOverrides = []struct {
+	name  string
+	field func(cfg *Config) *string
+}{
+	{"QUEST_TGBOT_TOKEN", func(cfg *Config) *string { return &cfg.TGBot.Token }},
+	{"QUEST_PROXY_PASS", func(cfg *Config) *string { return &cfg.Proxy_SOCKS5.Pass }},
+	{"QUEST_REDIS_SERVER", func(cfg *Config) *string { return &cfg.Redis.Server }},
+	{"QUEST_REDIS_PASS", func(cfg *Config) *string { return &cfg.Redis.Pass }},
+	{"QUEST_BLOBS_ACCESSKEY", func(cfg *Config) *string { return &cfg.Blobs.AccessKey }},
+	{"QUEST_BLOBS_SECRETKEY", func(cfg *Config) *string { return &cfg.Blobs.SecretKey }},
+	{"QUEST_EVENTS_WEBHOOKURL", func(cfg *Config) *string { return &cfg.Events.WebhookURL }},
+}
+
+// ReadFile reads the configuration and applies overrides from the environment, it is not validated
+func ReadFile(filename string) (Config, error) {
+	log.WithFields(log.Fields{"file": filename}).Info("Reading configuration")
+
+	var cfg Config
+	if err := gcfg.ReadFileInto(&cfg, filename); err != nil {
+		if os.IsNotExist(err) {
+			return Config{}, fmt.Errorf("%s does not exist, copy bot.cfg.example and fill it in or point to the file with -config", filename)
+		}
+		return Config{}, fmt.Errorf("%s: %s", filename, err)
+	}
+	cfg.applyLegacy()
+	cfg.ApplyEnv()
+	return cfg, nil
+}
+
+// applyLegacy moves settings of the [monitor] section into [events] unless they are set there
+func (cfg *Config) applyLegacy() {
+	if cfg.Monitor.QueueSize == 0 && cfg.Monitor.DigestSeconds == 0 {
+		return
+	}
+	log.Warn("[monitor] section is deprecated, move queuesize and digestseconds into [events]")
+	if cfg.Events.QueueSize == 0 {
+		cfg.Events.QueueSize = cfg.Monitor.QueueSize
+	}
+	if cfg.Events.DigestSeconds == 0 {
+		cfg.Events.DigestSeconds = cfg.Monitor.DigestSeconds
+	}
+}
+
+// ApplyEnv replaces secrets and addresses with values of set QUEST_* variables
+func (cfg *Config) ApplyEnv() {
+	for _, o := range envOverrides {
+		if v, found := os.LookupEnv(o.name); found && v != "" {
+			*o.field(cfg) = v
+			log.WithFields(log.Fields{"variable": o.name}).Info("Configuration value is taken from the environment")
+		}
+	}
+}
+
+// EngineConfig converts the engine section, it fails only on values which Validate reports
+func (cfg Config) EngineConfig() (quest.EngineConfig, error) {
+	limit, err := quest.ParseRateLimit(cfg.Engine.RateLimit)
+	if err != nil {
+		return quest.EngineConfig{}, err
+	}
+	return quest.EngineConfig{
+		DefaultRateLimit: limit,
+		BlobCacheSize:    cfg.Engine.BlobCacheMB * 1024 * 1024}, nil
+}
+
+// ShutdownTimeout returns the limit of a graceful shutdown, 30 seconds by default
+func (cfg Config) ShutdownTimeout() time.Duration {
+	if cfg.Shutdown.TimeoutSeconds == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(cfg.Shutdown.TimeoutSeconds) * time.Second
+}
+
+// Location returns the timezone of times shown in chats
+func (cfg Config) Location() (*time.Location, error) {
+	if cfg.Engine.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(cfg.Engine.Timezone)
+}
+
+// NeedsRedis tells whether the storage, blobs or any event sink keeps data in Redis
+func (cfg Config) NeedsRedis() bool {
+	if cfg.Storage.Backend == "" || cfg.Storage.Backend == "redis" || cfg.Blobs.Backend == "redis" {
+		return true
+	}
+	for _, name := range cfg.Events.Sink {
+		if name == "redis" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBlobStore creates the configured blob store, nil leaves pictures to the storage backend
+func (cfg Config) NewBlobStore(pool tgbotbase.RedisPool) (quest.BlobStore, error) {
+	switch cfg.Blobs.Backend {
+	case "":
+		return nil, nil
+	case "redis":
+		return quest.NewRedisBlobStore(pool), nil
+	case "file":
+		return quest.NewFileBlobStore(cfg.Blobs.Dir)
+	case "s3":
+		return quest.NewS3BlobStore(quest.S3Config{
+			Endpoint:  cfg.Blobs.Endpoint,
+			Bucket:    cfg.Blobs.Bucket,
+			Region:    cfg.Blobs.Region,
+			AccessKey: cfg.Blobs.AccessKey,
+			SecretKey: cfg.Blobs.SecretKey,
+			Prefix:    cfg.Blobs.Prefix})
+	case "memory":
+		return quest.NewMemoryBlobStore(), nil
+	}
+	return nil, fmt.Errorf("Unknown blob store backend '%s'", cfg.Blobs.Backend)
+}
+
+// NewStorages creates storages of the configured backend, the pool may be nil unless NeedsRedis
+func (cfg Config) NewStorages(pool tgbotbase.RedisPool) (quest.Storages, error) {
+	blobs, err := cfg.NewBlobStore(pool)
+	if err != nil {
+		return quest.Storages{}, err
+	}
+	switch cfg.Storage.Backend {
+	case "", "redis":
+		return quest.NewRedisStorages(pool, blobs), nil
+	case "file":
+		return quest.NewFileStorages(cfg.Storage.Dir, blobs)
+	case "memory":
+		log.Warn("Memory storage is used, all quests and progress are lost on exit")
+		storages := quest.NewMemoryStorages()
+		if blobs != nil {
+			storages.Blobs = blobs
+		}
+		return storages, nil
+	}
+	return quest.Storages{}, fmt.Errorf("Unknown storage backend '%s'", cfg.Storage.Backend)
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/quest"
+)
+
+// ValidationError lists all problems of the configuration so that they can be fixed at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "Configuration has problems:\n" + strings.Join(e, "\n")
+}
+
+// Validate checks everything the bot needs, nil is returned if there are no problems
+func (cfg Config) Validate() error {
+	problems := cfg.storageProblems()
+	if cfg.TGBot.Token == "" || strings.ContainsAny(cfg.TGBot.Token, " <>") {
+		problems = append(problems, "tgbot.token is not set: put the token from @BotFather into [tgbot] or QUEST_TGBOT_TOKEN")
+	}
+	if len(cfg.Owner.ID) == 0 {
+		problems = append(problems, "owner.id is not set: add at least one Telegram user ID of an owner into [owner]")
+	}
+	for _, id := range cfg.Owner.ID {
+		if id <= 0 {
+			problems = append(problems, fmt.Sprintf("owner.id %d is not a Telegram user ID, user IDs are positive", id))
+		}
+	}
+	for name, org := range cfg.Organizer {
+		for _, id := range org.ID {
+			if id <= 0 {
+				problems = append(problems, fmt.Sprintf("organizer \"%s\".id %d is not a Telegram user ID, user IDs are positive", name, id))
+			}
+		}
+	}
+	problems = append(problems, cfg.eventsProblems()...)
+	problems = append(problems, cfg.engineProblems()...)
+	if cfg.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTP.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("http.listen '%s' is not an address: use host:port like 127.0.0.1:9090 or :9090", cfg.HTTP.Listen))
+		}
+	}
+	if cfg.Shutdown.TimeoutSeconds < 0 {
+		problems = append(problems, fmt.Sprintf("shutdown.timeoutseconds %d is negative: remove it to use the default of 30", cfg.Shutdown.TimeoutSeconds))
+	}
+	if len(problems) > 0 {
+		return ValidationError(problems)
+	}
+	return nil
+}
+
+// ValidateStorage checks only what is needed to open storages, e.g. by tools
+func (cfg Config) ValidateStorage() error {
+	if problems := cfg.storageProblems(); len(problems) > 0 {
+		return ValidationError(problems)
+	}
+	return nil
+}
+
+func (cfg Config) storageProblems() []string {
+	problems := []string{}
+	if cfg.NeedsRedis() && cfg.Redis.Server == "" {
+		problems = append(problems, "redis.server is not set: put host:port of Redis into [redis] or QUEST_REDIS_SERVER, or use another storage backend")
+	}
+	switch cfg.Storage.Backend {
+	case "", "redis", "memory":
+	case "file":
+		if cfg.Storage.Dir == "" {
+			problems = append(problems, "storage.dir is not set: the file backend needs a directory for quests and state")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("storage.backend '%s' is unknown: use redis, file or memory", cfg.Storage.Backend))
+	}
+	switch cfg.Blobs.Backend {
+	case "", "redis", "memory":
+	case "file":
+		if cfg.Blobs.Dir == "" {
+			problems = append(problems, "blobs.dir is not set: the file blob store needs a directory for pictures")
+		}
+	case "s3":
+		for _, f := range []struct{ name, value string }{
+			{"endpoint", cfg.Blobs.Endpoint},
+			{"bucket", cfg.Blobs.Bucket},
+			{"accesskey", cfg.Blobs.AccessKey},
+			{"secretkey", cfg.Blobs.SecretKey}} {
+			if f.value == "" {
+				problems = append(problems, fmt.Sprintf("blobs.%s is not set: the s3 blob store needs it", f.name))
+			}
+		}
+		if u, err := url.Parse(cfg.Blobs.Endpoint); cfg.Blobs.Endpoint != "" && (err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")) {
+			problems = append(problems, fmt.Sprintf("blobs.endpoint '%s' is not an HTTP(S) URL like http://127.0.0.1:9000", cfg.Blobs.Endpoint))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("blobs.backend '%s' is unknown: use redis, file, s3 or memory, or remove [blobs] to keep pictures in the storage", cfg.Blobs.Backend))
+	}
+	return problems
+}
+
+func (cfg Config) eventsProblems() []string {
+	problems := []string{}
+	for _, name := range cfg.Events.Sink {
+		switch name {
+		case "telegram", "redis", "log":
+		case "webhook":
+			if cfg.Events.WebhookURL == "" {
+				problems = append(problems, "events.webhookurl is not set: the webhook sink needs the URL to post events to, set it or QUEST_EVENTS_WEBHOOKURL")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("events.sink '%s' is unknown: use telegram, redis, log or webhook", name))
+		}
+	}
+	if u, err := url.Parse(cfg.Events.WebhookURL); cfg.Events.WebhookURL != "" && (err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")) {
+		problems = append(problems, "events.webhookurl is not an HTTP(S) URL")
+	}
+	if cfg.Events.QueueSize < 0 {
+		problems = append(problems, fmt.Sprintf("events.queuesize %d is negative: remove it to use the default of 1024", cfg.Events.QueueSize))
+	}
+	if cfg.Events.DigestSeconds < 0 {
+		problems = append(problems, fmt.Sprintf("events.digestseconds %d is negative: use 0 to send notifications immediately", cfg.Events.DigestSeconds))
+	}
+	return problems
+}
+
+func (cfg Config) engineProblems() []string {
+	problems := []string{}
+	if limit, err := quest.ParseRateLimit(cfg.Engine.RateLimit); err != nil {
+		problems = append(problems, fmt.Sprintf("engine.ratelimit: %s, e.g. 5/1m/10m", err))
+	} else if limit.Enabled() && (limit.Window <= 0 || limit.Cooldown <= 0) {
+		problems = append(problems, fmt.Sprintf("engine.ratelimit %s must have positive window and cooldown", limit))
+	}
+	if cfg.Engine.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Engine.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("engine.timezone '%s' is unknown: use an IANA name like Europe/Moscow or UTC", cfg.Engine.Timezone))
+		}
+	}
+	if cfg.Engine.BlobCacheMB < 0 {
+		problems = append(problems, fmt.Sprintf("engine.blobcachemb %d is negative: remove it to use the default of 64", cfg.Engine.BlobCacheMB))
+	}
+	return problems
+}
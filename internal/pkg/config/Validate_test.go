@@ -0,0 +1,99 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		var cfg Config
+		cfg.TGBot.Token = "123:abc"
+		cfg.Owner.ID = []int{1}
+		cfg.Storage.Backend = "memory"
+		return cfg
+	}
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// problems are substrings of expected problems, none means the configuration is valid
+		problems []string
+	}{
+		{name: "valid", modify: func(cfg *Config) {}},
+		{name: "full", modify: func(cfg *Config) {
+			cfg.Storage.Backend = "file"
+			cfg.Storage.Dir = "/var/lib/quest"
+			cfg.Blobs.Backend = "s3"
+			cfg.Blobs.Endpoint = "http://127.0.0.1:9000"
+			cfg.Blobs.Bucket = "quest"
+			cfg.Blobs.AccessKey = "key"
+			cfg.Blobs.SecretKey = "secret"
+			cfg.Events.Sink = []string{"telegram", "log", "webhook"}
+			cfg.Events.WebhookURL = "https://example.com/hook"
+			cfg.Engine.RateLimit = "5/1m/10m"
+			cfg.Engine.Timezone = "Europe/Moscow"
+			cfg.HTTP.Listen = ":9090"
+		}},
+		{name: "placeholder token", modify: func(cfg *Config) { cfg.TGBot.Token = "<token>" }, problems: []string{"tgbot.token"}},
+		{name: "no owners", modify: func(cfg *Config) { cfg.Owner.ID = nil }, problems: []string{"owner.id is not set"}},
+		{name: "negative owner", modify: func(cfg *Config) { cfg.Owner.ID = []int{-5} }, problems: []string{"owner.id -5"}},
+		{name: "redis without server", modify: func(cfg *Config) { cfg.Storage.Backend = "redis" }, problems: []string{"redis.server"}},
+		{name: "file without dir", modify: func(cfg *Config) { cfg.Storage.Backend = "file" }, problems: []string{"storage.dir"}},
+		{name: "unknown backend", modify: func(cfg *Config) { cfg.Storage.Backend = "mongo" }, problems: []string{"storage.backend 'mongo'"}},
+		{name: "s3 incomplete", modify: func(cfg *Config) {
+			cfg.Blobs.Backend = "s3"
+			cfg.Blobs.Endpoint = "127.0.0.1:9000"
+		}, problems: []string{"blobs.bucket", "blobs.accesskey", "blobs.secretkey", "blobs.endpoint '127.0.0.1:9000'"}},
+		{name: "webhook without URL", modify: func(cfg *Config) { cfg.Events.Sink = []string{"webhook"} }, problems: []string{"events.webhookurl is not set"}},
+		{name: "unknown sink", modify: func(cfg *Config) { cfg.Events.Sink = []string{"kafka"} }, problems: []string{"events.sink 'kafka'"}},
+		{name: "negative queue", modify: func(cfg *Config) { cfg.Events.QueueSize = -1 }, problems: []string{"events.queuesize"}},
+		{name: "bad rate limit", modify: func(cfg *Config) { cfg.Engine.RateLimit = "5/1m" }, problems: []string{"engine.ratelimit"}},
+		{name: "zero cooldown", modify: func(cfg *Config) { cfg.Engine.RateLimit = "5/1m/0s" }, problems: []string{"positive window and cooldown"}},
+		{name: "unknown timezone", modify: func(cfg *Config) { cfg.Engine.Timezone = "Mars/Olympus" }, problems: []string{"engine.timezone"}},
+		{name: "bad listen", modify: func(cfg *Config) { cfg.HTTP.Listen = "9090" }, problems: []string{"http.listen"}},
+		{name: "negative timeout", modify: func(cfg *Config) { cfg.Shutdown.TimeoutSeconds = -1 }, problems: []string{"shutdown.timeoutseconds"}},
+		{name: "all problems at once", modify: func(cfg *Config) {
+			cfg.TGBot.Token = ""
+			cfg.Owner.ID = nil
+			cfg.Engine.BlobCacheMB = -1
+		}, problems: []string{"tgbot.token", "owner.id", "engine.blobcachemb"}},
+	}
+	for _, tt := range tests {
+		cfg := valid()
+		tt.modify(&cfg)
+		err := cfg.Validate()
+		if len(tt.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected problems: %s", tt.name, err)
+			}
+			continue
+		}
+		problems, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("%s: Validate() = %v, want ValidationError", tt.name, err)
+			continue
+		}
+		if len(problems) != len(tt.problems) {
+			t.Errorf("%s: problems %q, want %d", tt.name, problems, len(tt.problems))
+		}
+		for _, want := range tt.problems {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: problems %q do not mention '%s'", tt.name, problems, want)
+			}
+		}
+	}
+}
+
+func TestApplyLegacy(t *testing.T) {
+	var cfg Config
+	cfg.Monitor.QueueSize = 16
+	cfg.Monitor.DigestSeconds = 60
+	cfg.Events.DigestSeconds = 30
+	cfg.applyLegacy()
+	if cfg.Events.QueueSize != 16 {
+		t.Errorf("events.queuesize is %d, want 16 from [monitor]", cfg.Events.QueueSize)
+	}
+	if cfg.Events.DigestSeconds != 30 {
+		t.Errorf("events.digestseconds is %d, want 30 set in [events]", cfg.Events.DigestSeconds)
+	}
+}
@@ -0,0 +1,242 @@
+// Package metrics renders counters, gauges and histograms in the Prometheus text format,
+// the format is simple enough not to pull the client library into the bot
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies of handlers in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry keeps metrics in the order of registration
+type Registry struct {
+	mutex    sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(f family) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Render writes all metrics in the text exposition format
+func (r *Registry) Render(w io.Writer) {
+	r.mutex.Lock()
+	families := append([]family{}, r.families...)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	bw.Flush()
+}
+
+// Handler serves the metrics for /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Render(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+// series renders the name with labels, extra label is used for histogram buckets
+func (d desc) series(name string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", d.labels[i], escape(v)))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[0], escape(extra[1])))
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key, values are kept to render them
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a monotonic value per combination of labels
+type Counter struct {
+	desc
+	mutex       sync.Mutex
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:        desc{name: name, help: help, kind: "counter", labels: labels},
+		values:      make(map[string]float64, 0),
+		labelValues: make(map[string][]string, 0)}
+	r.add(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.labelValues[key]; !found {
+		c.labelValues[key] = append([]string{}, labelValues...)
+	}
+	c.values[key] += delta
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.labelValues) {
+		fmt.Fprintf(w, "%s %s\n", c.series(c.name, c.labelValues[key]), formatValue(c.values[key]))
+	}
+}
+
+// Func collects values on every scrape, e.g. from counters kept by other components
+type Func struct {
+	desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewCounterFunc registers a counter whose values are collected on scrape
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.add(&Func{desc: desc{name: name, help: help, kind: "counter", labels: labels}, collect: collect})
+}
+
+// NewGaugeFunc registers a gauge whose values are collected on scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.add(&Func{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+func (f *Func) write(w io.Writer) {
+	f.header(w)
+	f.collect(func(value float64, labelValues ...string) {
+		fmt.Fprintf(w, "%s %s\n", f.series(f.name, labelValues), formatValue(value))
+	})
+}
+
+// Histogram counts observations in cumulative buckets per combination of labels
+type Histogram struct {
+	desc
+	buckets []float64
+	mutex   sync.Mutex
+	data    map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: append([]float64{}, buckets...),
+		data:    make(map[string]*histogramSeries, 0)}
+	sort.Float64s(h.buckets)
+	r.add(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, found := h.data[key]
+	if !found {
+		s = &histogramSeries{labels: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.data[key] = s
+	}
+	for i, le := range h.buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.data))
+	for key := range h.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.data[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", s.labels, "le", formatValue(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", s.labels), s.count)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
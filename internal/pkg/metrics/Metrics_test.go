@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounter("answers_total", "Answers.", "quest", "result")
+	counter.Inc("q", "correct")
+	counter.Add(2, "q", "wrong")
+	counter.Inc("a\"b", "correct")
+	reg.NewGaugeFunc("players", "Active players.", nil, func(emit func(float64, ...string)) {
+		emit(3)
+	})
+	hist := reg.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "handler")
+	hist.Observe(0.05, "start")
+	hist.Observe(0.5, "start")
+	hist.Observe(5, "start")
+
+	var buf bytes.Buffer
+	reg.Render(&buf)
+	want := `# HELP answers_total Answers.
+# TYPE answers_total counter
+answers_total{quest="a\"b",result="correct"} 1
+answers_total{quest="q",result="correct"} 1
+answers_total{quest="q",result="wrong"} 2
+# HELP players Active players.
+# TYPE players gauge
+players 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{handler="start",le="0.1"} 1
+latency_seconds_bucket{handler="start",le="1"} 2
+latency_seconds_bucket{handler="start",le="+Inf"} 3
+latency_seconds_sum{handler="start"} 5.55
+latency_seconds_count{handler="start"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrongLabelsPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Counter accepted a wrong number of labels")
+		}
+	}()
+	NewRegistry().NewCounter("c", "C.", "label").Inc()
+}
@@ -0,0 +1,80 @@
+package quest
+
+import (
+	"fmt"
+	"time"
+)
+
+type AttemptResult string
+
+const (
+	AttemptInProgress AttemptResult = "in progress"
+	AttemptFinished   AttemptResult = "finished"
+	AttemptAbandoned  AttemptResult = "abandoned"
+	AttemptRestarted  AttemptResult = "restarted"
+)
+
+// Attempt is a single play of a quest by a user, every start of a quest begins a new one
+type Attempt struct {
+	Number   int
+	QuestID  string
+	Result   AttemptResult
+	Started  time.Time
+	Finished time.Time
+	Mistakes int
+	Skipped  int
+	Penalty  time.Duration
+
+	answeredTimes []time.Time
+}
+
+// Spent returns time of the attempt including penalties
+func (a Attempt) Spent() time.Duration {
+	return a.Finished.Sub(a.Started) + a.Penalty
+}
+
+// RankingPolicy defines which of attempts of a user counts for the ranking
+type RankingPolicy string
+
+const (
+	RankFirst RankingPolicy = "first"
+	RankBest  RankingPolicy = "best"
+	RankLast  RankingPolicy = "last"
+)
+
+func ParseRankingPolicy(s string) (RankingPolicy, error) {
+	switch p := RankingPolicy(s); p {
+	case RankFirst, RankBest, RankLast:
+		return p, nil
+	case "":
+		return RankFirst, nil
+	}
+	return "", fmt.Errorf("Unknown ranking policy '%s'", s)
+}
+
+// rankedAttempt selects the attempt which counts for the ranking, only finished attempts are ranked
+func rankedAttempt(attempts []Attempt, policy RankingPolicy) (Attempt, bool) {
+	switch policy {
+	case RankBest:
+		var best Attempt
+		found := false
+		for _, a := range attempts {
+			if a.Result == AttemptFinished && (!found || a.Spent() < best.Spent()) {
+				best = a
+				found = true
+			}
+		}
+		return best, found
+	case RankLast:
+		for i := len(attempts) - 1; i >= 0; i-- {
+			if attempts[i].Result == AttemptFinished {
+				return attempts[i], true
+			}
+		}
+		return Attempt{}, false
+	}
+	if len(attempts) == 0 || attempts[0].Result != AttemptFinished {
+		return Attempt{}, false
+	}
+	return attempts[0], true
+}
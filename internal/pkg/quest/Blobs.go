@@ -0,0 +1,263 @@
+package quest
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrBlobNotFound = errors.New("Blob not found")
+
+const blobRefPrefix = "sha256:"
+
+// BlobStore keeps media out of quest records, blobs are addressed by refs made of their content hash
+// so the same picture is stored once and a stored blob never changes
+type BlobStore interface {
+	// Put stores the data and returns its ref, storing the same data again is cheap
+	Put(data []byte) (string, error)
+	Get(ref string) ([]byte, error)
+}
+
+// BlobRef returns the ref of the data, it does not depend on the store
+func BlobRef(data []byte) string {
+	sum := sha256.Sum256(data)
+	return blobRefPrefix + hex.EncodeToString(sum[:])
+}
+
+// blobHash validates the ref and returns the hex hash which is safe to use in keys and paths
+func blobHash(ref string) (string, error) {
+	hash := strings.TrimPrefix(ref, blobRefPrefix)
+	if hash == ref || len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("Malformed blob ref '%s'", ref)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("Malformed blob ref '%s'", ref)
+	}
+	return hash, nil
+}
+
+// offloadPicture moves picture bytes of the stage into the store leaving the ref in the stage,
+// stages are kept as is without a store
+func offloadPicture(blobs BlobStore, stage Stage) (Stage, error) {
+	if blobs == nil || stage.pic == nil {
+		return stage, nil
+	}
+	ref, err := blobs.Put(stage.pic)
+	if err != nil {
+		return stage, err
+	}
+	stage.pic = nil
+	stage.picRef = ref
+	return stage, nil
+}
+
+// InlinePictures returns the quest with pictures loaded from the store into stages,
+// such a quest does not depend on the store, e.g. when it is exported
+func InlinePictures(q Quest, blobs BlobStore) (Quest, error) {
+	res := q
+	res.stages = make(map[string]Stage, len(q.stages))
+	for stageID, stage := range q.stages {
+		if stage.picRef != "" && stage.pic == nil {
+			pic, err := blobs.Get(stage.picRef)
+			if err != nil {
+				return Quest{}, fmt.Errorf("Picture of stage '%s': %s", stageID, err)
+			}
+			stage.pic = pic
+			stage.picRef = ""
+		}
+		res.stages[stageID] = stage
+	}
+	return res, nil
+}
+
+type memoryBlobStore struct {
+	mutex sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() BlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte, 0)}
+}
+
+func (s *memoryBlobStore) Put(data []byte) (string, error) {
+	ref := BlobRef(data)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blobs[ref] = append([]byte{}, data...)
+	return ref, nil
+}
+
+func (s *memoryBlobStore) Get(ref string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, found := s.blobs[ref]
+	if !found {
+		return nil, ErrBlobNotFound
+	}
+	return data, nil
+}
+
+// fileBlobStore keeps blobs as <dir>/<first 2 hex digits>/<hex hash>
+type fileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (s *fileBlobStore) path(ref string) (string, error) {
+	hash, err := blobHash(ref)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, hash[:2], hash), nil
+}
+
+func (s *fileBlobStore) Put(data []byte) (string, error) {
+	ref := BlobRef(data)
+	path, err := s.path(ref)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return ref, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return ref, writeFileAtomic(path, data)
+}
+
+func (s *fileBlobStore) Get(ref string) ([]byte, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+type redisBlobStore struct {
+	client *redis.Client
+}
+
+// NewRedisBlobStore keeps blobs next to quests, pictures are still loaded only when they are shown
+func NewRedisBlobStore(pool tgbotbase.RedisPool) BlobStore {
+	return &redisBlobStore{client: pool.GetConnByName("quest")}
+}
+
+func (s *redisBlobStore) Put(data []byte) (string, error) {
+	ref := BlobRef(data)
+	hash, err := blobHash(ref)
+	if err != nil {
+		return "", err
+	}
+	return ref, s.client.SetNX(redisBlobKey(hash), data, 0).Err()
+}
+
+func (s *redisBlobStore) Get(ref string) ([]byte, error) {
+	hash, err := blobHash(ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.client.Get(redisBlobKey(hash)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func redisBlobKey(hash string) string {
+	return "tg:blob:" + hash
+}
+
+// cachedBlobStore keeps recently used blobs in memory up to the limit of their total size
+type cachedBlobStore struct {
+	store    BlobStore
+	maxBytes int
+	mutex    sync.Mutex
+	size     int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type cachedBlob struct {
+	ref  string
+	data []byte
+}
+
+func NewCachedBlobStore(store BlobStore, maxBytes int) BlobStore {
+	return &cachedBlobStore{
+		store:    store,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element, 0)}
+}
+
+func (s *cachedBlobStore) Put(data []byte) (string, error) {
+	ref, err := s.store.Put(data)
+	if err != nil {
+		return "", err
+	}
+	s.add(ref, data)
+	return ref, nil
+}
+
+func (s *cachedBlobStore) Get(ref string) ([]byte, error) {
+	s.mutex.Lock()
+	if e, found := s.entries[ref]; found {
+		s.order.MoveToFront(e)
+		s.mutex.Unlock()
+		return e.Value.(*cachedBlob).data, nil
+	}
+	s.mutex.Unlock()
+
+	data, err := s.store.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	if BlobRef(data) != ref {
+		log.WithFields(log.Fields{"ref": ref}).Error("Blob content does not match its ref")
+		return nil, fmt.Errorf("Blob '%s' is corrupted", ref)
+	}
+	s.add(ref, data)
+	return data, nil
+}
+
+func (s *cachedBlobStore) add(ref string, data []byte) {
+	if len(data) > s.maxBytes {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, found := s.entries[ref]; found {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.entries[ref] = s.order.PushFront(&cachedBlob{ref, data})
+	s.size += len(data)
+	for s.size > s.maxBytes {
+		oldest := s.order.Back()
+		blob := s.order.Remove(oldest).(*cachedBlob)
+		delete(s.entries, blob.ref)
+		s.size -= len(blob.data)
+	}
+}
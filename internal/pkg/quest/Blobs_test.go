@@ -0,0 +1,60 @@
+package quest
+
+import (
+	"bytes"
+	"testing"
+)
+
+// countingBlobStore counts reads which reach the underlying store
+type countingBlobStore struct {
+	BlobStore
+	gets int
+}
+
+func (s *countingBlobStore) Get(ref string) ([]byte, error) {
+	s.gets++
+	return s.BlobStore.Get(ref)
+}
+
+func TestCachedBlobStore(t *testing.T) {
+	blob := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 10)
+	}
+	tests := []struct {
+		name string
+		// puts go to the store directly, reads go through a cache of 25 bytes
+		reads    []byte
+		wantGets int
+	}{
+		{name: "repeated read is cached", reads: []byte{1, 1, 1}, wantGets: 1},
+		{name: "two blobs fit", reads: []byte{1, 2, 1, 2}, wantGets: 2},
+		{name: "least recently used is evicted", reads: []byte{1, 2, 3, 1}, wantGets: 4},
+		{name: "recent use keeps the blob", reads: []byte{1, 2, 1, 3, 1}, wantGets: 3},
+		{name: "blob over the limit is not cached", reads: []byte{9, 9}, wantGets: 2},
+	}
+	for _, tt := range tests {
+		store := &countingBlobStore{BlobStore: NewMemoryBlobStore()}
+		refs := make(map[byte]string, 0)
+		for _, b := range []byte{1, 2, 3} {
+			refs[b], _ = store.Put(blob(b))
+		}
+		refs[9], _ = store.Put(bytes.Repeat([]byte{9}, 30))
+		cache := NewCachedBlobStore(store, 25)
+		for _, b := range tt.reads {
+			data, err := cache.Get(refs[b])
+			if err != nil || data[0] != b {
+				t.Fatalf("%s: Get of blob %d = %v, %v", tt.name, b, data, err)
+			}
+		}
+		if store.gets != tt.wantGets {
+			t.Errorf("%s: %d reads of the store, want %d", tt.name, store.gets, tt.wantGets)
+		}
+	}
+}
+
+func TestCachedBlobStoreMissing(t *testing.T) {
+	cache := NewCachedBlobStore(NewMemoryBlobStore(), 100)
+	if _, err := cache.Get(BlobRef([]byte("missing"))); err != ErrBlobNotFound {
+		t.Errorf("Get of a missing blob = %v, want ErrBlobNotFound", err)
+	}
+}
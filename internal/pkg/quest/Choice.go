@@ -0,0 +1,90 @@
+package quest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	choicePrefix = "choice"
+	choiceTried  = "choice:-"
+	// choiceAttemptMod keeps attempt tokens within 5 base36 digits, tokens repeat only for attempts
+	// started a multiple of about 16.8 hours apart to the millisecond
+	choiceAttemptMod = 36 * 36 * 36 * 36 * 36
+)
+
+// ChoiceData is carried by a button of a choice stage
+type ChoiceData struct {
+	QuestID string
+	// Attempt tells buttons of a restarted attempt from buttons of the previous one,
+	// options of the same stage are shuffled again for a new attempt
+	Attempt  string
+	StageIx  int
+	OptionIx int
+}
+
+// choiceAttempt identifies the attempt by its start time which is saved with progress,
+// so buttons stay valid after the bot is restarted
+func choiceAttempt(started time.Time) string {
+	ms := started.UnixNano() / int64(time.Millisecond)
+	return strconv.FormatInt(ms%choiceAttemptMod, 36)
+}
+
+// choiceKeyboard builds one button per option, tried options are marked and do nothing
+func choiceKeyboard(questID string, started time.Time, quest Quest, state State) *tgbotapi.InlineKeyboardMarkup {
+	options := quest.GetOptions(state)
+	if len(options) == 0 {
+		return nil
+	}
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(options))
+	for ix, opt := range options {
+		button := tgbotapi.NewInlineKeyboardButtonData(opt, ChoiceData{questID, choiceAttempt(started), state.stageIx, ix}.String())
+		if state.isWrongChoice(ix) {
+			button = tgbotapi.NewInlineKeyboardButtonData("❌ "+opt, choiceTried)
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(button))
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &markup
+}
+
+// EmptyKeyboard is used to remove buttons from an already sent message
+func EmptyKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+}
+
+// IsTriedChoice tells whether the button is an option which has been already tried
+func IsTriedChoice(data string) bool {
+	return data == choiceTried
+}
+
+// ParseChoiceData extracts the choice from callback data produced by the choice keyboard,
+// buttons of older versions of the bot are not parsed
+func ParseChoiceData(data string) (ChoiceData, bool) {
+	parts := strings.Split(data, ":")
+	if len(parts) < 5 || parts[0] != choicePrefix {
+		return ChoiceData{}, false
+	}
+	n := len(parts)
+	stageIx, err := strconv.Atoi(parts[n-2])
+	if err != nil {
+		return ChoiceData{}, false
+	}
+	optionIx, err := strconv.Atoi(parts[n-1])
+	if err != nil {
+		return ChoiceData{}, false
+	}
+	return ChoiceData{
+		QuestID:  strings.Join(parts[1:n-3], ":"),
+		Attempt:  parts[n-3],
+		StageIx:  stageIx,
+		OptionIx: optionIx}, true
+}
+
+func (d ChoiceData) String() string {
+	return fmt.Sprintf("%s:%s:%s:%d:%d", choicePrefix, d.QuestID, d.Attempt, d.StageIx, d.OptionIx)
+}
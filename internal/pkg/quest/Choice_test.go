@@ -0,0 +1,74 @@
+package quest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestParseChoiceData(t *testing.T) {
+	tests := []struct {
+		data   string
+		choice ChoiceData
+		ok     bool
+	}{
+		{data: "choice:q:a1:0:1", choice: ChoiceData{"q", "a1", 0, 1}, ok: true},
+		{data: "choice:city:tour:b2:12:3", choice: ChoiceData{"city:tour", "b2", 12, 3}, ok: true},
+		{data: ChoiceData{"quest", "zz", 4, 2}.String(), choice: ChoiceData{"quest", "zz", 4, 2}, ok: true},
+		{data: choiceTried},
+		{data: "choice:q:0:1"},
+		{data: "choice:q:a:x:1"},
+		{data: "choice:q:a:0:y"},
+		{data: "mod:q:a:0:1"},
+		{data: ""},
+	}
+	for _, tt := range tests {
+		choice, ok := ParseChoiceData(tt.data)
+		if choice != tt.choice || ok != tt.ok {
+			t.Errorf("ParseChoiceData(%q) = (%+v, %v), want (%+v, %v)", tt.data, choice, ok, tt.choice, tt.ok)
+		}
+	}
+}
+
+func TestChoiceDataFitsTelegramLimit(t *testing.T) {
+	data := ChoiceData{strings.Repeat("q", MaxQuestIDLen), choiceAttempt(time.Now()), 9999, 99}.String()
+	if len(data) > maxCallbackDataLen {
+		t.Errorf("Callback data of %d bytes exceeds the limit of %d", len(data), maxCallbackDataLen)
+	}
+}
+
+func TestChoiceOfPreviousAttemptIsOutdated(t *testing.T) {
+	q := newTestQuest(1, func(stageID string, stage *Stage) {
+		stage.SetType(StageChoice)
+		stage.SetOptions([]string{"a1", "b", "c", "d", "e", "f"}, true)
+	})
+	engine, _ := newTestEngine(t, map[string]Quest{"q": q})
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	buttons := engine.GetCurrentKeyboard(user).InlineKeyboard
+	old := make([]ChoiceData, 0, len(buttons))
+	for _, row := range buttons {
+		choice, ok := ParseChoiceData(*row[0].CallbackData)
+		if !ok {
+			t.Fatalf("Button data %q is not parsed", *row[0].CallbackData)
+		}
+		old = append(old, choice)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if err := engine.RestartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	for _, choice := range old {
+		if res, ok := engine.CheckChoice(user, choice); ok || res.Correct {
+			t.Errorf("Button %+v of the previous attempt is accepted", choice)
+		}
+	}
+	if status, _ := engine.GetStatus(user); status.Mistakes != 0 {
+		t.Errorf("Buttons of the previous attempt made %d mistakes", status.Mistakes)
+	}
+}
@@ -0,0 +1,310 @@
+package quest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	EventStarted             EventType = "started"
+	EventFinished            EventType = "finished"
+	EventAnsweredCorrectly   EventType = "answered_correctly"
+	EventAnsweredIncorrectly EventType = "answered_incorrectly"
+	EventSubmitted           EventType = "submitted"
+	EventSkipped             EventType = "skipped"
+	EventAbandoned           EventType = "abandoned"
+	// EventSuspicious is reported when a user exceeds the rate limit of wrong answers
+	EventSuspicious EventType = "suspicious"
+)
+
+// Event is something which happened to a player in a quest, it is delivered to every sink
+type Event struct {
+	Type    EventType        `json:"type"`
+	QuestID string           `json:"quest"`
+	UserID  tgbotbase.UserID `json:"user"`
+	Time    time.Time        `json:"time"`
+
+	// Version is a version of the quest the player has started
+	Version int `json:"version,omitempty"`
+
+	// Penalty is set for skipped stages
+	Penalty time.Duration `json:"penalty,omitempty"`
+	// WrongN and Cooldown are set for suspicious activity
+	WrongN   int           `json:"wrong,omitempty"`
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+	// Submission is set for answers sent to moderation
+	Submission *Submission `json:"submission,omitempty"`
+	// Spent (including penalties), Mistakes and Skipped sum up the attempt in finished events
+	Spent    time.Duration `json:"spent,omitempty"`
+	Mistakes int           `json:"mistakes,omitempty"`
+	Skipped  int           `json:"skipped,omitempty"`
+}
+
+// IsCritical tells whether the event must reach every sink: starts and finishes make the stats
+// and submissions wait for moderators, other events only inform and may be dropped under load
+func (t EventType) IsCritical() bool {
+	switch t {
+	case EventStarted, EventFinished, EventSubmitted:
+		return true
+	}
+	return false
+}
+
+// EventSink consumes events, every sink is served by its own goroutine so it may be slow
+type EventSink interface {
+	Name() string
+	HandleEvent(e Event)
+	// Close is called after the last event has been handled
+	Close()
+}
+
+// EventPublisher delivers events of the engine to the sinks without blocking the engine
+type EventPublisher interface {
+	Publish(e Event)
+	// Metrics returns counters of the sink queues
+	Metrics() PublisherMetrics
+	// Close delivers all queued events, closes the sinks and stops the publisher
+	Close()
+}
+
+// PublisherConfig tunes buffering of the events
+type PublisherConfig struct {
+	// QueueSize is a number of events which can wait for a sink, newer informational events are dropped
+	// for that sink while critical ones wait for a free place
+	QueueSize int
+}
+
+const defaultEventQueueSize = 1024
+
+// PublisherMetrics shows how the sinks keep up with the events
+type PublisherMetrics struct {
+	Published uint64
+	Sinks     map[string]SinkMetrics
+}
+
+type SinkMetrics struct {
+	Handled uint64
+	Dropped uint64
+	// Blocked counts events which have waited for a full queue instead of being dropped
+	Blocked uint64
+	// Failed counts events the sink has not delivered, only sinks which can tell it report them
+	Failed    uint64
+	Queued    int
+	MaxQueued int
+}
+
+// failingSink is implemented by sinks which know about events they have not delivered
+type failingSink interface {
+	Failures() uint64
+}
+
+// losslessSink is implemented by fast in-memory sinks which count every event, such as metrics and stats,
+// all their events wait for a free place like critical ones
+type losslessSink interface {
+	lossless()
+}
+
+type sinkWorker struct {
+	sink     EventSink
+	lossless bool
+	ch       chan Event
+	doneCh   chan struct{}
+
+	handled   uint64
+	dropped   uint64
+	blocked   uint64
+	maxQueued int64
+}
+
+type eventPublisher struct {
+	workers []*sinkWorker
+
+	closeMutex sync.RWMutex
+	closed     bool
+
+	published uint64
+}
+
+func NewEventPublisher(cfg PublisherConfig, sinks ...EventSink) EventPublisher {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultEventQueueSize
+	}
+
+	p := &eventPublisher{workers: make([]*sinkWorker, 0, len(sinks))}
+	for _, sink := range sinks {
+		_, lossless := sink.(losslessSink)
+		w := &sinkWorker{
+			sink:     sink,
+			lossless: lossless,
+			ch:       make(chan Event, cfg.QueueSize),
+			doneCh:   make(chan struct{})}
+		p.workers = append(p.workers, w)
+		go w.run()
+		log.WithFields(log.Fields{"sink": sink.Name(), "queue": cfg.QueueSize, "lossless": lossless}).Info("Event sink has been started")
+	}
+	return p
+}
+
+// Publish does not block the caller on informational events: if a sink queue is full the event is dropped
+// for that sink; critical events and events of lossless sinks wait until the sink takes them
+func (p *eventPublisher) Publish(e Event) {
+	p.closeMutex.RLock()
+	defer p.closeMutex.RUnlock()
+
+	if p.closed {
+		log.WithFields(log.Fields{"quest": e.QuestID, "user": e.UserID, "type": e.Type}).Warn("Event publisher is closed, event is dropped")
+		return
+	}
+	atomic.AddUint64(&p.published, 1)
+	for _, w := range p.workers {
+		w.push(e)
+	}
+}
+
+func (p *eventPublisher) Metrics() PublisherMetrics {
+	m := PublisherMetrics{
+		Published: atomic.LoadUint64(&p.published),
+		Sinks:     make(map[string]SinkMetrics, len(p.workers))}
+	for _, w := range p.workers {
+		m.Sinks[w.sink.Name()] = w.metrics()
+	}
+	return m
+}
+
+func (p *eventPublisher) Close() {
+	p.closeMutex.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, w := range p.workers {
+			close(w.ch)
+		}
+	}
+	p.closeMutex.Unlock()
+
+	for _, w := range p.workers {
+		<-w.doneCh
+	}
+	log.WithFields(log.Fields{"metrics": p.Metrics()}).Info("Event publisher has been stopped")
+}
+
+func (w *sinkWorker) push(e Event) {
+	select {
+	case w.ch <- e:
+	default:
+		if !e.Type.IsCritical() && !w.lossless {
+			dropped := atomic.AddUint64(&w.dropped, 1)
+			log.WithFields(log.Fields{"sink": w.sink.Name(), "quest": e.QuestID, "user": e.UserID, "type": e.Type, "dropped": dropped}).Warn("Event sink queue is full, event is dropped")
+			return
+		}
+		blocked := atomic.AddUint64(&w.blocked, 1)
+		log.WithFields(log.Fields{"sink": w.sink.Name(), "quest": e.QuestID, "user": e.UserID, "type": e.Type, "blocked": blocked}).Warn("Event sink queue is full, event waits for the sink")
+		w.ch <- e
+	}
+	queued := int64(len(w.ch))
+	for max := atomic.LoadInt64(&w.maxQueued); queued > max; max = atomic.LoadInt64(&w.maxQueued) {
+		if atomic.CompareAndSwapInt64(&w.maxQueued, max, queued) {
+			break
+		}
+	}
+}
+
+func (w *sinkWorker) run() {
+	defer close(w.doneCh)
+	for e := range w.ch {
+		w.sink.HandleEvent(e)
+		atomic.AddUint64(&w.handled, 1)
+	}
+	w.sink.Close()
+}
+
+func (w *sinkWorker) metrics() SinkMetrics {
+	m := SinkMetrics{
+		Handled:   atomic.LoadUint64(&w.handled),
+		Dropped:   atomic.LoadUint64(&w.dropped),
+		Blocked:   atomic.LoadUint64(&w.blocked),
+		Queued:    len(w.ch),
+		MaxQueued: int(atomic.LoadInt64(&w.maxQueued))}
+	if f, ok := w.sink.(failingSink); ok {
+		m.Failed = f.Failures()
+	}
+	return m
+}
+
+// eventDispatcher hands events of the engine to the publisher in the order they have been collected;
+// the queue is not limited so a sink which makes the publisher wait holds only the dispatcher, never the engine
+type eventDispatcher struct {
+	events EventPublisher
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queue  []Event
+	busy   bool
+}
+
+func newEventDispatcher(events EventPublisher) *eventDispatcher {
+	d := &eventDispatcher{events: events}
+	d.cond = sync.NewCond(&d.mutex)
+	go d.run()
+	return d
+}
+
+// add never blocks for long, events of one call are published one after another
+func (d *eventDispatcher) add(events []Event) {
+	d.mutex.Lock()
+	d.queue = append(d.queue, events...)
+	d.mutex.Unlock()
+	d.cond.Broadcast()
+}
+
+func (d *eventDispatcher) run() {
+	for {
+		d.mutex.Lock()
+		for len(d.queue) == 0 {
+			d.cond.Wait()
+		}
+		events := d.queue
+		d.queue = nil
+		d.busy = true
+		d.mutex.Unlock()
+
+		for _, e := range events {
+			d.events.Publish(e)
+		}
+
+		d.mutex.Lock()
+		d.busy = false
+		d.mutex.Unlock()
+		d.cond.Broadcast()
+	}
+}
+
+// wait returns once all added events have been handed to the publisher
+func (d *eventDispatcher) wait() {
+	d.mutex.Lock()
+	for len(d.queue) > 0 || d.busy {
+		d.cond.Wait()
+	}
+	d.mutex.Unlock()
+}
+
+// nopEventPublisher ignores all events, it is used by tools which run the engine outside of the bot
+type nopEventPublisher struct{}
+
+func NewNopEventPublisher() EventPublisher {
+	return nopEventPublisher{}
+}
+
+func (nopEventPublisher) Publish(e Event) {
+}
+
+func (nopEventPublisher) Metrics() PublisherMetrics {
+	return PublisherMetrics{}
+}
+
+func (nopEventPublisher) Close() {
+}
@@ -0,0 +1,123 @@
+package quest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// gatedSink handles events only after the gate is opened so that its queue fills up
+type gatedSink struct {
+	gate   chan struct{}
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (s *gatedSink) Name() string {
+	return "gated"
+}
+
+func (s *gatedSink) HandleEvent(e Event) {
+	<-s.gate
+	s.mutex.Lock()
+	s.events = append(s.events, e)
+	s.mutex.Unlock()
+}
+
+func (s *gatedSink) Close() {
+}
+
+func TestPublisherKeepsCriticalEvents(t *testing.T) {
+	sink := &gatedSink{gate: make(chan struct{})}
+	publisher := NewEventPublisher(PublisherConfig{QueueSize: 1}, sink)
+
+	types := []EventType{EventStarted, EventAnsweredCorrectly, EventAnsweredIncorrectly, EventSubmitted, EventSkipped, EventFinished}
+	done := make(chan struct{})
+	go func() {
+		for _, typ := range types {
+			publisher.Publish(Event{Type: typ, QuestID: "q", UserID: 1})
+		}
+		close(done)
+	}()
+	close(sink.gate)
+	<-done
+	publisher.Close()
+
+	got := map[EventType]int{}
+	for _, e := range sink.events {
+		got[e.Type]++
+	}
+	for _, typ := range types {
+		if typ.IsCritical() && got[typ] != 1 {
+			t.Errorf("critical %s event is handled %d times, want 1", typ, got[typ])
+		}
+	}
+	m := publisher.Metrics().Sinks["gated"]
+	if m.Handled+m.Dropped != uint64(len(types)) {
+		t.Errorf("handled %d and dropped %d events of %d", m.Handled, m.Dropped, len(types))
+	}
+}
+
+// losslessGatedSink is a gated sink which must see every event
+type losslessGatedSink struct {
+	gatedSink
+}
+
+func (s *losslessGatedSink) lossless() {
+}
+
+func TestPublisherKeepsEventsOfLosslessSinks(t *testing.T) {
+	sink := &losslessGatedSink{gatedSink{gate: make(chan struct{})}}
+	publisher := NewEventPublisher(PublisherConfig{QueueSize: 1}, sink)
+
+	const n = 5
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			publisher.Publish(Event{Type: EventAnsweredIncorrectly, QuestID: "q", UserID: 1})
+		}
+		close(done)
+	}()
+	close(sink.gate)
+	<-done
+	publisher.Close()
+
+	if len(sink.events) != n {
+		t.Errorf("Lossless sink has handled %d events of %d", len(sink.events), n)
+	}
+	if m := publisher.Metrics().Sinks["gated"]; m.Dropped != 0 {
+		t.Errorf("%d events are dropped for a lossless sink", m.Dropped)
+	}
+}
+
+func TestDispatcherDoesNotHoldEngine(t *testing.T) {
+	sink := &gatedSink{gate: make(chan struct{})}
+	publisher := NewEventPublisher(PublisherConfig{QueueSize: 1}, sink)
+	engine, _ := newTestEngine(t, map[string]Quest{"q": newTestQuest(2, nil)})
+	engine.(*questEngine).dispatcher = newEventDispatcher(publisher)
+
+	// critical events wait for the full queue of the sink, players keep playing meanwhile
+	done := make(chan struct{})
+	go func() {
+		for user := tgbotbase.UserID(1); user <= 5; user++ {
+			if err := engine.StartQuest(user, "q"); err != nil {
+				t.Error(err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Engine is held by a slow sink")
+	}
+
+	close(sink.gate)
+	waitEvents(engine)
+	publisher.Close()
+	if len(sink.events) != 5 {
+		t.Errorf("Sink has got %d started events, want 5", len(sink.events))
+	}
+}
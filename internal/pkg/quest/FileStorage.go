@@ -0,0 +1,601 @@
+package quest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+)
+
+// file storages keep everything in a directory for small deployments without Redis:
+//   <dir>/quests/<quest>.json            drafts in the JSON definition format
+//   <dir>/versions/<quest>/<n>.json      published versions
+//   <dir>/versions/<quest>/current       number of the current version
+//   <dir>/state.json                     submissions, invites, cooldowns and notification settings
+//   <dir>/progress.json                  progress of players, written apart from the state as it changes on every answer
+//   <dir>/blobs/                         pictures unless another blob store is configured
+
+const fileExt = ".json"
+
+// fileName turns a quest ID into a name which is safe to use as a single path element
+func fileName(questID string) (string, error) {
+	name := url.PathEscape(questID)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("Quest ID '%s' cannot be used as a file name", questID)
+	}
+	return name, nil
+}
+
+// writeFileAtomic replaces the file so that readers never see it half-written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type fileQuestStorage struct {
+	mutex sync.Mutex
+	dir   string
+	blobs BlobStore
+}
+
+// NewFileQuestStorage keeps pictures in blobs, they are kept in quest files if blobs is nil
+func NewFileQuestStorage(dir string, blobs BlobStore) (QuestStorage, error) {
+	dir = filepath.Join(dir, "quests")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileQuestStorage{dir: dir, blobs: blobs}, nil
+}
+
+func (s *fileQuestStorage) path(questID string) (string, error) {
+	name, err := fileName(questID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, name+fileExt), nil
+}
+
+// read returns an empty quest if there is no file yet like other storages do
+func (s *fileQuestStorage) read(questID string) (Quest, error) {
+	path, err := s.path(questID)
+	if err != nil {
+		return Quest{}, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewQuest(), nil
+	}
+	if err != nil {
+		return Quest{}, err
+	}
+	q := NewQuest()
+	if err := json.Unmarshal(data, &q); err != nil {
+		return Quest{}, fmt.Errorf("Malformed quest file '%s': %s", path, err)
+	}
+	return q, nil
+}
+
+func (s *fileQuestStorage) write(questID string, q Quest) error {
+	path, err := s.path(questID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// update reads the quest, changes it and writes it back while no other change is in progress
+func (s *fileQuestStorage) update(questID string, change func(q *Quest)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q, err := s.read(questID)
+	if err != nil {
+		return err
+	}
+	change(&q)
+	return s.write(questID, q)
+}
+
+func (s *fileQuestStorage) StoreQuest(rec QuestRecord) error {
+	stages, err := offloadStages(s.blobs, rec.quest)
+	if err != nil {
+		return err
+	}
+	return s.update(rec.questID, func(q *Quest) {
+		q.info = mergeInfo(q.info, rec.quest.info)
+		for id, stage := range stages {
+			q.stages[id] = stage
+		}
+	})
+}
+
+func (s *fileQuestStorage) StoreStage(questID string, rec StageRecord) error {
+	stage, err := offloadPicture(s.blobs, rec.stage)
+	if err != nil {
+		return err
+	}
+	return s.update(questID, func(q *Quest) {
+		q.stages[rec.stageID] = stage
+	})
+}
+
+func (s *fileQuestStorage) DeleteStage(questID, stageID string) error {
+	return s.update(questID, func(q *Quest) {
+		delete(q.stages, stageID)
+	})
+}
+
+func (s *fileQuestStorage) DeleteQuest(questID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path, err := s.path(questID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileQuestStorage) ReplaceQuest(rec QuestRecord) error {
+	stages, err := offloadStages(s.blobs, rec.quest)
+	if err != nil {
+		return err
+	}
+	q := rec.quest
+	q.stages = stages
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(rec.questID, q)
+}
+
+func (s *fileQuestStorage) LoadAll() ([]QuestRecord, []LoadFailure, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	quests := make([]QuestRecord, 0, len(files))
+	failures := make([]LoadFailure, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileExt) || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		questID, err := url.PathUnescape(strings.TrimSuffix(f.Name(), fileExt))
+		if err != nil {
+			log.WithFields(log.Fields{"file": f.Name()}).Warn("File name is not a quest ID, skipping")
+			continue
+		}
+		q, err := s.read(questID)
+		if err != nil {
+			log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to load quest")
+			failures = append(failures, LoadFailure{questID, err})
+			continue
+		}
+		quests = append(quests, QuestRecord{questID, q})
+	}
+	return quests, failures, nil
+}
+
+func (s *fileQuestStorage) LoadQuest(questID string) (*Quest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q, err := s.read(questID)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (s *fileQuestStorage) LoadStage(questID, stageID string) (*Stage, error) {
+	q, err := s.LoadQuest(questID)
+	if err != nil {
+		return nil, err
+	}
+	stage, found := q.stages[stageID]
+	if !found {
+		return nil, fmt.Errorf("Stage '%s' of quest '%s' not found", stageID, questID)
+	}
+	return &stage, nil
+}
+
+type fileVersionStorage struct {
+	mutex sync.Mutex
+	dir   string
+	blobs BlobStore
+}
+
+// NewFileVersionStorage keeps pictures of published versions in blobs, they are kept inline if blobs is nil
+func NewFileVersionStorage(dir string, blobs BlobStore) (VersionStorage, error) {
+	dir = filepath.Join(dir, "versions")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileVersionStorage{dir: dir, blobs: blobs}, nil
+}
+
+func (s *fileVersionStorage) questDir(questID string) (string, error) {
+	name, err := fileName(questID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// numbers returns numbers of all stored versions of the quest in ascending order
+func (s *fileVersionStorage) numbers(questID string) ([]int, error) {
+	dir, err := s.questDir(questID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, len(files))
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(f.Name(), fileExt))
+		if err != nil || !strings.HasSuffix(f.Name(), fileExt) {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func (s *fileVersionStorage) PublishVersion(questID string, quest Quest) (QuestVersion, error) {
+	stages, err := offloadStages(s.blobs, quest)
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	quest.stages = stages
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dir, err := s.questDir(questID)
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return QuestVersion{}, err
+	}
+	numbers, err := s.numbers(questID)
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	number := 1
+	if len(numbers) > 0 {
+		number = numbers[len(numbers)-1] + 1
+	}
+	quest.version = number
+	v := QuestVersion{
+		QuestID:   questID,
+		Number:    number,
+		Published: time.Now(),
+		Quest:     quest}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(number)+fileExt), data); err != nil {
+		return QuestVersion{}, err
+	}
+	return v, writeFileAtomic(filepath.Join(dir, "current"), []byte(strconv.Itoa(number)))
+}
+
+func (s *fileVersionStorage) LoadVersion(questID string, number int) (*QuestVersion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadVersion(questID, number)
+}
+
+func (s *fileVersionStorage) loadVersion(questID string, number int) (*QuestVersion, error) {
+	dir, err := s.questDir(questID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(number)+fileExt))
+	if os.IsNotExist(err) {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v QuestVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("Malformed version %d of quest '%s': %s", number, questID, err)
+	}
+	v.Quest.version = v.Number
+	return &v, nil
+}
+
+func (s *fileVersionStorage) currentVersion(questID string) (int, error) {
+	dir, err := s.questDir(questID)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "current"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *fileVersionStorage) ListVersions(questID string) ([]QuestVersion, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, err := s.currentVersion(questID)
+	if err != nil {
+		return nil, 0, err
+	}
+	numbers, err := s.numbers(questID)
+	if err != nil {
+		return nil, 0, err
+	}
+	versions := make([]QuestVersion, 0, len(numbers))
+	for _, n := range numbers {
+		v, err := s.loadVersion(questID, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, current, nil
+}
+
+func (s *fileVersionStorage) SetCurrentVersion(questID string, number int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dir, err := s.questDir(questID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(number)+fileExt)); os.IsNotExist(err) {
+		return ErrVersionNotFound
+	}
+	return writeFileAtomic(filepath.Join(dir, "current"), []byte(strconv.Itoa(number)))
+}
+
+func (s *fileVersionStorage) LoadCurrentVersions() ([]QuestVersion, []LoadFailure, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make([]QuestVersion, 0, len(dirs))
+	failures := make([]LoadFailure, 0)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		questID, err := url.PathUnescape(d.Name())
+		if err != nil {
+			log.WithFields(log.Fields{"dir": d.Name()}).Warn("Directory name is not a quest ID, skipping")
+			continue
+		}
+		current, err := s.currentVersion(questID)
+		if err != nil || current == 0 {
+			if err == nil {
+				err = ErrVersionNotFound
+			}
+			failures = append(failures, LoadFailure{questID, err})
+			continue
+		}
+		v, err := s.loadVersion(questID, current)
+		if err != nil {
+			log.WithFields(log.Fields{"quest": questID, "version": current, "error": err}).Error("Unable to load current version of quest")
+			failures = append(failures, LoadFailure{questID, err})
+			continue
+		}
+		versions = append(versions, *v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].QuestID < versions[j].QuestID
+	})
+	return versions, failures, nil
+}
+
+// fileState is the content of state.json
+type fileState struct {
+	Submissions []Submission                        `json:"submissions"`
+	Invites     []Invite                            `json:"invites"`
+	Cooldowns   []Cooldown                          `json:"cooldowns"`
+	Notify      map[tgbotbase.UserID]NotifySettings `json:"notify"`
+	// Progress is only read from state files written before progress.json
+	Progress []Progress `json:"progress,omitempty"`
+}
+
+// fileStateStorage keeps the state in memory and rewrites the whole file on every change,
+// the state is small as finished submissions and expired cooldowns are dropped;
+// progress is kept in its own file which is rewritten once per batch of changed players
+type fileStateStorage struct {
+	*memoryStateStorage
+	path         string
+	progressPath string
+	// progressMutex keeps writes of progress in the order of their changes
+	progressMutex sync.Mutex
+}
+
+func NewFileStateStorage(dir string) (StateStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &fileStateStorage{
+		memoryStateStorage: NewMemoryStateStorage().(*memoryStateStorage),
+		path:               filepath.Join(dir, "state.json"),
+		progressPath:       filepath.Join(dir, "progress.json")}
+	var state fileState
+	data, err := ioutil.ReadFile(s.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("Malformed state file '%s': %s", s.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, sub := range state.Submissions {
+		s.submissions[sub.ID] = sub
+	}
+	for _, inv := range state.Invites {
+		s.invites[inv.Code] = inv
+	}
+	for _, c := range state.Cooldowns {
+		s.cooldowns[limiterKey{c.UserID, c.QuestID, c.StageID}] = c
+	}
+	for owner, settings := range state.Notify {
+		s.notify[owner] = settings
+	}
+
+	progress, err := s.readProgress()
+	if err != nil {
+		return nil, err
+	}
+	legacy := progress == nil && len(state.Progress) > 0
+	if legacy {
+		progress = state.Progress
+	}
+	for _, p := range progress {
+		s.progress[p.UserID] = append(s.progress[p.UserID], p)
+	}
+	if legacy {
+		// progress saved in state.json on shutdown is moved before state.json is rewritten without it
+		if err := s.saveProgress(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readProgress returns nil if there is no progress file
+func (s *fileStateStorage) readProgress() ([]Progress, error) {
+	data, err := ioutil.ReadFile(s.progressPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress := make([]Progress, 0)
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("Malformed progress file '%s': %s", s.progressPath, err)
+	}
+	return progress, nil
+}
+
+// saveProgress must be called under progressMutex, except on creation of the storage
+func (s *fileStateStorage) saveProgress() error {
+	s.mutex.Lock()
+	progress := make([]Progress, 0, len(s.progress))
+	for _, p := range s.progress {
+		progress = append(progress, p...)
+	}
+	s.mutex.Unlock()
+	data, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.progressPath, data)
+}
+
+// save writes the state while holding the lock so that concurrent saves are not reordered
+func (s *fileStateStorage) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := fileState{
+		Submissions: make([]Submission, 0, len(s.submissions)),
+		Invites:     make([]Invite, 0, len(s.invites)),
+		Cooldowns:   make([]Cooldown, 0, len(s.cooldowns)),
+		Notify:      s.notify}
+	for _, sub := range s.submissions {
+		state.Submissions = append(state.Submissions, sub)
+	}
+	now := time.Now()
+	for _, inv := range s.invites {
+		if keep := inv.keepUntil(); keep.IsZero() || now.Before(keep) {
+			state.Invites = append(state.Invites, inv)
+		}
+	}
+	for _, c := range s.cooldowns {
+		if now.Before(c.Until) {
+			state.Cooldowns = append(state.Cooldowns, c)
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *fileStateStorage) StoreSubmission(sub Submission) error {
+	s.memoryStateStorage.StoreSubmission(sub)
+	return s.save()
+}
+
+func (s *fileStateStorage) DeleteSubmission(id string) error {
+	s.memoryStateStorage.DeleteSubmission(id)
+	return s.save()
+}
+
+func (s *fileStateStorage) StoreInvite(inv Invite) error {
+	s.memoryStateStorage.StoreInvite(inv)
+	return s.save()
+}
+
+func (s *fileStateStorage) UseInvite(code string, userID tgbotbase.UserID) error {
+	if err := s.memoryStateStorage.UseInvite(code, userID); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *fileStateStorage) StoreCooldown(c Cooldown) error {
+	s.memoryStateStorage.StoreCooldown(c)
+	return s.save()
+}
+
+func (s *fileStateStorage) StoreNotifySettings(owner tgbotbase.UserID, settings NotifySettings) error {
+	s.memoryStateStorage.StoreNotifySettings(owner, settings)
+	return s.save()
+}
+
+func (s *fileStateStorage) StoreProgress(progress map[tgbotbase.UserID][]Progress) error {
+	s.progressMutex.Lock()
+	defer s.progressMutex.Unlock()
+	s.memoryStateStorage.StoreProgress(progress)
+	return s.saveProgress()
+}
@@ -0,0 +1,65 @@
+package quest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+var (
+	ErrInviteNotFound = errors.New("Invite not found")
+	ErrInviteExpired  = errors.New("Invite has expired")
+	ErrInviteUsedUp   = errors.New("Invite has been used up")
+	ErrInviteRequired = errors.New("Quest can be started only with an invite")
+)
+
+// inviteGrace is how long expired invites are kept so that players are told that the invite has expired
+// instead of the invite being unknown
+const inviteGrace = 30 * 24 * time.Hour
+
+// Invite grants access to a quest (optionally as a member of a team), it is delivered as a deep link payload
+type Invite struct {
+	Code    string `json:"code"`
+	QuestID string `json:"quest"`
+	Team    string `json:"team,omitempty"`
+	// MaxUses limits the number of players who can use the invite, 0 means unlimited
+	MaxUses int64 `json:"maxuses"`
+	Uses    int64 `json:"uses"`
+	// Users have used the invite, each of them is counted once
+	Users []tgbotbase.UserID `json:"users,omitempty"`
+	// Expires is zero for invites without expiration
+	Expires time.Time `json:"expires"`
+}
+
+func (inv Invite) isExpired(t time.Time) bool {
+	return !inv.Expires.IsZero() && t.After(inv.Expires)
+}
+
+// keepUntil returns when storages may forget the invite, zero means never
+func (inv Invite) keepUntil() time.Time {
+	if inv.Expires.IsZero() {
+		return time.Time{}
+	}
+	return inv.Expires.Add(inviteGrace)
+}
+
+func (inv Invite) isUsedBy(userID tgbotbase.UserID) bool {
+	for _, u := range inv.Users {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// newInviteCode generates a random code which is valid as a Telegram deep link payload
+func newInviteCode() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
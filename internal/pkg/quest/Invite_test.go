@@ -0,0 +1,91 @@
+package quest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestUseInviteCountsUsersOnce(t *testing.T) {
+	s := NewMemoryStateStorage()
+	if err := s.StoreInvite(Invite{Code: "c0de", QuestID: "q", MaxUses: 2}); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		user tgbotbase.UserID
+		err  error
+	}{
+		{user: 1},
+		{user: 1},
+		{user: 2},
+		{user: 3, err: ErrInviteUsedUp},
+		{user: 2},
+	}
+	for i, step := range steps {
+		if err := s.UseInvite("c0de", step.user); err != step.err {
+			t.Errorf("Step %d: UseInvite by %d = %v, want %v", i, step.user, err, step.err)
+		}
+	}
+	inv, err := s.LoadInvite("c0de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Uses != 2 {
+		t.Errorf("Uses = %d, want 2", inv.Uses)
+	}
+	if err := s.UseInvite("missing", 1); err != ErrInviteNotFound {
+		t.Errorf("UseInvite of a missing invite = %v, want ErrInviteNotFound", err)
+	}
+}
+
+func TestUseInviteConcurrently(t *testing.T) {
+	s := NewMemoryStateStorage()
+	if err := s.StoreInvite(Invite{Code: "c0de", QuestID: "q", MaxUses: 5}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(user tgbotbase.UserID) {
+			defer wg.Done()
+			if s.UseInvite("c0de", user) == nil {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(tgbotbase.UserID(i))
+	}
+	wg.Wait()
+	if accepted != 5 {
+		t.Errorf("%d users accepted, want 5", accepted)
+	}
+}
+
+func TestExpiredInviteIsReported(t *testing.T) {
+	engine, _ := newTestEngine(t, map[string]Quest{"q": newTestQuest(1, nil)})
+	storage := engine.(*questEngine).stateStorage
+	now := time.Now()
+	invites := []Invite{
+		{Code: "expired", QuestID: "q", Expires: now.Add(-time.Hour)},
+		{Code: "forgotten", QuestID: "q", Expires: now.Add(-inviteGrace - time.Hour)},
+	}
+	for _, inv := range invites {
+		if err := storage.StoreInvite(inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := engine.StartQuestByInvite(1, "expired"); err != ErrInviteExpired {
+		t.Errorf("Start by an expired invite = %v, want ErrInviteExpired", err)
+	}
+	if err := storage.UseInvite("expired", 1); err != ErrInviteExpired {
+		t.Errorf("UseInvite of an expired invite = %v, want ErrInviteExpired", err)
+	}
+	if _, err := engine.StartQuestByInvite(1, "forgotten"); err != ErrInviteNotFound {
+		t.Errorf("Start by an invite expired long ago = %v, want ErrInviteNotFound", err)
+	}
+}
@@ -0,0 +1,37 @@
+package quest
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// logSink writes every event into the log
+type logSink struct{}
+
+func NewLogSink() EventSink {
+	return logSink{}
+}
+
+func (logSink) Name() string {
+	return "log"
+}
+
+func (logSink) HandleEvent(e Event) {
+	fields := log.Fields{"type": e.Type, "quest": e.QuestID, "user": e.UserID, "time": e.Time}
+	if e.Version != 0 {
+		fields["version"] = e.Version
+	}
+	if e.Penalty != 0 {
+		fields["penalty"] = e.Penalty
+	}
+	if e.WrongN != 0 {
+		fields["wrong_n"] = e.WrongN
+		fields["cooldown"] = e.Cooldown
+	}
+	if e.Submission != nil {
+		fields["submission"] = e.Submission.ID
+	}
+	log.WithFields(fields).Info("Quest event")
+}
+
+func (logSink) Close() {
+}
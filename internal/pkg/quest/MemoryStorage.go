@@ -0,0 +1,323 @@
+package quest
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// memory storages keep everything in the process, they back the memory storage of the bot,
+// questsim which plays drafts of authors and tests of the engine, none of them touches Redis
+
+type memoryQuestStorage struct {
+	mutex  sync.Mutex
+	quests map[string]Quest
+}
+
+func NewMemoryQuestStorage() QuestStorage {
+	return &memoryQuestStorage{quests: make(map[string]Quest, 0)}
+}
+
+// copyQuest makes a quest which does not share stages with the original
+func copyQuest(q Quest) Quest {
+	res := q
+	res.stages = make(map[string]Stage, len(q.stages))
+	for id, stage := range q.stages {
+		res.stages[id] = stage
+	}
+	return res
+}
+
+func (s *memoryQuestStorage) StoreQuest(rec QuestRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, found := s.quests[rec.questID]
+	if !found {
+		stored = NewQuest()
+	}
+	stored.info = mergeInfo(stored.info, rec.quest.info)
+	for id, stage := range rec.quest.stages {
+		stored.stages[id] = stage
+	}
+	s.quests[rec.questID] = stored
+	return nil
+}
+
+func (s *memoryQuestStorage) StoreStage(questID string, rec StageRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, found := s.quests[questID]
+	if !found {
+		stored = NewQuest()
+		s.quests[questID] = stored
+	}
+	stored.stages[rec.stageID] = rec.stage
+	return nil
+}
+
+func (s *memoryQuestStorage) DeleteStage(questID, stageID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stored, found := s.quests[questID]; found {
+		delete(stored.stages, stageID)
+	}
+	return nil
+}
+
+func (s *memoryQuestStorage) DeleteQuest(questID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.quests, questID)
+	return nil
+}
+
+func (s *memoryQuestStorage) ReplaceQuest(rec QuestRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.quests[rec.questID] = copyQuest(rec.quest)
+	return nil
+}
+
+func (s *memoryQuestStorage) LoadAll() ([]QuestRecord, []LoadFailure, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quests := make([]QuestRecord, 0, len(s.quests))
+	for id, q := range s.quests {
+		quests = append(quests, QuestRecord{id, copyQuest(q)})
+	}
+	return quests, nil, nil
+}
+
+func (s *memoryQuestStorage) LoadQuest(questID string) (*Quest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, found := s.quests[questID]
+	if !found {
+		stored = NewQuest()
+	}
+	q := copyQuest(stored)
+	return &q, nil
+}
+
+func (s *memoryQuestStorage) LoadStage(questID, stageID string) (*Stage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stage, found := s.quests[questID].stages[stageID]
+	if !found {
+		return nil, errors.New("Stage not found")
+	}
+	return &stage, nil
+}
+
+type memoryVersionStorage struct {
+	mutex    sync.Mutex
+	versions map[string][]QuestVersion
+	current  map[string]int
+}
+
+func NewMemoryVersionStorage() VersionStorage {
+	return &memoryVersionStorage{
+		versions: make(map[string][]QuestVersion, 0),
+		current:  make(map[string]int, 0)}
+}
+
+func (s *memoryVersionStorage) PublishVersion(questID string, quest Quest) (QuestVersion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quest = copyQuest(quest)
+	quest.version = len(s.versions[questID]) + 1
+	v := QuestVersion{
+		QuestID:   questID,
+		Number:    quest.version,
+		Published: time.Now(),
+		Quest:     quest}
+	s.versions[questID] = append(s.versions[questID], v)
+	s.current[questID] = v.Number
+	return v, nil
+}
+
+func (s *memoryVersionStorage) LoadVersion(questID string, number int) (*QuestVersion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	versions := s.versions[questID]
+	if number < 1 || number > len(versions) {
+		return nil, ErrVersionNotFound
+	}
+	v := versions[number-1]
+	return &v, nil
+}
+
+func (s *memoryVersionStorage) ListVersions(questID string) ([]QuestVersion, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]QuestVersion{}, s.versions[questID]...), s.current[questID], nil
+}
+
+func (s *memoryVersionStorage) SetCurrentVersion(questID string, number int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if number < 1 || number > len(s.versions[questID]) {
+		return ErrVersionNotFound
+	}
+	s.current[questID] = number
+	return nil
+}
+
+func (s *memoryVersionStorage) LoadCurrentVersions() ([]QuestVersion, []LoadFailure, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	versions := make([]QuestVersion, 0, len(s.current))
+	for questID, number := range s.current {
+		versions = append(versions, s.versions[questID][number-1])
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].QuestID < versions[j].QuestID
+	})
+	return versions, nil, nil
+}
+
+type memoryStateStorage struct {
+	mutex       sync.Mutex
+	submissions map[string]Submission
+	invites     map[string]Invite
+	cooldowns   map[limiterKey]Cooldown
+	notify      map[tgbotbase.UserID]NotifySettings
+	progress    map[tgbotbase.UserID][]Progress
+}
+
+func NewMemoryStateStorage() StateStorage {
+	return &memoryStateStorage{
+		submissions: make(map[string]Submission, 0),
+		invites:     make(map[string]Invite, 0),
+		cooldowns:   make(map[limiterKey]Cooldown, 0),
+		notify:      make(map[tgbotbase.UserID]NotifySettings, 0),
+		progress:    make(map[tgbotbase.UserID][]Progress, 0)}
+}
+
+func (s *memoryStateStorage) StoreSubmission(sub Submission) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.submissions[sub.ID] = sub
+	return nil
+}
+
+func (s *memoryStateStorage) DeleteSubmission(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.submissions, id)
+	return nil
+}
+
+func (s *memoryStateStorage) LoadSubmissions() ([]Submission, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subs := make([]Submission, 0, len(s.submissions))
+	for _, sub := range s.submissions {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (s *memoryStateStorage) StoreInvite(inv Invite) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.invites[inv.Code] = inv
+	return nil
+}
+
+func (s *memoryStateStorage) LoadInvite(code string) (*Invite, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inv, found := s.invites[code]
+	if keep := inv.keepUntil(); !found || (!keep.IsZero() && time.Now().After(keep)) {
+		return nil, ErrInviteNotFound
+	}
+	return &inv, nil
+}
+
+func (s *memoryStateStorage) UseInvite(code string, userID tgbotbase.UserID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inv, found := s.invites[code]
+	if !found {
+		return ErrInviteNotFound
+	}
+	if inv.isExpired(time.Now()) {
+		return ErrInviteExpired
+	}
+	if inv.isUsedBy(userID) {
+		return nil
+	}
+	if inv.MaxUses > 0 && inv.Uses >= inv.MaxUses {
+		return ErrInviteUsedUp
+	}
+	inv.Uses++
+	inv.Users = append(append(make([]tgbotbase.UserID, 0, len(inv.Users)+1), inv.Users...), userID)
+	s.invites[code] = inv
+	return nil
+}
+
+func (s *memoryStateStorage) StoreCooldown(c Cooldown) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cooldowns[limiterKey{c.UserID, c.QuestID, c.StageID}] = c
+	return nil
+}
+
+func (s *memoryStateStorage) LoadCooldowns() ([]Cooldown, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	cooldowns := make([]Cooldown, 0, len(s.cooldowns))
+	for key, c := range s.cooldowns {
+		if now.After(c.Until) {
+			delete(s.cooldowns, key)
+			continue
+		}
+		cooldowns = append(cooldowns, c)
+	}
+	return cooldowns, nil
+}
+
+func (s *memoryStateStorage) StoreNotifySettings(owner tgbotbase.UserID, settings NotifySettings) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.notify[owner] = settings
+	return nil
+}
+
+func (s *memoryStateStorage) LoadNotifySettings() (map[tgbotbase.UserID]NotifySettings, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make(map[tgbotbase.UserID]NotifySettings, len(s.notify))
+	for owner, settings := range s.notify {
+		res[owner] = settings
+	}
+	return res, nil
+}
+
+func (s *memoryStateStorage) StoreProgress(progress map[tgbotbase.UserID][]Progress) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for userID, p := range progress {
+		if len(p) == 0 {
+			delete(s.progress, userID)
+			continue
+		}
+		s.progress[userID] = append([]Progress{}, p...)
+	}
+	return nil
+}
+
+func (s *memoryStateStorage) LoadProgress() ([]Progress, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := make([]Progress, 0, len(s.progress))
+	for _, progress := range s.progress {
+		res = append(res, progress...)
+	}
+	return res, nil
+}
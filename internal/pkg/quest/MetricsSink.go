@@ -0,0 +1,43 @@
+package quest
+
+import (
+	"github.com/admirallarimda/tgbot-quest/internal/pkg/metrics"
+)
+
+// metricsSink counts quests and answers for /metrics
+type metricsSink struct {
+	started  *metrics.Counter
+	finished *metrics.Counter
+	answers  *metrics.Counter
+}
+
+func NewMetricsSink(reg *metrics.Registry) EventSink {
+	return &metricsSink{
+		started:  reg.NewCounter("tgbot_quest_quests_started_total", "Quests started by players.", "quest"),
+		finished: reg.NewCounter("tgbot_quest_quests_finished_total", "Quests finished by players.", "quest"),
+		answers:  reg.NewCounter("tgbot_quest_answers_total", "Answers checked by the engine, moderated ones are counted on resolution.", "quest", "result")}
+}
+
+func (s *metricsSink) Name() string {
+	return "metrics"
+}
+
+func (s *metricsSink) HandleEvent(e Event) {
+	switch e.Type {
+	case EventStarted:
+		s.started.Inc(e.QuestID)
+	case EventFinished:
+		s.finished.Inc(e.QuestID)
+	case EventAnsweredCorrectly:
+		s.answers.Inc(e.QuestID, "correct")
+	case EventAnsweredIncorrectly:
+		s.answers.Inc(e.QuestID, "incorrect")
+	}
+}
+
+func (s *metricsSink) Close() {
+}
+
+// lossless keeps counters exact, a dropped answer would never be counted
+func (s *metricsSink) lossless() {
+}
@@ -0,0 +1,86 @@
+package quest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Submission is an answer to a moderated stage waiting for organizers' decision
+type Submission struct {
+	ID      string           `json:"id"`
+	QuestID string           `json:"quest"`
+	StageID string           `json:"stage"`
+	UserID  tgbotbase.UserID `json:"user"`
+	Answer  string           `json:"answer"`
+	Time    time.Time        `json:"time"`
+}
+
+// Decision is a verdict of a moderator on a submission
+type Decision struct {
+	Approved  bool
+	Moderator string
+	// Authorize is checked by the engine under its lock before the decision is applied, nil allows any moderator
+	Authorize func(sub Submission) bool `json:"-"`
+}
+
+// Resolution is a decision already taken on a submission, it is remembered for resolutionTTL
+// so that moderators pressing buttons of other copies of the submission learn who has resolved it
+type Resolution struct {
+	Decision
+	Time time.Time
+}
+
+// Verb returns "approved" or "rejected"
+func (r Resolution) Verb() string {
+	if r.Approved {
+		return "approved"
+	}
+	return "rejected"
+}
+
+const resolutionTTL = 24 * time.Hour
+
+const (
+	moderationPrefix  = "mod"
+	moderationApprove = "approve"
+	moderationReject  = "reject"
+)
+
+func newSubmissionID(t time.Time) string {
+	return fmt.Sprintf("%x", t.UnixNano())
+}
+
+// FormatSubmission returns a text of the submission shown to organizers
+func FormatSubmission(sub Submission, username string) string {
+	return fmt.Sprintf("Answer for '%s' (stage '%s') by '%s' at %s:\n%s", sub.QuestID, sub.StageID, username, sub.Time, sub.Answer)
+}
+
+// ModerationKeyboard returns Approve/Reject buttons for the submission
+func ModerationKeyboard(sub Submission) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", moderationData(moderationApprove, sub.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("Reject", moderationData(moderationReject, sub.ID))))
+}
+
+// ParseModerationData extracts decision from callback data produced by ModerationKeyboard
+func ParseModerationData(data string) (id string, approved bool, ok bool) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 || parts[0] != moderationPrefix {
+		return "", false, false
+	}
+	switch parts[1] {
+	case moderationApprove:
+		return parts[2], true, true
+	case moderationReject:
+		return parts[2], false, true
+	}
+	return "", false, false
+}
+
+func moderationData(decision, id string) string {
+	return fmt.Sprintf("%s:%s:%s", moderationPrefix, decision, id)
+}
@@ -0,0 +1,62 @@
+package quest
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+type moderationSink struct {
+	sender        Sender
+	notifications OwnerNotifications
+	usernames     *sync.Map
+
+	failed uint64
+}
+
+// NewModerationSink sends submitted answers to staff running the quest, it does not depend on
+// configured sinks since players wait for moderation
+func NewModerationSink(sender Sender, notifications OwnerNotifications, usernames *sync.Map) EventSink {
+	return &moderationSink{
+		sender:        sender,
+		notifications: notifications,
+		usernames:     usernames}
+}
+
+func (s *moderationSink) Name() string {
+	return "moderation"
+}
+
+func (s *moderationSink) HandleEvent(e Event) {
+	if e.Type == EventSubmitted && e.Submission != nil {
+		s.sendSubmission(*e.Submission)
+	}
+}
+
+func (s *moderationSink) Close() {
+}
+
+func (s *moderationSink) Failures() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+// sendSubmission is not batched and does not depend on subscriptions to other events,
+// owners always get submissions so that every answer has someone to moderate it
+func (s *moderationSink) sendSubmission(sub Submission) {
+	text := FormatSubmission(sub, username(s.usernames, sub.UserID))
+	staff := s.notifications.Staff()
+	chats := staffChats(s.notifications, sub.QuestID, func(member tgbotbase.UserID, settings NotifySettings) bool {
+		return staff.IsOwner(member) || settings.Watches(sub.QuestID)
+	})
+	for _, chat := range chats {
+		msg := tgbotapi.NewMessage(chat, text)
+		msg.ReplyMarkup = ModerationKeyboard(sub)
+		if err := s.sender.Send(msg); err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			log.WithFields(log.Fields{"quest": sub.QuestID, "user": sub.UserID, "chat": chat, "error": err}).Error("Unable to send submission to moderators")
+		}
+	}
+}
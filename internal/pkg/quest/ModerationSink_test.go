@@ -0,0 +1,43 @@
+package quest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestModerationSinkDelivers(t *testing.T) {
+	staff := NewStaff([]tgbotbase.UserID{1})
+	staff.AddOrganizers([]tgbotbase.UserID{2}, []string{"q"}, 0)
+	staff.AddOrganizers([]tgbotbase.UserID{3}, []string{"other"}, 0)
+	staff.AddOrganizers([]tgbotbase.UserID{4}, []string{"q"}, 0)
+	notifications := NewOwnerNotifications(NewMemoryStateStorage(), staff)
+	// the owner watches another quest and still moderates, the organizer watching another quest does not
+	if _, err := notifications.Update(1, func(s *NotifySettings) { s.Quests = []string{"other"} }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notifications.Update(2, func(s *NotifySettings) { s.Quests = []string{"other"} }); err != nil {
+		t.Fatal(err)
+	}
+	sender := newRecordingSender(4)
+	var usernames sync.Map
+
+	sink := NewModerationSink(sender, notifications, &usernames)
+	sub := Submission{ID: "s", QuestID: "q", StageID: "s1", UserID: 10, Answer: "photo"}
+	sink.HandleEvent(Event{Type: EventSubmitted, QuestID: "q", UserID: 10, Submission: &sub})
+	sink.HandleEvent(Event{Type: EventAnsweredCorrectly, QuestID: "q", UserID: 10})
+
+	for chat, want := range map[int64]int{1: 1, 2: 0, 3: 0} {
+		if got := len(sender.sent[chat]); got != want {
+			t.Errorf("Chat %d got %d submissions, want %d", chat, got, want)
+		}
+	}
+	if got := sender.sent[1]; len(got) == 1 && !strings.HasSuffix(got[0], "\nphoto") {
+		t.Errorf("Submission is sent as %q", got[0])
+	}
+	if failures := sink.(failingSink).Failures(); failures != 1 {
+		t.Errorf("%d failed submissions, want 1", failures)
+	}
+}
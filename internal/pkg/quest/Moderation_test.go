@@ -0,0 +1,118 @@
+package quest
+
+import (
+	"testing"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestParseModerationData(t *testing.T) {
+	tests := []struct {
+		data     string
+		id       string
+		approved bool
+		ok       bool
+	}{
+		{data: "mod:approve:15f3a", id: "15f3a", approved: true, ok: true},
+		{data: "mod:reject:15f3a", id: "15f3a", approved: false, ok: true},
+		{data: moderationData(moderationApprove, "abc"), id: "abc", approved: true, ok: true},
+		{data: "mod:maybe:15f3a"},
+		{data: "mod:approve"},
+		{data: "mod:approve:1:2"},
+		{data: "choice:q:0:1"},
+		{data: ""},
+	}
+	for _, tt := range tests {
+		id, approved, ok := ParseModerationData(tt.data)
+		if id != tt.id || approved != tt.approved || ok != tt.ok {
+			t.Errorf("ParseModerationData(%q) = (%q, %v, %v), want (%q, %v, %v)", tt.data, id, approved, ok, tt.id, tt.approved, tt.ok)
+		}
+	}
+}
+
+func TestResolveSubmissionTwice(t *testing.T) {
+	q := newTestQuest(2, func(stageID string, stage *Stage) {
+		stage.SetType(StageModerated)
+	})
+	engine, _ := newTestEngine(t, map[string]Quest{"q": q})
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	res := engine.CheckAnswer(user, "photo")
+	if !res.Pending || res.Submission == nil {
+		t.Fatalf("Answer has not been sent to moderation: %+v", res)
+	}
+	id := res.Submission.ID
+
+	deny := func(sub Submission) bool { return sub.QuestID != "q" }
+	if _, _, err := engine.ResolveSubmission(id, Decision{Approved: false, Moderator: "mallory", Authorize: deny}); err != ErrNotAuthorized {
+		t.Fatalf("Unauthorized decision returned %v, want ErrNotAuthorized", err)
+	}
+	if _, res, err := engine.ResolveSubmission(id, Decision{Approved: true, Moderator: "alice"}); err != nil || !res.Correct {
+		t.Fatalf("First decision has not been applied: %+v, %v", res, err)
+	}
+	if _, _, err := engine.ResolveSubmission(id, Decision{Approved: false, Moderator: "bob"}); err != ErrSubmissionResolved {
+		t.Fatalf("Second decision returned %v, want ErrSubmissionResolved", err)
+	}
+	r, found := engine.Resolution(id)
+	if !found || !r.Approved || r.Moderator != "alice" || r.Verb() != "approved" {
+		t.Errorf("Resolution = %+v, %v, want approval by alice", r, found)
+	}
+	if _, _, err := engine.ResolveSubmission("unknown", Decision{Approved: true}); err == nil || err == ErrSubmissionResolved {
+		t.Errorf("Unknown submission returned %v", err)
+	}
+}
+
+func TestSubmissionsDroppedWithStage(t *testing.T) {
+	q := newTestQuest(3, func(stageID string, stage *Stage) {
+		stage.SetType(StageModerated)
+	})
+	q.SetInfo(QuestInfo{Visibility: VisibilityHidden, Ranking: RankFirst, AllowSkip: true})
+	storages := NewMemoryStorages()
+	if err := storages.Quests.StoreQuest(*NewQuestRecord("q", q)); err != nil {
+		t.Fatal(err)
+	}
+	engine := NewQuestEngine(EngineConfig{}, storages, NewNopEventPublisher())
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	pendingN := func() (int, int) {
+		stored, err := storages.State.LoadSubmissions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(engine.PendingSubmissions()), len(stored)
+	}
+
+	steps := []struct {
+		name   string
+		action func() error
+	}{
+		{"skip", func() error {
+			_, err := engine.SkipStage(user)
+			return err
+		}},
+		{"restart", func() error {
+			return engine.RestartQuest(user, "q")
+		}},
+		{"quit", func() error {
+			return engine.QuitQuest(user)
+		}},
+	}
+	for _, step := range steps {
+		if res := engine.CheckAnswer(user, "photo"); !res.Pending {
+			t.Fatalf("%s: answer has not been sent to moderation", step.name)
+		}
+		if engineN, storedN := pendingN(); engineN != 1 || storedN != 1 {
+			t.Fatalf("%s: %d pending and %d stored submissions before, want 1", step.name, engineN, storedN)
+		}
+		if err := step.action(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if engineN, storedN := pendingN(); engineN != 0 || storedN != 0 {
+			t.Errorf("%s: %d pending and %d stored submissions left, want none", step.name, engineN, storedN)
+		}
+	}
+}
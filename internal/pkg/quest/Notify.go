@@ -0,0 +1,200 @@
+package quest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+)
+
+// NotifyEvent is a kind of notifications an owner can subscribe to
+type NotifyEvent string
+
+const (
+	NotifyStart   NotifyEvent = "start"
+	NotifyFinish  NotifyEvent = "finish"
+	NotifyAbandon NotifyEvent = "abandon"
+	// NotifySolved is sent for every solved stage
+	NotifySolved NotifyEvent = "solved"
+	// NotifyWrong is sent when a player gives several wrong answers in a row
+	NotifyWrong NotifyEvent = "wrong"
+	// NotifyTimeout is sent when a player is blocked by the rate limit
+	NotifyTimeout NotifyEvent = "timeout"
+)
+
+var AllNotifyEvents = []NotifyEvent{NotifyStart, NotifyFinish, NotifyAbandon, NotifySolved, NotifyWrong, NotifyTimeout}
+
+func ParseNotifyEvent(s string) (NotifyEvent, error) {
+	for _, e := range AllNotifyEvents {
+		if string(e) == s {
+			return e, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown notification '%s'", s)
+}
+
+const defaultWrongStreak = 5
+
+// NotifySettings defines which notifications an owner gets and where they are sent
+type NotifySettings struct {
+	Events []NotifyEvent `json:"events"`
+	// Quests limits notifications to these quests, empty means all quests
+	Quests []string `json:"quests,omitempty"`
+	// ChatID is a group chat for notifications, zero means direct messages
+	ChatID int64 `json:"chat,omitempty"`
+	// WrongStreak is a number of wrong answers in a row reported as a streak
+	WrongStreak int `json:"streak,omitempty"`
+}
+
+func DefaultNotifySettings() NotifySettings {
+	return NotifySettings{
+		Events:      []NotifyEvent{NotifyStart, NotifyFinish, NotifyAbandon, NotifyTimeout},
+		WrongStreak: defaultWrongStreak}
+}
+
+// Wants tells whether the notification about the quest should be sent
+func (s NotifySettings) Wants(e NotifyEvent, questID string) bool {
+	return s.hasEvent(e) && s.Watches(questID)
+}
+
+// Watches tells whether the quest passes the quest filter
+func (s NotifySettings) Watches(questID string) bool {
+	if len(s.Quests) == 0 {
+		return true
+	}
+	for _, q := range s.Quests {
+		if q == questID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s NotifySettings) hasEvent(e NotifyEvent) bool {
+	for _, ev := range s.Events {
+		if ev == e {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEvent subscribes to or unsubscribes from the notification
+func (s *NotifySettings) SetEvent(e NotifyEvent, on bool) {
+	events := make([]NotifyEvent, 0, len(s.Events)+1)
+	for _, ev := range s.Events {
+		if ev != e {
+			events = append(events, ev)
+		}
+	}
+	if on {
+		events = append(events, e)
+	}
+	s.Events = events
+}
+
+// Chat returns the chat where notifications of the owner are sent
+func (s NotifySettings) Chat(owner tgbotbase.UserID) int64 {
+	if s.ChatID != 0 {
+		return s.ChatID
+	}
+	return int64(owner)
+}
+
+func (s NotifySettings) String() string {
+	events := make([]string, 0, len(s.Events))
+	for _, e := range s.Events {
+		events = append(events, string(e))
+	}
+	text := "Notifications: "
+	if len(events) == 0 {
+		text += "none"
+	} else {
+		text += strings.Join(events, ", ")
+	}
+	if len(s.Quests) == 0 {
+		text += "\nQuests: all"
+	} else {
+		text += "\nQuests: " + strings.Join(s.Quests, ", ")
+	}
+	if s.ChatID == 0 {
+		text += "\nSent to: direct messages"
+	} else {
+		text += fmt.Sprintf("\nSent to: chat %d", s.ChatID)
+	}
+	return text + fmt.Sprintf("\nWrong answers streak: %d", s.WrongStreak)
+}
+
+// OwnerNotifications keeps notification settings of all owners and organizers
+type OwnerNotifications interface {
+	Staff() Staff
+	Get(owner tgbotbase.UserID) NotifySettings
+	// Update changes settings of the owner and persists them
+	Update(owner tgbotbase.UserID, change func(s *NotifySettings)) (NotifySettings, error)
+}
+
+type ownerNotifications struct {
+	mutex    sync.RWMutex
+	staff    Staff
+	settings map[tgbotbase.UserID]NotifySettings
+	storage  StateStorage
+}
+
+func NewOwnerNotifications(storage StateStorage, staff Staff) OwnerNotifications {
+	members := staff.Members()
+	n := &ownerNotifications{
+		staff:    staff,
+		settings: make(map[tgbotbase.UserID]NotifySettings, len(members)),
+		storage:  storage}
+	stored, err := storage.LoadNotifySettings()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to load notification settings, defaults are used")
+	}
+	for _, member := range members {
+		s, found := stored[member]
+		if !found {
+			s = n.defaults(member)
+		}
+		n.settings[member] = s
+	}
+	return n
+}
+
+func (n *ownerNotifications) Staff() Staff {
+	return n.staff
+}
+
+func (n *ownerNotifications) defaults(member tgbotbase.UserID) NotifySettings {
+	s := DefaultNotifySettings()
+	s.ChatID = n.staff.DefaultChat(member)
+	return s
+}
+
+func (n *ownerNotifications) Get(owner tgbotbase.UserID) NotifySettings {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if s, found := n.settings[owner]; found {
+		return s
+	}
+	return n.defaults(owner)
+}
+
+func (n *ownerNotifications) Update(owner tgbotbase.UserID, change func(s *NotifySettings)) (NotifySettings, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	s, found := n.settings[owner]
+	if !found {
+		s = n.defaults(owner)
+	}
+	change(&s)
+	if s.WrongStreak <= 0 {
+		s.WrongStreak = defaultWrongStreak
+	}
+	if err := n.storage.StoreNotifySettings(owner, s); err != nil {
+		return n.settings[owner], err
+	}
+	n.settings[owner] = s
+	return s, nil
+}
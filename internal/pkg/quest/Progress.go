@@ -0,0 +1,223 @@
+package quest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+)
+
+// Progress is a snapshot of a quest played by a user, the engine saves it shortly after every change and on shutdown
+type Progress struct {
+	UserID  tgbotbase.UserID `json:"user"`
+	QuestID string           `json:"quest"`
+	// Version is the published version the user plays, players keep it after new versions are published
+	Version int    `json:"version"`
+	Current bool   `json:"current"`
+	Team    string `json:"team,omitempty"`
+
+	Started  time.Time `json:"started"`
+	Mistakes int       `json:"mistakes"`
+	Skipped  int       `json:"skipped"`
+
+	StageIx      int              `json:"stage"`
+	StageOrder   []string         `json:"order"`
+	OptionOrder  map[string][]int `json:"options,omitempty"`
+	WrongChoices []int            `json:"wrong,omitempty"`
+}
+
+// userProgress must be called under the mutex, it returns snapshots of all quests of the user
+func (q *questEngine) userProgress(userID tgbotbase.UserID) []Progress {
+	uq, found := q.activeQuests[userID]
+	if !found {
+		return nil
+	}
+	progress := make([]Progress, 0, len(uq.quests))
+	for questID, questData := range uq.quests {
+		progress = append(progress, Progress{
+			UserID:       userID,
+			QuestID:      questID,
+			Version:      questData.quest.version,
+			Current:      questID == uq.current,
+			Team:         questData.team,
+			Started:      questData.started,
+			Mistakes:     questData.mistakes,
+			Skipped:      questData.skipped,
+			StageIx:      questData.state.stageIx,
+			StageOrder:   questData.state.stageOrder,
+			OptionOrder:  questData.state.optionOrder,
+			WrongChoices: questData.state.wrongChoices})
+	}
+	return progress
+}
+
+// defaultProgressDelay is how long changed progress waits to be written together with other changes
+const defaultProgressDelay = time.Second
+
+// progressSaver writes progress outside of the engine mutex: snapshots are collected under the mutex
+// and written in batches one after another so that an older snapshot never overwrites a newer one
+type progressSaver struct {
+	storage StateStorage
+	delay   time.Duration
+
+	mutex   sync.Mutex
+	pending map[tgbotbase.UserID][]Progress
+	// writeMutex is held while a batch is taken and written
+	writeMutex sync.Mutex
+	signal     chan struct{}
+}
+
+func newProgressSaver(storage StateStorage, delay time.Duration) *progressSaver {
+	if delay <= 0 {
+		delay = defaultProgressDelay
+	}
+	s := &progressSaver{
+		storage: storage,
+		delay:   delay,
+		pending: make(map[tgbotbase.UserID][]Progress, 0),
+		signal:  make(chan struct{}, 1)}
+	go s.run()
+	return s
+}
+
+// add replaces the pending snapshot of the user, it does not wait for the storage
+func (s *progressSaver) add(userID tgbotbase.UserID, progress []Progress) {
+	s.mutex.Lock()
+	s.pending[userID] = progress
+	s.mutex.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *progressSaver) run() {
+	for range s.signal {
+		time.Sleep(s.delay)
+		if err := s.save(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Unable to save progress, it is saved again on the next change or on shutdown")
+		}
+	}
+}
+
+// save writes all pending snapshots in one batch, a failed batch stays pending unless newer snapshots have come
+func (s *progressSaver) save() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.mutex.Lock()
+	batch := s.pending
+	s.pending = make(map[tgbotbase.UserID][]Progress, 0)
+	s.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := s.storage.StoreProgress(batch)
+	if err != nil {
+		s.mutex.Lock()
+		for userID, progress := range batch {
+			if _, newer := s.pending[userID]; !newer {
+				s.pending[userID] = progress
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+// saveProgress must be called under the mutex, it passes progress of users changed since the last call
+// to the saver so that players continue after a restart or a crash
+func (q *questEngine) saveProgress() {
+	for userID := range q.dirty {
+		delete(q.dirty, userID)
+		q.saver.add(userID, q.userProgress(userID))
+	}
+}
+
+func (q *questEngine) Flush() (int, error) {
+	defer q.dispatcher.wait()
+	q.mutex.Lock()
+	saved := 0
+	for userID := range q.activeQuests {
+		delete(q.dirty, userID)
+		progress := q.userProgress(userID)
+		q.saver.add(userID, progress)
+		saved += len(progress)
+	}
+	q.unlock()
+
+	if err := q.saver.save(); err != nil {
+		return 0, err
+	}
+	log.WithFields(log.Fields{"progress_n": saved}).Info("Progress of players has been saved")
+	return saved, nil
+}
+
+// restoreProgress brings back saved progress when the engine is created, the saved progress is kept
+// as it is until the players change it
+func (q *questEngine) restoreProgress() error {
+	progress, err := q.stateStorage.LoadProgress()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	dropped := make(map[tgbotbase.UserID]bool, 0)
+	for _, p := range progress {
+		logger := log.WithFields(log.Fields{"user": p.UserID, "quest": p.QuestID, "version": p.Version})
+		quest, err := q.progressQuest(p)
+		if err != nil {
+			logger.WithField("error", err).Warn("Progress cannot be restored, dropping it")
+			dropped[p.UserID] = true
+			continue
+		}
+		q.storeActive(p.UserID, activeUserQuest{
+			questID: p.QuestID,
+			team:    p.Team,
+			quest:   quest,
+			state: State{
+				stageIx:      p.StageIx,
+				stageOrder:   p.StageOrder,
+				optionOrder:  p.OptionOrder,
+				wrongChoices: p.WrongChoices},
+			started:  p.Started,
+			mistakes: p.Mistakes,
+			skipped:  p.Skipped})
+		if p.Current {
+			q.activeQuests[p.UserID].current = p.QuestID
+		}
+		restored++
+	}
+	// only users with dropped progress have to be saved again
+	q.dirty = dropped
+	q.saveProgress()
+	log.WithFields(log.Fields{"progress_n": len(progress), "restored_n": restored}).Info("Progress of players has been restored")
+	return nil
+}
+
+// progressQuest must be called under the mutex, it returns the version of the quest the progress belongs to
+func (q *questEngine) progressQuest(p Progress) (Quest, error) {
+	quest, found := q.quests[p.QuestID]
+	// quests added without publishing have version 0, their progress continues on the live quest
+	if p.Version == 0 && found {
+		logger := log.WithFields(log.Fields{"user": p.UserID, "quest": p.QuestID, "live_version": quest.version})
+		logger.Info("Progress of an unpublished quest continues on the live quest")
+	} else if !found || quest.version != p.Version {
+		v, err := q.versionStorage.LoadVersion(p.QuestID, p.Version)
+		if err != nil {
+			return Quest{}, err
+		}
+		quest = v.Quest
+	}
+	if p.StageIx < 0 || p.StageIx >= len(p.StageOrder) {
+		return Quest{}, fmt.Errorf("Stage %d is out of %d stages", p.StageIx, len(p.StageOrder))
+	}
+	for _, stageID := range p.StageOrder {
+		if _, found := quest.stages[stageID]; !found {
+			return Quest{}, fmt.Errorf("Stage '%s' not found", stageID)
+		}
+	}
+	return quest, nil
+}
@@ -0,0 +1,89 @@
+package quest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// waitProgress waits until the saver has written progress matching the check
+func waitProgress(t *testing.T, storage StateStorage, check func(progress []Progress) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress, err := storage.LoadProgress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(progress) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Progress has not been saved, stored %+v", progress)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProgressSurvivesRestart(t *testing.T) {
+	storages := NewMemoryStorages()
+	if err := storages.Quests.StoreQuest(*NewQuestRecord("q", newTestQuest(3, nil))); err != nil {
+		t.Fatal(err)
+	}
+	user := tgbotbase.UserID(1)
+	cfg := EngineConfig{ProgressDelay: time.Millisecond}
+	engine := NewQuestEngine(cfg, storages, &eventRecorder{})
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	engine.CheckAnswer(user, "wrong")
+	answer, _ := currentAnswer(engine, user)
+	engine.CheckAnswer(user, answer)
+	before, err := engine.GetStatus(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitProgress(t, storages.State, func(progress []Progress) bool {
+		return len(progress) == 1 && progress[0].StageIx == 1 && progress[0].Mistakes == 1
+	})
+
+	// no Flush: the engine is gone as if the bot has crashed
+	restarted := NewQuestEngine(cfg, storages, &eventRecorder{})
+	after, err := restarted.GetStatus(user)
+	if err != nil {
+		t.Fatalf("Progress has not been restored: %v", err)
+	}
+	if after.StageID != before.StageID || after.Stage != 2 || after.Mistakes != 1 {
+		t.Errorf("Restored status %+v, want %+v", after, before)
+	}
+	if progress, _ := storages.State.LoadProgress(); len(progress) != 1 {
+		t.Errorf("%d progress entries are kept after restoring, want 1", len(progress))
+	}
+
+	for i := 0; i < 2; i++ {
+		answer, _ := currentAnswer(restarted, user)
+		restarted.CheckAnswer(user, answer)
+	}
+	waitProgress(t, storages.State, func(progress []Progress) bool {
+		return len(progress) == 0
+	})
+}
+
+func TestProgressOfUnpublishedQuest(t *testing.T) {
+	storages := NewMemoryStorages()
+	if err := storages.Quests.StoreQuest(*NewQuestRecord("q", newTestQuest(2, nil))); err != nil {
+		t.Fatal(err)
+	}
+	user := tgbotbase.UserID(1)
+	saved := []Progress{{UserID: user, QuestID: "q", Current: true, Started: time.Now(), StageIx: 1, StageOrder: []string{"s1", "s2"}}}
+	if err := storages.State.StoreProgress(map[tgbotbase.UserID][]Progress{user: saved}); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewQuestEngine(EngineConfig{}, storages, &eventRecorder{})
+	status, err := engine.GetStatus(user)
+	if err != nil || status.StageID != "s2" {
+		t.Errorf("Progress of version 0 restored as %+v, %v, want stage s2", status, err)
+	}
+}
@@ -3,19 +3,51 @@ package quest
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
+	"time"
 )
 
+type StageType string
+
+const (
+	// StageText is checked against the list of known answers
+	StageText StageType = "text"
+	// StageModerated has no single right answer - it is judged by organizers
+	StageModerated StageType = "moderated"
+	// StageChoice offers a fixed set of options, answers are the correct ones
+	StageChoice StageType = "choice"
+)
+
+func ParseStageType(s string) (StageType, error) {
+	switch t := StageType(s); t {
+	case StageText, StageModerated, StageChoice:
+		return t, nil
+	case "":
+		return StageText, nil
+	}
+	return "", fmt.Errorf("Unknown stage type '%s'", s)
+}
+
 type Stage struct {
 	question string
 	answers  map[string]bool
 	pic      []byte
+	// picRef refers to the picture in a BlobStore, it is loaded only when the stage is shown
+	picRef string
+	// picID is a Telegram file_id of a picture uploaded through the bot
+	picID     string
+	stageType StageType
+
+	options        []string
+	shuffleOptions bool
 }
 
 func NewStage(question string, answers []string) Stage {
 	s := Stage{
-		question: question,
-		answers:  make(map[string]bool, len(answers))}
+		question:  question,
+		answers:   make(map[string]bool, len(answers)),
+		stageType: StageText}
 	for _, a := range answers {
 		s.answers[strings.ToLower(a)] = true
 	}
@@ -26,12 +58,125 @@ func (s *Stage) AddPicture(pic []byte) {
 	s.pic = pic
 }
 
+// SetPictureRef attaches a picture kept in a BlobStore
+func (s *Stage) SetPictureRef(ref string) {
+	s.picRef = ref
+}
+
+// SetPictureID attaches a picture already uploaded to Telegram
+func (s *Stage) SetPictureID(fileID string) {
+	s.picID = fileID
+}
+
+func (s Stage) Question() string {
+	return s.question
+}
+
+func (s Stage) Answers() []string {
+	answers := make([]string, 0, len(s.answers))
+	for a := range s.answers {
+		answers = append(answers, a)
+	}
+	sort.Strings(answers)
+	return answers
+}
+
+func (s Stage) Picture() []byte {
+	return s.pic
+}
+
+func (s Stage) PictureRef() string {
+	return s.picRef
+}
+
+func (s Stage) PictureID() string {
+	return s.picID
+}
+
+func (s Stage) Type() StageType {
+	return s.stageType
+}
+
+func (s Stage) Options() []string {
+	return s.options
+}
+
+func (s Stage) ShuffleOptions() bool {
+	return s.shuffleOptions
+}
+
+func (s *Stage) SetType(t StageType) {
+	s.stageType = t
+}
+
+// SetOptions turns the stage into a multiple-choice one
+func (s *Stage) SetOptions(options []string, shuffle bool) {
+	s.stageType = StageChoice
+	s.options = options
+	s.shuffleOptions = shuffle
+}
+
+type Visibility string
+
+const (
+	// VisibilityPublic quests are listed in the catalog
+	VisibilityPublic Visibility = "public"
+	// VisibilityHidden quests can be started only by their ID
+	VisibilityHidden Visibility = "hidden"
+	// VisibilityInvite quests can be started only with an invite
+	VisibilityInvite Visibility = "invite"
+)
+
+func ParseVisibility(s string) (Visibility, error) {
+	switch v := Visibility(s); v {
+	case VisibilityPublic, VisibilityHidden, VisibilityInvite:
+		return v, nil
+	case "":
+		return VisibilityHidden, nil
+	}
+	return "", fmt.Errorf("Unknown visibility '%s'", s)
+}
+
+// QuestInfo is a description of a quest shown to players
+type QuestInfo struct {
+	Title       string
+	Description string
+	Difficulty  string
+	Visibility  Visibility
+
+	// AllowSkip lets players skip a stage, SkipPenalty is added to their time
+	AllowSkip   bool
+	SkipPenalty time.Duration
+
+	// Ranking defines which attempt counts when a player replays the quest
+	Ranking RankingPolicy
+	// RateLimit protects stages from brute-forcing the answers
+	RateLimit RateLimit
+}
+
 type Quest struct {
 	stages map[string]Stage
+	info   QuestInfo
+	// version is a number of the published version, zero for drafts
+	version int
 }
 
 func NewQuest() Quest {
-	return Quest{stages: make(map[string]Stage, 0)}
+	return Quest{
+		stages: make(map[string]Stage, 0),
+		info:   QuestInfo{Visibility: VisibilityHidden, Ranking: RankFirst}}
+}
+
+func (q *Quest) SetInfo(info QuestInfo) {
+	q.info = info
+}
+
+func (q Quest) Info() QuestInfo {
+	return q.info
+}
+
+func (q Quest) Version() int {
+	return q.version
 }
 
 func (q *Quest) AddStage(stageID string, stage Stage) {
@@ -44,6 +189,11 @@ func (q *Quest) AddStage(stageID string, stage Stage) {
 type State struct {
 	stageIx    int
 	stageOrder []string
+
+	// optionOrder keeps per-player order of options for shuffled choice stages
+	optionOrder map[string][]int
+	// wrongChoices are options of the current stage which have been already tried
+	wrongChoices []int
 }
 
 func (s State) IsFinished() bool {
@@ -57,6 +207,7 @@ func (s State) GetStageID() string {
 func (s State) Next() *State {
 	s2 := s
 	s2.stageIx++
+	s2.wrongChoices = nil
 	return &s2
 }
 
@@ -78,9 +229,17 @@ func (q Quest) CreateInitialState() State {
 	rand.Shuffle(len(order), func(i, j int) {
 		order[i], order[j] = order[j], order[i]
 	})
+	optionOrder := make(map[string][]int, 0)
+	for id, stage := range q.stages {
+		if stage.stageType != StageChoice || !stage.shuffleOptions {
+			continue
+		}
+		optionOrder[id] = rand.Perm(len(stage.options))
+	}
 	return State{
-		stageIx:    0,
-		stageOrder: order}
+		stageIx:     0,
+		stageOrder:  order,
+		optionOrder: optionOrder}
 }
 
 func (q Quest) GetQuestion(state State) string {
@@ -90,3 +249,72 @@ func (q Quest) GetQuestion(state State) string {
 func (q Quest) GetPicture(state State) []byte {
 	return q.stages[state.GetStageID()].pic
 }
+
+func (q Quest) GetPictureRef(state State) string {
+	return q.stages[state.GetStageID()].picRef
+}
+
+func (q Quest) GetPictureID(state State) string {
+	return q.stages[state.GetStageID()].picID
+}
+
+// Stage returns the stage by its ID
+func (q Quest) Stage(stageID string) (Stage, bool) {
+	stage, found := q.stages[stageID]
+	return stage, found
+}
+
+// StageIDs returns IDs of all stages in alphabetical order
+func (q Quest) StageIDs() []string {
+	ids := make([]string, 0, len(q.stages))
+	for id := range q.stages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (q Quest) IsModerated(state State) bool {
+	return q.stages[state.GetStageID()].stageType == StageModerated
+}
+
+// GetOptions returns options of the current choice stage in the order shown to the player
+func (q Quest) GetOptions(state State) []string {
+	stageID := state.GetStageID()
+	stage := q.stages[stageID]
+	if stage.stageType != StageChoice {
+		return nil
+	}
+	order, found := state.optionOrder[stageID]
+	if !found {
+		return stage.options
+	}
+	options := make([]string, 0, len(order))
+	for _, ix := range order {
+		options = append(options, stage.options[ix])
+	}
+	return options
+}
+
+// MarkWrongChoice remembers that the answer (if it is one of the options) has been tried
+func (q Quest) MarkWrongChoice(answer string, state State) State {
+	answer = strings.ToLower(answer)
+	for ix, opt := range q.GetOptions(state) {
+		if strings.ToLower(opt) != answer || state.isWrongChoice(ix) {
+			continue
+		}
+		wrong := make([]int, 0, len(state.wrongChoices)+1)
+		state.wrongChoices = append(append(wrong, state.wrongChoices...), ix)
+		break
+	}
+	return state
+}
+
+func (s State) isWrongChoice(ix int) bool {
+	for _, wrong := range s.wrongChoices {
+		if wrong == ix {
+			return true
+		}
+	}
+	return false
+}
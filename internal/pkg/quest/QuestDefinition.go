@@ -0,0 +1,111 @@
+package quest
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// questDefinition is a self-contained JSON form of a quest used for snapshots and files
+type questDefinition struct {
+	Info   infoDefinition             `json:"info"`
+	Stages map[string]stageDefinition `json:"stages"`
+}
+
+type infoDefinition struct {
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Difficulty  string        `json:"difficulty,omitempty"`
+	Visibility  Visibility    `json:"visibility,omitempty"`
+	AllowSkip   bool          `json:"skip,omitempty"`
+	SkipPenalty string        `json:"skip_penalty,omitempty"`
+	Ranking     RankingPolicy `json:"ranking,omitempty"`
+	RateLimit   string        `json:"rate_limit,omitempty"`
+}
+
+type stageDefinition struct {
+	Question   string    `json:"question"`
+	Type       StageType `json:"type,omitempty"`
+	Answers    []string  `json:"answers,omitempty"`
+	Options    []string  `json:"options,omitempty"`
+	Shuffle    bool      `json:"shuffle,omitempty"`
+	Picture    []byte    `json:"picture,omitempty"`
+	PictureRef string    `json:"picture_ref,omitempty"`
+	PictureID  string    `json:"picture_id,omitempty"`
+}
+
+func (q Quest) MarshalJSON() ([]byte, error) {
+	def := questDefinition{
+		Info: infoDefinition{
+			Title:       q.info.Title,
+			Description: q.info.Description,
+			Difficulty:  q.info.Difficulty,
+			Visibility:  q.info.Visibility,
+			AllowSkip:   q.info.AllowSkip,
+			Ranking:     q.info.Ranking,
+			RateLimit:   q.info.RateLimit.String()},
+		Stages: make(map[string]stageDefinition, len(q.stages))}
+	if q.info.AllowSkip {
+		def.Info.SkipPenalty = q.info.SkipPenalty.String()
+	}
+	for id, stage := range q.stages {
+		def.Stages[id] = stageDefinition{
+			Question:   stage.question,
+			Type:       stage.stageType,
+			Answers:    stage.Answers(),
+			Options:    stage.options,
+			Shuffle:    stage.shuffleOptions,
+			Picture:    stage.pic,
+			PictureRef: stage.picRef,
+			PictureID:  stage.picID}
+	}
+	return json.Marshal(def)
+}
+
+func (q *Quest) UnmarshalJSON(data []byte) error {
+	var def questDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+
+	info := QuestInfo{
+		Title:       def.Info.Title,
+		Description: def.Info.Description,
+		Difficulty:  def.Info.Difficulty,
+		AllowSkip:   def.Info.AllowSkip}
+	var err error
+	if info.Visibility, err = ParseVisibility(string(def.Info.Visibility)); err != nil {
+		return err
+	}
+	if info.Ranking, err = ParseRankingPolicy(string(def.Info.Ranking)); err != nil {
+		return err
+	}
+	if info.RateLimit, err = ParseRateLimit(def.Info.RateLimit); err != nil {
+		return err
+	}
+	if def.Info.SkipPenalty != "" {
+		if info.SkipPenalty, err = time.ParseDuration(def.Info.SkipPenalty); err != nil {
+			return err
+		}
+	}
+
+	res := NewQuest()
+	res.SetInfo(info)
+	for id, sd := range def.Stages {
+		stageType, err := ParseStageType(string(sd.Type))
+		if err != nil {
+			return fmt.Errorf("Stage '%s': %s", id, err)
+		}
+		stage := NewStage(sd.Question, sd.Answers)
+		stage.SetType(stageType)
+		if stageType == StageChoice {
+			stage.SetOptions(sd.Options, sd.Shuffle)
+		}
+		stage.AddPicture(sd.Picture)
+		stage.SetPictureRef(sd.PictureRef)
+		stage.SetPictureID(sd.PictureID)
+		res.stages[id] = stage
+	}
+	*q = res
+	return nil
+}
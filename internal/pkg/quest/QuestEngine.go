@@ -6,6 +6,7 @@ import (
 	"github.com/admirallarimda/tgbotbase"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/telegram-bot-api.v4"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,132 +15,1026 @@ type AnswerResult struct {
 	Active   bool
 	Correct  bool
 	Finished bool
+	// Pending is set when the answer of a moderated stage waits for organizers' decision
+	Pending bool
+	// Submission is set only when the answer has just been sent to moderation
+	Submission *Submission
+	// Cooldown is set when answers are not accepted due to too many wrong ones
+	Cooldown time.Duration
+}
+
+// QuestSummary is an entry of the quest catalog
+type QuestSummary struct {
+	ID   string
+	Info QuestInfo
+}
+
+// Title returns the title of the quest falling back to its ID
+func (s QuestSummary) Title() string {
+	if s.Info.Title == "" {
+		return s.ID
+	}
+	return s.Info.Title
 }
 
 type QuestEngine interface {
+	// ListQuests returns public quests ordered by their titles
+	ListQuests() []QuestSummary
+	GetQuestInfo(questID string) (QuestInfo, bool)
 	StartQuest(userID tgbotbase.UserID, questID string) error
+	// StartQuestByInvite redeems the invite code and starts the quest it points to
+	StartQuestByInvite(userID tgbotbase.UserID, code string) (questID string, err error)
+	// CreateInvite makes an invite for maxUses players (0 - unlimited) which expires after ttl (0 - never)
+	CreateInvite(questID, team string, maxUses int64, ttl time.Duration) (Invite, error)
+	// RestartQuest drops the progress of an active quest and starts it as a new attempt
+	RestartQuest(userID tgbotbase.UserID, questID string) error
+	// SwitchQuest makes another active quest the current one
+	SwitchQuest(userID tgbotbase.UserID, questID string) error
+	ListActiveQuests(userID tgbotbase.UserID) []QuestStatus
 	CheckAnswer(userID tgbotbase.UserID, answer string) AnswerResult
 	GetCurrentQuestion(userID tgbotbase.UserID) tgbotapi.Chattable
 	AddQuest(questID string, quest Quest)
+
+	// PublishQuest makes the draft of the quest a new live version, players in progress keep their version;
+	// drafts with validation errors are not published, issues are returned in any case
+	PublishQuest(questID string) (QuestVersion, []Issue, error)
+	// RollbackQuest makes a previously published version live again
+	RollbackQuest(questID string, number int) (QuestVersion, error)
+	// ListVersions returns published versions of the quest and the number of the live one
+	ListVersions(questID string) ([]QuestVersion, int, error)
+	// Validation returns the report of checking quests on load
+	Validation() ValidationReport
+
+	// CheckChoice checks the option of a pressed button, false is returned if the button is not of the current stage
+	// of the current attempt
+	CheckChoice(userID tgbotbase.UserID, choice ChoiceData) (AnswerResult, bool)
+	// GetCurrentKeyboard returns buttons of the current choice stage (nil for other stages)
+	GetCurrentKeyboard(userID tgbotbase.UserID) *tgbotapi.InlineKeyboardMarkup
+
+	GetStatus(userID tgbotbase.UserID) (QuestStatus, error)
+	// SkipStage moves the player to the next stage if the quest allows it
+	SkipStage(userID tgbotbase.UserID) (AnswerResult, error)
+	QuitQuest(userID tgbotbase.UserID) error
+
+	PendingSubmissions() []Submission
+	// ResolveSubmission applies the decision, ErrSubmissionResolved is returned if the submission has been already resolved
+	// and ErrNotAuthorized if the decision does not authorize the moderator
+	ResolveSubmission(id string, decision Decision) (Submission, AnswerResult, error)
+	// Resolution returns the decision taken on a recently resolved submission
+	Resolution(id string) (Resolution, bool)
+
+	// Flush saves progress of all players to the state storage and returns the number of saved quests,
+	// progress is saved shortly after every change too, so Flush writes the last changes and repeats failed saves;
+	// it returns once events of finished calls have been handed to the publisher
+	Flush() (int, error)
+	// ActivePlayers returns the number of users who have at least one quest in progress
+	ActivePlayers() int
 }
 
 type activeUserQuest struct {
 	questID string
+	team    string
 	quest   Quest
 	state   State
+
+	started  time.Time
+	mistakes int
+	skipped  int
+
+	// version is changed on every update of the state
+	version uint64
+}
+
+// userQuests holds all quests a user plays at the same time, answers go to the current one
+type userQuests struct {
+	current string
+	quests  map[string]activeUserQuest
+}
+
+// QuestStatus describes the progress of a player in the active quest
+type QuestStatus struct {
+	QuestID     string
+	Title       string
+	StageID     string
+	Team        string
+	Stage       int
+	StagesTotal int
+	Started     time.Time
+	Mistakes    int
+	Skipped     int
+	AllowSkip   bool
+	SkipPenalty time.Duration
+}
+
+var (
+	ErrNoActiveQuest  = errors.New("No active quest")
+	ErrSkipNotAllowed = errors.New("Skipping stages is not allowed in the quest")
+	// ErrQuestActive is returned on start of a quest which is in progress, RestartQuest should be used
+	ErrQuestActive = errors.New("Quest is already in progress")
+	// ErrSubmissionResolved is returned when another moderator has already resolved the submission
+	ErrSubmissionResolved = errors.New("Submission has been already resolved")
+	// ErrNotAuthorized is returned when the moderator is not allowed to resolve the submission
+	ErrNotAuthorized = errors.New("Moderator is not allowed to resolve the submission")
+)
+
+// defaultBlobCacheSize limits memory taken by pictures loaded from the blob store
+const defaultBlobCacheSize = 64 * 1024 * 1024
+
+// EngineConfig holds settings which apply to all quests
+type EngineConfig struct {
+	// DefaultRateLimit protects stages of quests which have no rate limit of their own
+	DefaultRateLimit RateLimit
+	// BlobCacheSize is a limit of memory for pictures in bytes, 64MB if zero
+	BlobCacheSize int
+	// ProgressDelay is how long changed progress waits to be saved together with other changes, a second if zero
+	ProgressDelay time.Duration
 }
 
 type questEngine struct {
 	quests map[string]Quest
 
-	activeQuests map[tgbotbase.UserID]activeUserQuest
-	mutex        sync.Mutex
+	activeQuests map[tgbotbase.UserID]*userQuests
+	pending      map[string]Submission
+	resolved     map[string]Resolution
+	limiters     map[limiterKey]*stageLimiter
+	userLocks    map[tgbotbase.UserID]*userLock
+	// dirty users have changed their progress under the mutex, unlock passes it to the saver
+	dirty      map[tgbotbase.UserID]bool
+	saver      *progressSaver
+	versionSeq uint64
+	mutex      sync.Mutex
+	// limitersPruned is the time of the last removal of idle limiters
+	limitersPruned time.Time
+
+	// outbox collects events under the mutex, unlock passes them to the dispatcher keeping their order
+	outbox     []Event
+	dispatcher *eventDispatcher
 
-	resultMonitor ResultMonitor
+	cfg            EngineConfig
+	stateStorage   StateStorage
+	questStorage   QuestStorage
+	versionStorage VersionStorage
+	blobs          BlobStore
+
+	validation ValidationReport
 }
 
 var _ QuestEngine = &questEngine{}
 
-func NewQuestEngine(pool tgbotbase.RedisPool, resmon ResultMonitor) QuestEngine {
+// NewQuestEngine creates an engine on top of storages of any backend, see NewRedisStorages, NewFileStorages and NewMemoryStorages
+func NewQuestEngine(cfg EngineConfig, storages Storages, events EventPublisher) QuestEngine {
 	engine := &questEngine{
-		quests:        make(map[string]Quest, 0),
-		activeQuests:  make(map[tgbotbase.UserID]activeUserQuest, 0),
-		resultMonitor: resmon}
-	storage := NewRedisQuestStorage(pool)
-	quests, err := storage.LoadAll()
+		cfg:            cfg,
+		quests:         make(map[string]Quest, 0),
+		activeQuests:   make(map[tgbotbase.UserID]*userQuests, 0),
+		pending:        make(map[string]Submission, 0),
+		resolved:       make(map[string]Resolution, 0),
+		limiters:       make(map[limiterKey]*stageLimiter, 0),
+		userLocks:      make(map[tgbotbase.UserID]*userLock, 0),
+		dirty:          make(map[tgbotbase.UserID]bool, 0),
+		saver:          newProgressSaver(storages.State, cfg.ProgressDelay),
+		dispatcher:     newEventDispatcher(events),
+		stateStorage:   storages.State,
+		questStorage:   storages.Quests,
+		versionStorage: storages.Versions}
+	if storages.Blobs != nil {
+		cacheSize := cfg.BlobCacheSize
+		if cacheSize == 0 {
+			cacheSize = defaultBlobCacheSize
+		}
+		engine.blobs = NewCachedBlobStore(storages.Blobs, cacheSize)
+		engine.validation.Blobs = engine.blobs
+	}
+	if err := engine.loadQuests(); err != nil {
+		panic(err)
+	}
+	// progress is restored before submissions so that submissions find the stages they belong to
+	if err := engine.restoreProgress(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to restore progress of players, they start over")
+	}
+
+	subs, err := engine.stateStorage.LoadSubmissions()
 	if err != nil {
 		panic(err)
 	}
+	for _, sub := range subs {
+		engine.pending[sub.ID] = sub
+	}
+	log.WithFields(log.Fields{"submissions_n": len(subs)}).Info("Pending submissions loaded")
 
-	for _, rec := range quests {
-		log.WithFields(log.Fields{"quest": rec.questID, "stages_n": len(rec.quest.stages)}).Info("Quest loaded")
-		engine.quests[rec.questID] = rec.quest
+	cooldowns, err := engine.stateStorage.LoadCooldowns()
+	if err != nil {
+		panic(err)
+	}
+	for _, c := range cooldowns {
+		engine.limiters[limiterKey{c.UserID, c.QuestID, c.StageID}] = &stageLimiter{until: c.Until}
 	}
+	log.WithFields(log.Fields{"cooldowns_n": len(cooldowns)}).Info("Active cooldowns loaded")
 	return engine
 }
 
+// loadQuests loads live versions of quests, drafts which have never been published are published as is
+// so that quests created before versioning stay playable; quests with validation errors are not loaded
+func (q *questEngine) loadQuests() error {
+	versions, failures, err := q.versionStorage.LoadCurrentVersions()
+	if err != nil {
+		return err
+	}
+	q.validation.Failures = append(q.validation.Failures, failures...)
+	published := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		published[v.QuestID] = true
+		logger := log.WithFields(log.Fields{"quest": v.QuestID, "version": v.Number, "stages_n": len(v.Quest.stages)})
+		if HasErrors(q.validation.Add(v.QuestID, v.Quest)) {
+			logger.Error("Quest has validation errors, skipping")
+			continue
+		}
+		logger.Info("Quest loaded")
+		q.quests[v.QuestID] = v.Quest
+	}
+
+	drafts, failures, err := q.questStorage.LoadAll()
+	if err != nil {
+		return err
+	}
+	for _, f := range failures {
+		if !published[f.QuestID] {
+			q.validation.Failures = append(q.validation.Failures, f)
+		}
+	}
+	for _, rec := range drafts {
+		if published[rec.questID] {
+			continue
+		}
+		if len(rec.quest.stages) == 0 {
+			log.WithFields(log.Fields{"quest": rec.questID}).Info("Quest has no stages yet, skipping")
+			continue
+		}
+		if HasErrors(q.validation.Add(rec.questID, rec.quest)) {
+			log.WithFields(log.Fields{"quest": rec.questID}).Error("Unpublished quest has validation errors, skipping")
+			continue
+		}
+		v, err := q.versionStorage.PublishVersion(rec.questID, rec.quest)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"quest": rec.questID, "version": v.Number, "stages_n": len(v.Quest.stages)}).Info("Unpublished quest has been published on load")
+		q.quests[rec.questID] = v.Quest
+	}
+	return nil
+}
+
+func (q *questEngine) PublishQuest(questID string) (QuestVersion, []Issue, error) {
+	draft, err := q.questStorage.LoadQuest(questID)
+	if err != nil {
+		return QuestVersion{}, nil, err
+	}
+	issues := ValidateQuest(questID, *draft)
+	if q.blobs != nil {
+		issues = append(issues, ValidatePictures(questID, *draft, q.blobs)...)
+	}
+	if HasErrors(issues) {
+		return QuestVersion{}, issues, fmt.Errorf("Quest '%s' has validation errors", questID)
+	}
+	v, err := q.versionStorage.PublishVersion(questID, *draft)
+	if err != nil {
+		return QuestVersion{}, issues, err
+	}
+	q.AddQuest(questID, v.Quest)
+	log.WithFields(log.Fields{"quest": questID, "version": v.Number, "issues_n": len(issues)}).Info("Quest has been published")
+	return v, issues, nil
+}
+
+func (q *questEngine) Validation() ValidationReport {
+	return q.validation
+}
+
+func (q *questEngine) RollbackQuest(questID string, number int) (QuestVersion, error) {
+	v, err := q.versionStorage.LoadVersion(questID, number)
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	if err := q.versionStorage.SetCurrentVersion(questID, number); err != nil {
+		return QuestVersion{}, err
+	}
+	q.AddQuest(questID, v.Quest)
+	log.WithFields(log.Fields{"quest": questID, "version": number}).Info("Quest has been rolled back")
+	return *v, nil
+}
+
+func (q *questEngine) ListVersions(questID string) ([]QuestVersion, int, error) {
+	return q.versionStorage.ListVersions(questID)
+}
+
+func (q *questEngine) ListQuests() []QuestSummary {
+	q.mutex.Lock()
+	defer q.unlock()
+	list := make([]QuestSummary, 0, len(q.quests))
+	for id, quest := range q.quests {
+		if quest.info.Visibility != VisibilityPublic {
+			continue
+		}
+		list = append(list, QuestSummary{ID: id, Info: quest.info})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Title() < list[j].Title()
+	})
+	return list
+}
+
+func (q *questEngine) ActivePlayers() int {
+	q.mutex.Lock()
+	defer q.unlock()
+	return len(q.activeQuests)
+}
+
+func (q *questEngine) GetQuestInfo(questID string) (QuestInfo, bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+	quest, found := q.quests[questID]
+	return quest.info, found
+}
+
 func (q *questEngine) StartQuest(userID tgbotbase.UserID, questID string) error {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	defer q.unlock()
+	quest, found := q.quests[questID]
+	if !found {
+		return errors.New(fmt.Sprintf("Quest '%s' is not registered", questID))
+	}
+	if _, active := q.getActive(userID, questID); active {
+		return ErrQuestActive
+	}
+	if quest.info.Visibility == VisibilityInvite {
+		return ErrInviteRequired
+	}
+	q.startQuest(userID, questID, quest, "")
+	return nil
+}
+
+func (q *questEngine) RestartQuest(userID tgbotbase.UserID, questID string) error {
+	q.mutex.Lock()
+	defer q.unlock()
+	questData, found := q.getActive(userID, questID)
+	if !found {
+		return ErrNoActiveQuest
+	}
 	quest, found := q.quests[questID]
 	if !found {
 		return errors.New(fmt.Sprintf("Quest '%s' is not registered", questID))
 	}
+	log.WithFields(log.Fields{"user": userID, "quest": questID}).Debug("Quest restarted")
+	q.dropSubmissions(userID, questID, "")
+	q.dropLimiters(userID, questID, time.Now())
+	q.startQuest(userID, questID, quest, questData.team)
+	return nil
+}
+
+func (q *questEngine) SwitchQuest(userID tgbotbase.UserID, questID string) error {
+	q.mutex.Lock()
+	defer q.unlock()
+	if _, found := q.getActive(userID, questID); !found {
+		return ErrNoActiveQuest
+	}
+	q.activeQuests[userID].current = questID
+	q.dirty[userID] = true
+	return nil
+}
+
+func (q *questEngine) ListActiveQuests(userID tgbotbase.UserID) []QuestStatus {
+	q.mutex.Lock()
+	defer q.unlock()
+	uq, found := q.activeQuests[userID]
+	if !found {
+		return nil
+	}
+	list := make([]QuestStatus, 0, len(uq.quests))
+	for _, questData := range uq.quests {
+		list = append(list, questData.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+func (q *questEngine) StartQuestByInvite(userID tgbotbase.UserID, code string) (string, error) {
+	logger := log.WithFields(log.Fields{"user": userID, "invite": code})
+	inv, err := q.stateStorage.LoadInvite(code)
+	if err != nil {
+		logger.WithField("error", err).Debug("Unable to load invite")
+		return "", err
+	}
+	// expired invites are kept for a while, UseInvite checks the expiration again under the mutex
+	if inv.isExpired(time.Now()) {
+		return inv.QuestID, ErrInviteExpired
+	}
+
+	q.mutex.Lock()
+	defer q.unlock()
+	quest, found := q.quests[inv.QuestID]
+	if !found {
+		return inv.QuestID, errors.New(fmt.Sprintf("Quest '%s' is not registered", inv.QuestID))
+	}
+	if _, active := q.getActive(userID, inv.QuestID); active {
+		return inv.QuestID, ErrQuestActive
+	}
+	if err := q.stateStorage.UseInvite(code, userID); err != nil {
+		logger.WithField("error", err).Debug("Unable to use invite")
+		return inv.QuestID, err
+	}
+	logger.WithFields(log.Fields{"quest": inv.QuestID, "team": inv.Team}).Info("Invite used")
+	q.startQuest(userID, inv.QuestID, quest, inv.Team)
+	return inv.QuestID, nil
+}
 
-	q.activeQuests[userID] = activeUserQuest{
+func (q *questEngine) startQuest(userID tgbotbase.UserID, questID string, quest Quest, team string) {
+	now := time.Now()
+	q.storeActive(userID, activeUserQuest{
 		questID: questID,
+		team:    team,
 		quest:   quest,
-		state:   quest.CreateInitialState()}
-	q.resultMonitor.QuestStarted(questID, userID, time.Now())
+		state:   quest.CreateInitialState(),
+		started: now})
+	q.activeQuests[userID].current = questID
+	q.publish(Event{Type: EventStarted, QuestID: questID, UserID: userID, Time: now, Version: quest.version})
+}
 
-	return nil
+// getCurrent, getActive, storeActive and removeActive must be called under the mutex
+func (q *questEngine) getCurrent(userID tgbotbase.UserID) (activeUserQuest, bool) {
+	uq, found := q.activeQuests[userID]
+	if !found {
+		return activeUserQuest{}, false
+	}
+	questData, found := uq.quests[uq.current]
+	return questData, found
 }
 
-func (q *questEngine) CheckAnswer(userID tgbotbase.UserID, answer string) AnswerResult {
+func (q *questEngine) getActive(userID tgbotbase.UserID, questID string) (activeUserQuest, bool) {
+	uq, found := q.activeQuests[userID]
+	if !found {
+		return activeUserQuest{}, false
+	}
+	questData, found := uq.quests[questID]
+	return questData, found
+}
+
+// storeActive assigns a new version to the stored state
+func (q *questEngine) storeActive(userID tgbotbase.UserID, questData activeUserQuest) {
+	q.dirty[userID] = true
+	q.versionSeq++
+	questData.version = q.versionSeq
+	uq, found := q.activeQuests[userID]
+	if !found {
+		uq = &userQuests{
+			current: questData.questID,
+			quests:  make(map[string]activeUserQuest, 1)}
+		q.activeQuests[userID] = uq
+	}
+	uq.quests[questData.questID] = questData
+}
+
+// removeActive makes the most recently started of remaining quests the current one
+// and forgets limiters of the quest which are not in cooldown
+func (q *questEngine) removeActive(userID tgbotbase.UserID, questID string) {
+	uq, found := q.activeQuests[userID]
+	if !found {
+		return
+	}
+	q.dirty[userID] = true
+	q.dropLimiters(userID, questID, time.Now())
+	delete(uq.quests, questID)
+	if len(uq.quests) == 0 {
+		delete(q.activeQuests, userID)
+		return
+	}
+	if uq.current != questID {
+		return
+	}
+	var latest time.Time
+	for id, questData := range uq.quests {
+		if questData.started.After(latest) {
+			latest = questData.started
+			uq.current = id
+		}
+	}
+}
+
+func (q *questEngine) CreateInvite(questID, team string, maxUses int64, ttl time.Duration) (Invite, error) {
+	if maxUses < 0 || ttl < 0 {
+		return Invite{}, fmt.Errorf("Invite cannot have %d uses and lifetime %s", maxUses, ttl)
+	}
 	q.mutex.Lock()
-	questData, found := q.activeQuests[userID]
-	q.mutex.Unlock()
+	_, found := q.quests[questID]
+	q.unlock()
 	if !found {
-		log.WithFields(log.Fields{"user": userID}).Warn("Active quest not found on checking answer")
-		return AnswerResult{
-			Active:   false,
-			Correct:  false,
-			Finished: false}
+		return Invite{}, errors.New(fmt.Sprintf("Quest '%s' is not registered", questID))
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return Invite{}, err
+	}
+	inv := Invite{
+		Code:    code,
+		QuestID: questID,
+		Team:    team,
+		MaxUses: maxUses}
+	if ttl > 0 {
+		inv.Expires = time.Now().Add(ttl)
+	}
+	if err := q.stateStorage.StoreInvite(inv); err != nil {
+		return Invite{}, err
+	}
+	log.WithFields(log.Fields{"quest": questID, "invite": code, "team": team, "max_uses": maxUses, "expires": inv.Expires}).Info("Invite created")
+	return inv, nil
+}
+
+func (q *questEngine) CheckAnswer(userID tgbotbase.UserID, answer string) AnswerResult {
+	res, _ := q.checkAnswer(userID, func(activeUserQuest) (string, bool) {
+		return answer, true
+	})
+	return res
+}
+
+func (q *questEngine) CheckChoice(userID tgbotbase.UserID, choice ChoiceData) (AnswerResult, bool) {
+	return q.checkAnswer(userID, func(questData activeUserQuest) (string, bool) {
+		if questData.questID != choice.QuestID || questData.state.stageIx != choice.StageIx ||
+			choiceAttempt(questData.started) != choice.Attempt {
+			return "", false
+		}
+		options := questData.quest.GetOptions(questData.state)
+		if choice.OptionIx < 0 || choice.OptionIx >= len(options) {
+			return "", false
+		}
+		return options[choice.OptionIx], true
+	})
+}
+
+// checkAnswer serializes answers of the same user, the answer is evaluated against a snapshot of the state
+// which is written back only if nobody has changed the state in the meantime, otherwise the check is repeated.
+// answerOf extracts the answer from the snapshot, false means that the answer does not fit the current stage
+func (q *questEngine) checkAnswer(userID tgbotbase.UserID, answerOf func(activeUserQuest) (string, bool)) (AnswerResult, bool) {
+	defer q.lockUser(userID)()
+	for {
+		q.mutex.Lock()
+		questData, found := q.getCurrent(userID)
+		var cooldown time.Duration
+		if found {
+			cooldown = q.cooldownLeft(limiterKey{userID, questData.questID, questData.state.GetStageID()}, time.Now())
+		}
+		q.unlock()
+		if !found {
+			log.WithFields(log.Fields{"user": userID}).Warn("Active quest not found on checking answer")
+			return AnswerResult{
+				Active:   false,
+				Correct:  false,
+				Finished: false}, false
+		}
+
+		answer, ok := answerOf(questData)
+		if !ok {
+			return AnswerResult{Active: true}, false
+		}
+
+		if cooldown > 0 {
+			log.WithFields(log.Fields{"user": userID, "answer": answer, "cooldown": cooldown}).Debug("Answer during cooldown")
+			return AnswerResult{Active: true, Cooldown: cooldown}, true
+		}
+
+		var newState *State
+		moderated := questData.quest.IsModerated(questData.state)
+		if !moderated {
+			newState = questData.quest.CheckAnswer(answer, questData.state)
+		}
+
+		q.mutex.Lock()
+		if !q.isLatest(userID, questData) {
+			q.unlock()
+			log.WithFields(log.Fields{"user": userID, "answer": answer}).Debug("State has changed during answer check, repeating")
+			continue
+		}
+		var res AnswerResult
+		if moderated {
+			res = q.submitAnswer(userID, questData, answer)
+		} else {
+			res = q.applyAnswer(userID, questData, answer, newState)
+		}
+		q.unlock()
+		return res, true
 	}
+}
 
-	newState := questData.quest.CheckAnswer(answer, questData.state)
+// applyAnswer must be called under the mutex
+func (q *questEngine) applyAnswer(userID tgbotbase.UserID, questData activeUserQuest, answer string, newState *State) AnswerResult {
+	now := time.Now()
 	if newState == nil {
 		log.WithFields(log.Fields{"user": userID, "answer": answer}).Debug("Incorrect answer")
-		q.resultMonitor.QuestionAnsweredIncorrectly(questData.questID, userID, time.Now())
+		questData.state = questData.quest.MarkWrongChoice(answer, questData.state)
+		questData.mistakes++
+		q.storeActive(userID, questData)
+		q.publish(Event{Type: EventAnsweredIncorrectly, QuestID: questData.questID, UserID: userID, Time: now})
+		cooldown := q.registerWrongAnswer(userID, questData, now)
 		return AnswerResult{
 			Active:   true,
 			Correct:  false,
-			Finished: false}
+			Finished: false,
+			Cooldown: cooldown}
 	}
 
 	log.WithFields(log.Fields{"user": userID, "answer": answer}).Debug("Correct answer")
-	q.resultMonitor.QuestionAnsweredCorrectly(questData.questID, userID, time.Now())
+	q.publish(Event{Type: EventAnsweredCorrectly, QuestID: questData.questID, UserID: userID, Time: now})
 	finished := false
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
 	if newState.IsFinished() {
 		finished = true
-		q.resultMonitor.QuestFinished(questData.questID, userID, time.Now())
-		delete(q.activeQuests, userID)
+		q.publish(questData.finishedEvent(userID, now))
+		q.removeActive(userID, questData.questID)
 	} else {
-		q.activeQuests[userID] = activeUserQuest{
-			questID: questData.questID,
-			quest:   questData.quest,
-			state:   *newState}
+		questData.state = *newState
+		q.storeActive(userID, questData)
 	}
 	return AnswerResult{Active: true, Correct: true, Finished: finished}
+}
 
+// userLock is removed from userLocks when nobody holds or waits for it
+type userLock struct {
+	sync.Mutex
+	refs int
 }
 
-func (q *questEngine) GetCurrentQuestion(userID tgbotbase.UserID) tgbotapi.Chattable {
+// lockUser serializes answer processing of a single user, it returns the unlock function
+func (q *questEngine) lockUser(userID tgbotbase.UserID) func() {
 	q.mutex.Lock()
-	questData, found := q.activeQuests[userID]
+	l, found := q.userLocks[userID]
+	if !found {
+		l = &userLock{}
+		q.userLocks[userID] = l
+	}
+	l.refs++
+	q.unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		q.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(q.userLocks, userID)
+		}
+		q.unlock()
+	}
+}
+
+// publish must be called under the mutex, the event is published once the mutex is released by unlock
+func (q *questEngine) publish(e Event) {
+	q.outbox = append(q.outbox, e)
+}
+
+// unlock queues changed progress and events collected under the mutex and releases it;
+// progress is written by the saver and events are published by the dispatcher so that neither holds the engine
+func (q *questEngine) unlock() {
+	if len(q.dirty) > 0 {
+		q.saveProgress()
+	}
+	if len(q.outbox) > 0 {
+		q.dispatcher.add(q.outbox)
+		q.outbox = nil
+	}
 	q.mutex.Unlock()
+}
+
+// isLatest must be called under the mutex, it is the compare part of compare-and-swap of the user state
+func (q *questEngine) isLatest(userID tgbotbase.UserID, questData activeUserQuest) bool {
+	current, found := q.getCurrent(userID)
+	return found && current.questID == questData.questID && current.version == questData.version
+}
+
+// cooldownLeft must be called under the mutex
+func (q *questEngine) cooldownLeft(key limiterKey, t time.Time) time.Duration {
+	l, found := q.limiters[key]
+	if !found || !t.Before(l.until) {
+		return 0
+	}
+	return l.until.Sub(t)
+}
+
+// registerWrongAnswer must be called under the mutex, it returns the cooldown if the limit has been exceeded
+func (q *questEngine) registerWrongAnswer(userID tgbotbase.UserID, questData activeUserQuest, t time.Time) time.Duration {
+	limit := questData.quest.info.RateLimit
+	if !limit.Enabled() {
+		limit = q.cfg.DefaultRateLimit
+	}
+	if !limit.Enabled() {
+		return 0
+	}
+	key := limiterKey{userID, questData.questID, questData.state.GetStageID()}
+	l, found := q.limiters[key]
+	if !found {
+		q.pruneLimiters(t)
+		l = &stageLimiter{}
+		q.limiters[key] = l
+	}
+	if !l.addWrong(limit, t) {
+		return 0
+	}
+
+	log.WithFields(log.Fields{"user": userID, "quest": questData.questID, "stage": key.stageID, "until": l.until}).Warn("Too many wrong answers, cooldown started")
+	c := Cooldown{UserID: userID, QuestID: key.questID, StageID: key.stageID, Until: l.until}
+	if err := q.stateStorage.StoreCooldown(c); err != nil {
+		log.WithFields(log.Fields{"user": userID, "error": err}).Error("Unable to store cooldown")
+	}
+	q.publish(Event{Type: EventSuspicious, QuestID: questData.questID, UserID: userID, Time: t, WrongN: limit.MaxWrong, Cooldown: limit.Cooldown})
+	return limit.Cooldown
+}
+
+// limitersPruneInterval limits how often all limiters are checked for being idle
+const limitersPruneInterval = time.Minute
+
+// pruneLimiters must be called under the mutex, it forgets limiters without recent wrong answers and cooldown
+func (q *questEngine) pruneLimiters(t time.Time) {
+	if t.Sub(q.limitersPruned) < limitersPruneInterval {
+		return
+	}
+	q.limitersPruned = t
+	for key, l := range q.limiters {
+		if l.idle(t) {
+			delete(q.limiters, key)
+		}
+	}
+}
+
+// dropLimiters must be called under the mutex when the user leaves the quest,
+// limiters in cooldown are kept so that the cooldown cannot be escaped by restarting the quest
+func (q *questEngine) dropLimiters(userID tgbotbase.UserID, questID string, t time.Time) {
+	for key, l := range q.limiters {
+		if key.userID == userID && key.questID == questID && !t.Before(l.until) {
+			delete(q.limiters, key)
+		}
+	}
+}
+
+func (q *questEngine) GetCurrentQuestion(userID tgbotbase.UserID) tgbotapi.Chattable {
+	q.mutex.Lock()
+	questData, found := q.getCurrent(userID)
+	q.unlock()
 	if !found {
 		log.WithFields(log.Fields{"user": userID}).Warn("Active quest not found on getting current question")
 		return tgbotapi.NewMessage(int64(userID), "You do not have any active quest :(")
 	}
 
 	pic := questData.quest.GetPicture(questData.state)
+	if ref := questData.quest.GetPictureRef(questData.state); ref != "" && q.blobs != nil {
+		data, err := q.blobs.Get(ref)
+		if err != nil {
+			log.WithFields(log.Fields{"quest": questData.questID, "ref": ref, "error": err}).Error("Unable to load picture, the question is sent without it")
+		}
+		pic = data
+	}
 	text := questData.quest.GetQuestion(questData.state)
+	keyboard := choiceKeyboard(questData.questID, questData.started, questData.quest, questData.state)
+	if picID := questData.quest.GetPictureID(questData.state); picID != "" {
+		msg := tgbotapi.NewPhotoShare(int64(userID), picID)
+		msg.Caption = text
+		if keyboard != nil {
+			msg.ReplyMarkup = keyboard
+		}
+		return msg
+	}
 	if pic != nil {
 		buf := tgbotapi.FileBytes{
 			Name:  "TODO_put_some_name_here",
 			Bytes: pic}
 		msg := tgbotapi.NewPhotoUpload(int64(userID), buf)
 		msg.Caption = text
+		if keyboard != nil {
+			msg.ReplyMarkup = keyboard
+		}
 		return msg
 	}
-	return tgbotapi.NewMessage(int64(userID), text)
+	msg := tgbotapi.NewMessage(int64(userID), text)
+	if keyboard != nil {
+		msg.ReplyMarkup = keyboard
+	}
+	return msg
+}
+
+func (q *questEngine) GetCurrentKeyboard(userID tgbotbase.UserID) *tgbotapi.InlineKeyboardMarkup {
+	q.mutex.Lock()
+	defer q.unlock()
+	questData, found := q.getCurrent(userID)
+	if !found {
+		return nil
+	}
+	return choiceKeyboard(questData.questID, questData.started, questData.quest, questData.state)
 }
 
 func (q *questEngine) AddQuest(questID string, quest Quest) {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	defer q.unlock()
 	q.quests[questID] = quest
 }
+
+func (q *questEngine) GetStatus(userID tgbotbase.UserID) (QuestStatus, error) {
+	q.mutex.Lock()
+	defer q.unlock()
+	questData, found := q.getCurrent(userID)
+	if !found {
+		return QuestStatus{}, ErrNoActiveQuest
+	}
+	return questData.status(), nil
+}
+
+func (questData activeUserQuest) status() QuestStatus {
+	info := questData.quest.info
+	stageID := ""
+	if !questData.state.IsFinished() {
+		stageID = questData.state.GetStageID()
+	}
+	return QuestStatus{
+		QuestID:     questData.questID,
+		Title:       QuestSummary{ID: questData.questID, Info: info}.Title(),
+		StageID:     stageID,
+		Team:        questData.team,
+		Stage:       questData.state.stageIx + 1,
+		StagesTotal: len(questData.state.stageOrder),
+		Started:     questData.started,
+		Mistakes:    questData.mistakes,
+		Skipped:     questData.skipped,
+		AllowSkip:   info.AllowSkip,
+		SkipPenalty: info.SkipPenalty}
+}
+
+// finishedEvent sums up the attempt, skipped stages are added to the spent time with the penalty of the quest
+func (questData activeUserQuest) finishedEvent(userID tgbotbase.UserID, t time.Time) Event {
+	penalty := questData.quest.info.SkipPenalty * time.Duration(questData.skipped)
+	return Event{
+		Type:     EventFinished,
+		QuestID:  questData.questID,
+		UserID:   userID,
+		Time:     t,
+		Version:  questData.quest.version,
+		Spent:    t.Sub(questData.started) + penalty,
+		Mistakes: questData.mistakes,
+		Skipped:  questData.skipped}
+}
+
+func (q *questEngine) SkipStage(userID tgbotbase.UserID) (AnswerResult, error) {
+	q.mutex.Lock()
+	defer q.unlock()
+	questData, found := q.getCurrent(userID)
+	if !found {
+		return AnswerResult{}, ErrNoActiveQuest
+	}
+	if !questData.quest.info.AllowSkip {
+		return AnswerResult{Active: true}, ErrSkipNotAllowed
+	}
+
+	now := time.Now()
+	log.WithFields(log.Fields{"user": userID, "quest": questData.questID, "stage": questData.state.GetStageID()}).Debug("Stage skipped")
+	q.publish(Event{Type: EventSkipped, QuestID: questData.questID, UserID: userID, Time: now, Penalty: questData.quest.info.SkipPenalty})
+	q.dropSubmissions(userID, questData.questID, questData.state.GetStageID())
+	questData.skipped++
+	newState := questData.state.Next()
+	if newState.IsFinished() {
+		q.publish(questData.finishedEvent(userID, now))
+		q.removeActive(userID, questData.questID)
+		return AnswerResult{Active: true, Finished: true}, nil
+	}
+	questData.state = *newState
+	q.storeActive(userID, questData)
+	return AnswerResult{Active: true}, nil
+}
+
+func (q *questEngine) QuitQuest(userID tgbotbase.UserID) error {
+	q.mutex.Lock()
+	defer q.unlock()
+	questData, found := q.getCurrent(userID)
+	if !found {
+		return ErrNoActiveQuest
+	}
+	log.WithFields(log.Fields{"user": userID, "quest": questData.questID}).Debug("Quest abandoned")
+	q.dropSubmissions(userID, questData.questID, "")
+	q.removeActive(userID, questData.questID)
+	q.publish(Event{Type: EventAbandoned, QuestID: questData.questID, UserID: userID, Time: time.Now()})
+	return nil
+}
+
+// submitAnswer must be called under the mutex
+func (q *questEngine) submitAnswer(userID tgbotbase.UserID, questData activeUserQuest, answer string) AnswerResult {
+	stageID := questData.state.GetStageID()
+	for _, sub := range q.pending {
+		if sub.UserID == userID && sub.QuestID == questData.questID && sub.StageID == stageID {
+			log.WithFields(log.Fields{"user": userID, "submission": sub.ID}).Debug("Answer is already waiting for moderation")
+			return AnswerResult{Active: true, Pending: true}
+		}
+	}
+
+	now := time.Now()
+	sub := Submission{
+		ID:      newSubmissionID(now),
+		QuestID: questData.questID,
+		StageID: stageID,
+		UserID:  userID,
+		Answer:  answer,
+		Time:    now}
+	if err := q.stateStorage.StoreSubmission(sub); err != nil {
+		log.WithFields(log.Fields{"user": userID, "submission": sub.ID, "error": err}).Error("Unable to store submission")
+	}
+	q.pending[sub.ID] = sub
+	log.WithFields(log.Fields{"user": userID, "submission": sub.ID, "answer": answer}).Debug("Answer sent to moderation")
+	q.publish(Event{Type: EventSubmitted, QuestID: sub.QuestID, UserID: sub.UserID, Time: sub.Time, Submission: &sub})
+	return AnswerResult{Active: true, Pending: true, Submission: &sub}
+}
+
+// dropSubmissions must be called under the mutex, it forgets answers of the user waiting for moderation
+// on the stage the user is leaving, empty stageID drops submissions of all stages of the quest
+func (q *questEngine) dropSubmissions(userID tgbotbase.UserID, questID, stageID string) {
+	for id, sub := range q.pending {
+		if sub.UserID != userID || sub.QuestID != questID || (stageID != "" && sub.StageID != stageID) {
+			continue
+		}
+		delete(q.pending, id)
+		if err := q.stateStorage.DeleteSubmission(id); err != nil {
+			log.WithFields(log.Fields{"submission": id, "error": err}).Error("Unable to delete submission")
+		}
+		log.WithFields(log.Fields{"user": userID, "submission": id, "stage": sub.StageID}).Debug("Submission of an abandoned stage dropped")
+	}
+}
+
+func (q *questEngine) PendingSubmissions() []Submission {
+	q.mutex.Lock()
+	defer q.unlock()
+	subs := make([]Submission, 0, len(q.pending))
+	for _, sub := range q.pending {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Time.Before(subs[j].Time)
+	})
+	return subs
+}
+
+func (q *questEngine) ResolveSubmission(id string, decision Decision) (Submission, AnswerResult, error) {
+	q.mutex.Lock()
+	defer q.unlock()
+	sub, found := q.pending[id]
+	if !found {
+		if _, resolved := q.resolved[id]; resolved {
+			return Submission{}, AnswerResult{}, ErrSubmissionResolved
+		}
+		return Submission{}, AnswerResult{}, fmt.Errorf("Submission '%s' is not pending", id)
+	}
+	if decision.Authorize != nil && !decision.Authorize(sub) {
+		return sub, AnswerResult{}, ErrNotAuthorized
+	}
+	delete(q.pending, id)
+	if err := q.stateStorage.DeleteSubmission(id); err != nil {
+		log.WithFields(log.Fields{"submission": id, "error": err}).Error("Unable to delete submission")
+	}
+	q.rememberResolution(id, Resolution{Decision: decision, Time: time.Now()})
+	approved := decision.Approved
+
+	logger := log.WithFields(log.Fields{"user": sub.UserID, "submission": id, "approved": approved, "moderator": decision.Moderator})
+	questData, found := q.getActive(sub.UserID, sub.QuestID)
+	if !found || questData.state.IsFinished() || questData.state.GetStageID() != sub.StageID {
+		logger.Warn("Submission does not match the current stage of the user")
+		return sub, AnswerResult{}, fmt.Errorf("Submission '%s' is outdated", id)
+	}
+
+	now := time.Now()
+	if !approved {
+		logger.Debug("Submission rejected")
+		questData.mistakes++
+		q.storeActive(sub.UserID, questData)
+		q.publish(Event{Type: EventAnsweredIncorrectly, QuestID: sub.QuestID, UserID: sub.UserID, Time: now})
+		return sub, AnswerResult{Active: true}, nil
+	}
+
+	logger.Debug("Submission approved")
+	q.publish(Event{Type: EventAnsweredCorrectly, QuestID: sub.QuestID, UserID: sub.UserID, Time: now})
+	newState := questData.state.Next()
+	if newState.IsFinished() {
+		q.publish(questData.finishedEvent(sub.UserID, now))
+		q.removeActive(sub.UserID, sub.QuestID)
+		return sub, AnswerResult{Active: true, Correct: true, Finished: true}, nil
+	}
+	questData.state = *newState
+	q.storeActive(sub.UserID, questData)
+	return sub, AnswerResult{Active: true, Correct: true}, nil
+}
+
+func (q *questEngine) Resolution(id string) (Resolution, bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+	r, found := q.resolved[id]
+	return r, found
+}
+
+// rememberResolution must be called under the mutex, resolutions older than resolutionTTL are forgotten
+func (q *questEngine) rememberResolution(id string, r Resolution) {
+	for resolvedID, old := range q.resolved {
+		if r.Time.Sub(old.Time) > resolutionTTL {
+			delete(q.resolved, resolvedID)
+		}
+	}
+	q.resolved[id] = r
+}
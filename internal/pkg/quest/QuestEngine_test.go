@@ -0,0 +1,265 @@
+package quest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// eventRecorder is a publisher which keeps all events for checks
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Publish(e Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) Metrics() PublisherMetrics {
+	return PublisherMetrics{}
+}
+
+func (r *eventRecorder) Close() {
+}
+
+// waitEvents returns once the engine has published all events of finished calls
+func waitEvents(engine QuestEngine) {
+	engine.(*questEngine).dispatcher.wait()
+}
+
+// last returns the latest event of the type
+func (r *eventRecorder) last(t EventType) (Event, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].Type == t {
+			return r.events[i], true
+		}
+	}
+	return Event{}, false
+}
+
+// newTestEngine runs the engine on memory storages with the quests published on load
+func newTestEngine(t *testing.T, quests map[string]Quest) (QuestEngine, *eventRecorder) {
+	t.Helper()
+	storages := NewMemoryStorages()
+	for id, q := range quests {
+		if err := storages.Quests.StoreQuest(*NewQuestRecord(id, q)); err != nil {
+			t.Fatalf("Unable to store quest '%s': %s", id, err)
+		}
+	}
+	events := &eventRecorder{}
+	return NewQuestEngine(EngineConfig{}, storages, events), events
+}
+
+// newTestQuest creates a quest of stages 's1', 's2'... answered by 'a1', 'a2'...
+func newTestQuest(stagesN int, setup func(stageID string, stage *Stage)) Quest {
+	q := NewQuest()
+	for i := 1; i <= stagesN; i++ {
+		stageID := fmt.Sprintf("s%d", i)
+		stage := NewStage("question "+stageID, []string{fmt.Sprintf("a%d", i)})
+		if setup != nil {
+			setup(stageID, &stage)
+		}
+		q.AddStage(stageID, stage)
+	}
+	return q
+}
+
+func TestSkipLastStageCountsSkip(t *testing.T) {
+	q := newTestQuest(2, nil)
+	q.SetInfo(QuestInfo{Visibility: VisibilityHidden, Ranking: RankFirst, AllowSkip: true, SkipPenalty: time.Hour})
+	engine, events := newTestEngine(t, map[string]Quest{"q": q})
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	if res := engine.CheckAnswer(user, "wrong"); res.Correct {
+		t.Fatal("Wrong answer accepted")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := engine.SkipStage(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitEvents(engine)
+	e, found := events.last(EventFinished)
+	if !found {
+		t.Fatal("Quest has not been finished")
+	}
+	if e.Skipped != 2 || e.Mistakes != 1 || e.Spent < 2*time.Hour {
+		t.Errorf("Finished event = %+v, want 2 skipped, 1 mistake and at least 2h spent", e)
+	}
+}
+
+// currentAnswer returns the right answer for the current stage of the player, false if the player has no quest
+func currentAnswer(engine QuestEngine, userID tgbotbase.UserID) (string, bool) {
+	status, err := engine.GetStatus(userID)
+	if err != nil || status.StageID == "" {
+		return "", false
+	}
+	return "a" + status.StageID[1:], true
+}
+
+// TestParallelAnswers sends the same right answer several times at once, every stage must be passed exactly once
+func TestParallelAnswers(t *testing.T) {
+	const usersN, stagesN, parallelN = 5, 10, 8
+	engine, events := newTestEngine(t, map[string]Quest{"q": newTestQuest(stagesN, nil)})
+
+	var wg sync.WaitGroup
+	for u := 1; u <= usersN; u++ {
+		wg.Add(1)
+		go func(userID tgbotbase.UserID) {
+			defer wg.Done()
+			if err := engine.StartQuest(userID, "q"); err != nil {
+				t.Error(err)
+				return
+			}
+			for stage := 0; stage < stagesN; stage++ {
+				answer, ok := currentAnswer(engine, userID)
+				if !ok {
+					t.Errorf("User %d: no current stage at stage %d", userID, stage)
+					return
+				}
+				var correct, finished int64
+				var answers sync.WaitGroup
+				for i := 0; i < parallelN; i++ {
+					answers.Add(1)
+					go func() {
+						defer answers.Done()
+						res := engine.CheckAnswer(userID, answer)
+						if res.Correct {
+							atomic.AddInt64(&correct, 1)
+						}
+						if res.Finished {
+							atomic.AddInt64(&finished, 1)
+						}
+					}()
+				}
+				answers.Wait()
+				if correct != 1 {
+					t.Errorf("User %d: stage %d passed %d times", userID, stage, correct)
+				}
+				if wantFinished := stage == stagesN-1; (finished == 1) != wantFinished || finished > 1 {
+					t.Errorf("User %d: stage %d finished the quest %d times", userID, stage, finished)
+				}
+			}
+		}(tgbotbase.UserID(u))
+	}
+	wg.Wait()
+	waitEvents(engine)
+
+	counts := make(map[EventType]int, 0)
+	for _, e := range events.events {
+		counts[e.Type]++
+	}
+	if counts[EventAnsweredCorrectly] != usersN*stagesN || counts[EventFinished] != usersN {
+		t.Errorf("Events %v, want %d correct answers and %d finishes", counts, usersN*stagesN, usersN)
+	}
+}
+
+// TestConcurrentPlayerActions drives answers, skips and restarts of the same user from several goroutines
+// and checks that every attempt passes stages one by one and the stored state is the latest one
+func TestConcurrentPlayerActions(t *testing.T) {
+	const stagesN, workersN, actionsN = 5, 8, 200
+	q := newTestQuest(stagesN, nil)
+	q.SetInfo(QuestInfo{Visibility: VisibilityHidden, Ranking: RankFirst, AllowSkip: true})
+	engine, events := newTestEngine(t, map[string]Quest{"q": q})
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workersN; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < actionsN; i++ {
+				answer, active := currentAnswer(engine, user)
+				if !active {
+					if err := engine.StartQuest(user, "q"); err != nil && err != ErrQuestActive {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+				switch n := rnd.Intn(100); {
+				case n < 45:
+					engine.CheckAnswer(user, answer)
+				case n < 70:
+					engine.CheckAnswer(user, "wrong")
+				case n < 90:
+					if _, err := engine.SkipStage(user); err != nil && err != ErrNoActiveQuest {
+						t.Error(err)
+					}
+				default:
+					if err := engine.RestartQuest(user, "q"); err != nil && err != ErrNoActiveQuest {
+						t.Error(err)
+					}
+				}
+				if status, err := engine.GetStatus(user); err == nil && (status.Stage < 1 || status.Stage > stagesN) {
+					t.Errorf("Stage %d is out of 1..%d", status.Stage, stagesN)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	waitEvents(engine)
+
+	// replay the events: an attempt starts with EventStarted, passes every stage once and ends with EventFinished
+	inAttempt, passed, skipped, mistakes := false, 0, 0, 0
+	for i, e := range events.events {
+		switch e.Type {
+		case EventStarted:
+			inAttempt, passed, skipped, mistakes = true, 0, 0, 0
+		case EventAnsweredCorrectly, EventSkipped:
+			if !inAttempt {
+				t.Fatalf("Event %d: %s outside of an attempt", i, e.Type)
+			}
+			passed++
+			if e.Type == EventSkipped {
+				skipped++
+			}
+			if passed > stagesN {
+				t.Fatalf("Event %d: stage %d of %d passed", i, passed, stagesN)
+			}
+		case EventAnsweredIncorrectly:
+			mistakes++
+		case EventFinished:
+			if !inAttempt || passed != stagesN {
+				t.Fatalf("Event %d: quest finished after %d stages of %d", i, passed, stagesN)
+			}
+			if e.Skipped != skipped || e.Mistakes != mistakes {
+				t.Errorf("Event %d: finished with %d skipped and %d mistakes, events show %d and %d", i, e.Skipped, e.Mistakes, skipped, mistakes)
+			}
+			inAttempt = false
+		}
+	}
+
+	status, err := engine.GetStatus(user)
+	if err != nil {
+		if inAttempt {
+			t.Errorf("Quest is not active but the last attempt has not been finished")
+		}
+		return
+	}
+	if status.Stage != passed+1 || status.Skipped != skipped || status.Mistakes != mistakes {
+		t.Errorf("Status %+v does not match events: %d passed, %d skipped, %d mistakes", status, passed, skipped, mistakes)
+	}
+	internal := engine.(*questEngine)
+	internal.mutex.Lock()
+	defer internal.mutex.Unlock()
+	if current, _ := internal.getCurrent(user); current.version != internal.versionSeq {
+		t.Errorf("Version of the stored state %d is not the latest %d", current.version, internal.versionSeq)
+	}
+}
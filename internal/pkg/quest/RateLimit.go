@@ -0,0 +1,103 @@
+package quest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// RateLimit allows MaxWrong wrong answers per Window, after that answers are not accepted for Cooldown
+type RateLimit struct {
+	MaxWrong int
+	Window   time.Duration
+	Cooldown time.Duration
+}
+
+func (r RateLimit) Enabled() bool {
+	return r.MaxWrong > 0
+}
+
+// String returns the limit in the format accepted by ParseRateLimit
+func (r RateLimit) String() string {
+	if !r.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s/%s", r.MaxWrong, r.Window, r.Cooldown)
+}
+
+// ParseRateLimit parses limits like "5/1m/10m" - 5 wrong answers per minute, then 10 minutes of cooldown
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return RateLimit{}, fmt.Errorf("Rate limit '%s' must look like <max wrong>/<window>/<cooldown>", s)
+	}
+	maxWrong, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("Incorrect number of answers in rate limit '%s': %s", s, err)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("Incorrect window in rate limit '%s': %s", s, err)
+	}
+	cooldown, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("Incorrect cooldown in rate limit '%s': %s", s, err)
+	}
+	return RateLimit{MaxWrong: maxWrong, Window: window, Cooldown: cooldown}, nil
+}
+
+// Cooldown is a period when answers of a user on a stage are not accepted
+type Cooldown struct {
+	UserID  tgbotbase.UserID `json:"user"`
+	QuestID string           `json:"quest"`
+	StageID string           `json:"stage"`
+	Until   time.Time        `json:"until"`
+}
+
+type limiterKey struct {
+	userID  tgbotbase.UserID
+	questID string
+	stageID string
+}
+
+func (k limiterKey) String() string {
+	return fmt.Sprintf("%d:%s:%s", k.userID, k.questID, k.stageID)
+}
+
+type stageLimiter struct {
+	wrong  []time.Time
+	until  time.Time
+	window time.Duration
+}
+
+// addWrong records a wrong answer and returns true if the limit has been exceeded
+func (l *stageLimiter) addWrong(limit RateLimit, t time.Time) bool {
+	l.window = limit.Window
+	recent := l.wrong[:0]
+	for _, w := range l.wrong {
+		if t.Sub(w) < limit.Window {
+			recent = append(recent, w)
+		}
+	}
+	l.wrong = append(recent, t)
+	if len(l.wrong) < limit.MaxWrong {
+		return false
+	}
+	l.wrong = nil
+	l.until = t.Add(limit.Cooldown)
+	return true
+}
+
+// idle returns true if the limiter neither blocks answers nor counts recent wrong ones
+func (l *stageLimiter) idle(t time.Time) bool {
+	if t.Before(l.until) {
+		return false
+	}
+	return len(l.wrong) == 0 || t.Sub(l.wrong[len(l.wrong)-1]) >= l.window
+}
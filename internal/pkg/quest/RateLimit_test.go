@@ -0,0 +1,121 @@
+package quest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s       string
+		limit   RateLimit
+		wantErr bool
+	}{
+		{s: "", limit: RateLimit{}},
+		{s: "5/1m/10m", limit: RateLimit{MaxWrong: 5, Window: time.Minute, Cooldown: 10 * time.Minute}},
+		{s: "3/30s/1h30m", limit: RateLimit{MaxWrong: 3, Window: 30 * time.Second, Cooldown: 90 * time.Minute}},
+		{s: "5/1m", wantErr: true},
+		{s: "5/1m/10m/1h", wantErr: true},
+		{s: "five/1m/10m", wantErr: true},
+		{s: "5/minute/10m", wantErr: true},
+		{s: "5/1m/10", wantErr: true},
+	}
+	for _, tt := range tests {
+		limit, err := ParseRateLimit(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimit(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if limit != tt.limit {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.s, limit, tt.limit)
+		}
+		if parsed, err := ParseRateLimit(limit.String()); err != nil || parsed != limit {
+			t.Errorf("String() of %q = %q does not parse back", tt.s, limit.String())
+		}
+	}
+}
+
+func TestStageLimiter(t *testing.T) {
+	limit := RateLimit{MaxWrong: 3, Window: time.Minute, Cooldown: 10 * time.Minute}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		wrong    []time.Duration
+		exceeded bool
+		idleAt   time.Duration
+		idle     bool
+	}{
+		{name: "below limit", wrong: []time.Duration{0, 10 * time.Second}, idleAt: 30 * time.Second},
+		{name: "below limit, window passed", wrong: []time.Duration{0, 10 * time.Second}, idleAt: 71 * time.Second, idle: true},
+		{name: "spread over windows", wrong: []time.Duration{0, 50 * time.Second, 2 * time.Minute}, idleAt: 2*time.Minute + time.Second},
+		{name: "exceeded", wrong: []time.Duration{0, time.Second, 2 * time.Second}, exceeded: true, idleAt: 5 * time.Minute},
+		{name: "cooldown passed", wrong: []time.Duration{0, time.Second, 2 * time.Second}, exceeded: true, idleAt: 11 * time.Minute, idle: true},
+	}
+	for _, tt := range tests {
+		l := &stageLimiter{}
+		exceeded := false
+		for _, w := range tt.wrong {
+			exceeded = l.addWrong(limit, start.Add(w))
+		}
+		if exceeded != tt.exceeded {
+			t.Errorf("%s: exceeded = %v, want %v", tt.name, exceeded, tt.exceeded)
+		}
+		if idle := l.idle(start.Add(tt.idleAt)); idle != tt.idle {
+			t.Errorf("%s: idle = %v, want %v", tt.name, idle, tt.idle)
+		}
+	}
+}
+
+func TestLimitersAndLocksPruned(t *testing.T) {
+	q := newTestQuest(1, nil)
+	q.SetInfo(QuestInfo{Visibility: VisibilityHidden, Ranking: RankFirst, RateLimit: RateLimit{MaxWrong: 2, Window: time.Minute, Cooldown: time.Hour}})
+	engine, events := newTestEngine(t, map[string]Quest{"q": q})
+	internal := engine.(*questEngine)
+	limiters := func() int {
+		internal.mutex.Lock()
+		defer internal.mutex.Unlock()
+		return len(internal.limiters)
+	}
+
+	user := tgbotbase.UserID(1)
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	engine.CheckAnswer(user, "wrong")
+	if n := limiters(); n != 1 {
+		t.Fatalf("%d limiters after a wrong answer, want 1", n)
+	}
+	if res := engine.CheckAnswer(user, "a1"); !res.Finished {
+		t.Fatalf("Quest has not been finished: %+v", res)
+	}
+	if n := limiters(); n != 0 {
+		t.Errorf("%d limiters left after the quest has been finished, want 0", n)
+	}
+
+	if err := engine.StartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	engine.CheckAnswer(user, "wrong")
+	if res := engine.CheckAnswer(user, "wrong"); res.Cooldown == 0 {
+		t.Fatal("Cooldown has not been started")
+	}
+	waitEvents(engine)
+	if _, found := events.last(EventSuspicious); !found {
+		t.Error("Suspicious activity has not been reported")
+	}
+	if err := engine.RestartQuest(user, "q"); err != nil {
+		t.Fatal(err)
+	}
+	if res := engine.CheckAnswer(user, "a1"); res.Cooldown == 0 {
+		t.Error("Restart has escaped the cooldown")
+	}
+
+	internal.mutex.Lock()
+	locks := len(internal.userLocks)
+	internal.mutex.Unlock()
+	if locks != 0 {
+		t.Errorf("%d user locks left, want 0", locks)
+	}
+}
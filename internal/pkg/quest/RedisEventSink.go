@@ -0,0 +1,78 @@
+package quest
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// events are kept outside of "tg:questdef:*" where quests live
+const eventLogKey = "tg:questevents:log"
+
+// maxStoredEvents caps the event log, the oldest events are trimmed and do not count in restored stats
+const maxStoredEvents = 200000
+
+// RedisEventSink appends events to a Redis list so that stats survive restarts
+type RedisEventSink interface {
+	EventSink
+	LoadEvents() ([]Event, error)
+}
+
+type redisEventSink struct {
+	client   *redis.Client
+	failures uint64
+}
+
+func NewRedisEventSink(pool tgbotbase.RedisPool) RedisEventSink {
+	return &redisEventSink{client: pool.GetConnByName("quest")}
+}
+
+func (s *redisEventSink) Name() string {
+	return "redis"
+}
+
+func (s *redisEventSink) HandleEvent(e Event) {
+	logger := log.WithFields(log.Fields{"type": e.Type, "quest": e.QuestID, "user": e.UserID})
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.WithField("error", err).Error("Unable to encode event")
+		atomic.AddUint64(&s.failures, 1)
+		return
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(eventLogKey, data)
+		pipe.LTrim(eventLogKey, -maxStoredEvents, -1)
+		return nil
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Unable to store event")
+		atomic.AddUint64(&s.failures, 1)
+	}
+}
+
+func (s *redisEventSink) Failures() uint64 {
+	return atomic.LoadUint64(&s.failures)
+}
+
+func (s *redisEventSink) Close() {
+}
+
+func (s *redisEventSink) LoadEvents() ([]Event, error) {
+	data, err := s.client.LRange(eventLogKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(data))
+	for _, d := range data {
+		var e Event
+		if err := json.Unmarshal([]byte(d), &e); err != nil {
+			log.WithFields(log.Fields{"event": d, "error": err}).Error("Unable to decode stored event, skipping it")
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
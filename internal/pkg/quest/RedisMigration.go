@@ -0,0 +1,315 @@
+package quest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// the legacy layout kept every stage in 'tg:quest:<quest>:<stage>:question' hashes with ':answers' and
+// ':options' lists next to them and quest info in 'tg:quest:<quest>:info', nothing was escaped
+const legacyQuestPrefix = "tg:quest:"
+
+func scanLegacyQuests() string {
+	return legacyQuestPrefix + "*"
+}
+
+type legacyStageKey struct {
+	questID string
+	stageID string
+}
+
+// MigrationReport describes what has been converted from the legacy layout
+type MigrationReport struct {
+	Quests   []string
+	Stages   int
+	Failures []LoadFailure
+	// Warnings are keys which could be split into quest and stage IDs in more than one way
+	Warnings []string
+	// RemovedKeys is a number of legacy keys deleted after the conversion
+	RemovedKeys int
+	// RenamedVersions is a number of version keys renamed to escaped quest IDs
+	RenamedVersions int
+	// OffloadedQuests is a number of quests whose pictures have been moved from stage hashes to blobs
+	OffloadedQuests int
+	// OffloadedVersions is a number of published versions whose pictures have been moved to blobs
+	OffloadedVersions int
+}
+
+func (r MigrationReport) String() string {
+	lines := []string{fmt.Sprintf("Migrated %d quests with %d stages: %d failed, %d warnings, %d legacy keys removed, %d version keys renamed, pictures of %d quests and %d versions moved to blobs",
+		len(r.Quests), r.Stages, len(r.Failures), len(r.Warnings), r.RemovedKeys, r.RenamedVersions, r.OffloadedQuests, r.OffloadedVersions)}
+	for _, f := range r.Failures {
+		lines = append(lines, fmt.Sprintf("[error] %s: %s", f.QuestID, f.Err))
+	}
+	for _, w := range r.Warnings {
+		lines = append(lines, "[warning] "+w)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MigrateRedisSchema converts quests from the legacy layout into the current one and moves pictures
+// kept in stage hashes and published versions to blobs. Quests are written by StoreQuest, so the migration can be run again
+// safely; legacy keys are deleted only with cleanup and only for quests which have been converted.
+// Nothing is written with dryRun.
+func MigrateRedisSchema(pool tgbotbase.RedisPool, blobs BlobStore, cleanup bool, dryRun bool) (MigrationReport, error) {
+	client := pool.GetConnByName("quest")
+	report := MigrationReport{}
+
+	keys, err := tgbotbase.GetAllKeys(client, scanLegacyQuests())
+	if err != nil {
+		return report, err
+	}
+	infos, stages, warnings := splitLegacyKeys(keys)
+	report.Warnings = warnings
+
+	questIDs := make(map[string]bool, len(infos))
+	for questID := range infos {
+		questIDs[questID] = true
+	}
+	for key := range stages {
+		questIDs[key.questID] = true
+	}
+
+	storage := NewRedisQuestStorage(pool, blobs)
+	for questID := range questIDs {
+		q, err := loadLegacyQuest(client, questID, stages)
+		if err != nil {
+			log.WithFields(log.Fields{"quest": questID, "error": err}).Error("Unable to read legacy quest")
+			report.Failures = append(report.Failures, LoadFailure{questID, err})
+			continue
+		}
+		if !dryRun {
+			if err := storage.StoreQuest(QuestRecord{questID, *q}); err != nil {
+				return report, err
+			}
+		}
+		report.Quests = append(report.Quests, questID)
+		report.Stages += len(q.stages)
+		log.WithFields(log.Fields{"quest": questID, "stages_n": len(q.stages), "dry_run": dryRun}).Info("Quest has been migrated")
+
+		if cleanup && !dryRun {
+			legacy := []string{legacyQuestPrefix + questID + ":info"}
+			for key := range stages {
+				if key.questID == questID {
+					stageKey := legacyQuestPrefix + questID + ":" + key.stageID
+					legacy = append(legacy, stageKey+":question", stageKey+":answers", stageKey+":options")
+				}
+			}
+			removed, err := client.Del(legacy...).Result()
+			if err != nil {
+				return report, err
+			}
+			report.RemovedKeys += int(removed)
+		}
+	}
+	sort.Strings(report.Quests)
+
+	renamed, err := renameVersionKeys(client, dryRun)
+	report.RenamedVersions = renamed
+	if err != nil {
+		return report, err
+	}
+	report.OffloadedQuests, err = offloadPictures(storage, dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.OffloadedVersions, err = offloadVersionPictures(&redisVersionStorage{client: client, blobs: blobs}, dryRun)
+	return report, err
+}
+
+// offloadPictures stores again quests which have pictures inline so that they are moved to blobs
+func offloadPictures(storage QuestStorage, dryRun bool) (int, error) {
+	quests, _, err := storage.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+	offloaded := 0
+	for _, rec := range quests {
+		inline := false
+		for _, stage := range rec.quest.stages {
+			inline = inline || stage.pic != nil
+		}
+		if !inline {
+			continue
+		}
+		if !dryRun {
+			if err := storage.StoreQuest(rec); err != nil {
+				return offloaded, err
+			}
+		}
+		offloaded++
+	}
+	return offloaded, nil
+}
+
+// offloadVersionPictures stores again published versions which have pictures inline, numbers and times
+// of the versions are kept, so only the place of the pictures changes
+func offloadVersionPictures(storage *redisVersionStorage, dryRun bool) (int, error) {
+	if storage.blobs == nil {
+		return 0, nil
+	}
+	keys, err := tgbotbase.GetAllKeys(storage.client, scanCurrentVersions())
+	if err != nil {
+		return 0, err
+	}
+	offloaded := 0
+	for _, key := range keys {
+		questID := redisUnescape(strings.TrimSuffix(strings.TrimPrefix(key, redisVersionPrefix), ":current"))
+		versions, _, err := storage.ListVersions(questID)
+		if err != nil {
+			return offloaded, err
+		}
+		for _, v := range versions {
+			inline := false
+			for _, stage := range v.Quest.stages {
+				inline = inline || stage.pic != nil
+			}
+			if !inline {
+				continue
+			}
+			if !dryRun {
+				stages, err := offloadStages(storage.blobs, v.Quest)
+				if err != nil {
+					return offloaded, err
+				}
+				v.Quest.stages = stages
+				data, err := json.Marshal(v)
+				if err != nil {
+					return offloaded, err
+				}
+				if err := storage.client.Set(redisVersionKey(questID, v.Number), data, 0).Err(); err != nil {
+					return offloaded, err
+				}
+			}
+			log.WithFields(log.Fields{"quest": questID, "version": v.Number, "dry_run": dryRun}).Info("Pictures of version have been moved to blobs")
+			offloaded++
+		}
+	}
+	return offloaded, nil
+}
+
+// splitLegacyKeys finds quests and stages in legacy keys. IDs were not escaped, so a stage key is split
+// after the longest quest ID known from info keys, and at the last ':' otherwise.
+func splitLegacyKeys(keys []string) (map[string]bool, map[legacyStageKey]bool, []string) {
+	infos := make(map[string]bool, 0)
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":info") {
+			infos[strings.TrimSuffix(strings.TrimPrefix(key, legacyQuestPrefix), ":info")] = true
+		}
+	}
+	known := make([]string, 0, len(infos))
+	for questID := range infos {
+		known = append(known, questID)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return len(known[i]) > len(known[j])
+	})
+
+	stages := make(map[legacyStageKey]bool, 0)
+	warnings := make([]string, 0)
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, legacyQuestPrefix)
+		found := false
+		for _, suffix := range []string{":question", ":answers", ":options"} {
+			if strings.HasSuffix(rest, suffix) {
+				rest = strings.TrimSuffix(rest, suffix)
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		stage := legacyStageKey{}
+		for _, questID := range known {
+			if strings.HasPrefix(rest, questID+":") {
+				stage = legacyStageKey{questID, strings.TrimPrefix(rest, questID+":")}
+				break
+			}
+		}
+		if stage.questID == "" {
+			sep := strings.LastIndex(rest, ":")
+			if sep <= 0 {
+				warnings = append(warnings, fmt.Sprintf("Key '%s' has no stage ID, skipping", key))
+				continue
+			}
+			stage = legacyStageKey{rest[:sep], rest[sep+1:]}
+			if strings.Count(rest, ":") > 1 && !stages[stage] {
+				warnings = append(warnings, fmt.Sprintf("Key '%s' is ambiguous, it is read as stage '%s' of quest '%s'", key, stage.stageID, stage.questID))
+			}
+		}
+		stages[stage] = true
+	}
+	return infos, stages, warnings
+}
+
+func loadLegacyQuest(client *redis.Client, questID string, stages map[legacyStageKey]bool) (*Quest, error) {
+	fields, err := client.HGetAll(legacyQuestPrefix + questID + ":info").Result()
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseInfoFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	q := NewQuest()
+	q.info = *info
+	for key := range stages {
+		if key.questID != questID {
+			continue
+		}
+		stageKey := legacyQuestPrefix + questID + ":" + key.stageID
+		fields, err := client.HGetAll(stageKey + ":question").Result()
+		if err != nil {
+			return nil, err
+		}
+		answers, err := client.LRange(stageKey+":answers", 0, math.MaxInt64).Result()
+		if err != nil {
+			return nil, err
+		}
+		options, err := client.LRange(stageKey+":options", 0, math.MaxInt64).Result()
+		if err != nil {
+			return nil, err
+		}
+		stage, err := parseStageFields(fields, answers, options)
+		if err != nil {
+			return nil, fmt.Errorf("Stage '%s': %s", key.stageID, err)
+		}
+		q.stages[key.stageID] = *stage
+	}
+	return &q, nil
+}
+
+// renameVersionKeys moves versions of quests with special characters in IDs to escaped keys
+func renameVersionKeys(client *redis.Client, dryRun bool) (int, error) {
+	keys, err := tgbotbase.GetAllKeys(client, redisVersionPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	renamed := 0
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, redisVersionPrefix)
+		sep := strings.LastIndex(rest, ":")
+		if sep < 0 {
+			continue
+		}
+		questID, suffix := rest[:sep], rest[sep:]
+		if redisEscape(redisUnescape(questID)) == questID {
+			continue
+		}
+		if !dryRun {
+			if err := client.Rename(key, redisVersionPrefix+redisEscape(questID)+suffix).Err(); err != nil {
+				return renamed, err
+			}
+		}
+		renamed++
+	}
+	return renamed, nil
+}
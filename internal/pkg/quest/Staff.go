@@ -0,0 +1,75 @@
+package quest
+
+import (
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// Staff are people running quests: owners manage all quests, organizers manage only the assigned ones
+type Staff struct {
+	owners     []tgbotbase.UserID
+	organizers map[tgbotbase.UserID]map[string]bool
+	// chats are default chats for notifications of organizers
+	chats map[tgbotbase.UserID]int64
+}
+
+func NewStaff(owners []tgbotbase.UserID) Staff {
+	return Staff{
+		owners:     owners,
+		organizers: make(map[tgbotbase.UserID]map[string]bool, 0),
+		chats:      make(map[tgbotbase.UserID]int64, 0)}
+}
+
+// AddOrganizers assigns quests to organizers, the chat (if non-zero) is used for their notifications by default
+func (s Staff) AddOrganizers(organizers []tgbotbase.UserID, quests []string, chat int64) {
+	for _, org := range organizers {
+		if _, found := s.organizers[org]; !found {
+			s.organizers[org] = make(map[string]bool, len(quests))
+		}
+		for _, q := range quests {
+			s.organizers[org][q] = true
+		}
+		if chat != 0 {
+			s.chats[org] = chat
+		}
+	}
+}
+
+func (s Staff) Owners() []tgbotbase.UserID {
+	return s.owners
+}
+
+func (s Staff) IsOwner(userID tgbotbase.UserID) bool {
+	for _, owner := range s.owners {
+		if owner == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Staff) IsStaff(userID tgbotbase.UserID) bool {
+	_, found := s.organizers[userID]
+	return found || s.IsOwner(userID)
+}
+
+// CanManage tells whether the user can see stats, moderate answers and get notifications of the quest
+func (s Staff) CanManage(userID tgbotbase.UserID, questID string) bool {
+	return s.IsOwner(userID) || s.organizers[userID][questID]
+}
+
+// Members returns owners followed by organizers who are not owners
+func (s Staff) Members() []tgbotbase.UserID {
+	res := make([]tgbotbase.UserID, 0, len(s.owners)+len(s.organizers))
+	res = append(res, s.owners...)
+	for org := range s.organizers {
+		if !s.IsOwner(org) {
+			res = append(res, org)
+		}
+	}
+	return res
+}
+
+// DefaultChat returns a chat configured for notifications of the user, zero means direct messages
+func (s Staff) DefaultChat(userID tgbotbase.UserID) int64 {
+	return s.chats[userID]
+}
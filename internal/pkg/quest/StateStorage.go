@@ -0,0 +1,299 @@
+package quest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// StateStorage keeps runtime state of the engine which must survive restarts
+type StateStorage interface {
+	StoreSubmission(sub Submission) error
+	DeleteSubmission(id string) error
+	LoadSubmissions() ([]Submission, error)
+
+	// StoreInvite keeps the invite for a while after it has expired so that LoadInvite tells it is expired
+	StoreInvite(inv Invite) error
+	LoadInvite(code string) (*Invite, error)
+	// UseInvite atomically counts the user as one more player of the invite, it fails with ErrInviteExpired after
+	// the expiration and with ErrInviteUsedUp over the limit; a user who has already used the invite is not counted again
+	UseInvite(code string, userID tgbotbase.UserID) error
+
+	StoreCooldown(c Cooldown) error
+	// LoadCooldowns returns only cooldowns which are still active
+	LoadCooldowns() ([]Cooldown, error)
+
+	StoreNotifySettings(owner tgbotbase.UserID, settings NotifySettings) error
+	LoadNotifySettings() (map[tgbotbase.UserID]NotifySettings, error)
+
+	// StoreProgress replaces saved progress of the users in one write, empty progress forgets the user
+	StoreProgress(progress map[tgbotbase.UserID][]Progress) error
+	// LoadProgress returns saved progress of all users
+	LoadProgress() ([]Progress, error)
+}
+
+type redisStateStorage struct {
+	client *redis.Client
+}
+
+func NewRedisStateStorage(pool tgbotbase.RedisPool) StateStorage {
+	return &redisStateStorage{client: pool.GetConnByName("quest")}
+}
+
+func (s *redisStateStorage) StoreSubmission(sub Submission) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(redisSubmissionsKey(), sub.ID, data).Err()
+}
+
+func (s *redisStateStorage) DeleteSubmission(id string) error {
+	return s.client.HDel(redisSubmissionsKey(), id).Err()
+}
+
+func (s *redisStateStorage) LoadSubmissions() ([]Submission, error) {
+	fields, err := s.client.HGetAll(redisSubmissionsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]Submission, 0, len(fields))
+	for id, data := range fields {
+		var sub Submission
+		if err := json.Unmarshal([]byte(data), &sub); err != nil {
+			log.WithFields(log.Fields{"submission": id, "error": err}).Warn("Unable to decode submission")
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (s *redisStateStorage) StoreInvite(inv Invite) error {
+	key := redisInviteKey(inv.Code)
+	fields := map[string]interface{}{
+		"quest":   inv.QuestID,
+		"team":    inv.Team,
+		"maxuses": inv.MaxUses,
+		"uses":    inv.Uses}
+	if !inv.Expires.IsZero() {
+		fields["expires"] = inv.Expires.Unix()
+	}
+	err := s.client.HMSet(key, fields).Err()
+	if err != nil {
+		return err
+	}
+	if keep := inv.keepUntil(); !keep.IsZero() {
+		return s.client.ExpireAt(key, keep).Err()
+	}
+	return nil
+}
+
+func (s *redisStateStorage) LoadInvite(code string) (*Invite, error) {
+	fields, err := s.client.HGetAll(redisInviteKey(code)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrInviteNotFound
+	}
+	inv := Invite{
+		Code:    code,
+		QuestID: fields["quest"],
+		Team:    fields["team"]}
+	if inv.MaxUses, err = strconv.ParseInt(fields["maxuses"], 10, 64); err != nil {
+		return nil, fmt.Errorf("Malformed invite '%s': %s", code, err)
+	}
+	if inv.Uses, err = strconv.ParseInt(fields["uses"], 10, 64); err != nil {
+		return nil, fmt.Errorf("Malformed invite '%s': %s", code, err)
+	}
+	if expires, found := fields["expires"]; found {
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed invite '%s': %s", code, err)
+		}
+		inv.Expires = time.Unix(sec, 0)
+	}
+	return &inv, nil
+}
+
+// useInviteScript checks and counts a use of the invite at once, users of the invite are kept in a set
+// which expires along with the invite. It returns 1 for a new user, 0 for a repeated one, -1 if the invite
+// is not found, -2 if it is used up and -3 if it has expired at the time in ARGV[2]
+var useInviteScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local expires = redis.call('HGET', KEYS[1], 'expires')
+if expires and tonumber(expires) < tonumber(ARGV[2]) then
+	return -3
+end
+if redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+local maxuses = tonumber(redis.call('HGET', KEYS[1], 'maxuses'))
+local uses = tonumber(redis.call('HGET', KEYS[1], 'uses'))
+if maxuses > 0 and uses >= maxuses then
+	return -2
+end
+redis.call('HINCRBY', KEYS[1], 'uses', 1)
+redis.call('SADD', KEYS[2], ARGV[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1
+`)
+
+func (s *redisStateStorage) UseInvite(code string, userID tgbotbase.UserID) error {
+	keys := []string{redisInviteKey(code), redisInviteUsersKey(code)}
+	res, err := useInviteScript.Run(s.client, keys, int64(userID), time.Now().Unix()).Int64()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case -1:
+		return ErrInviteNotFound
+	case -2:
+		return ErrInviteUsedUp
+	case -3:
+		return ErrInviteExpired
+	}
+	return nil
+}
+
+func (s *redisStateStorage) StoreCooldown(c Cooldown) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	key := limiterKey{c.UserID, c.QuestID, c.StageID}
+	return s.client.HSet(redisCooldownsKey(), key.String(), data).Err()
+}
+
+func (s *redisStateStorage) LoadCooldowns() ([]Cooldown, error) {
+	fields, err := s.client.HGetAll(redisCooldownsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cooldowns := make([]Cooldown, 0, len(fields))
+	for key, data := range fields {
+		var c Cooldown
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			log.WithFields(log.Fields{"cooldown": key, "error": err}).Warn("Unable to decode cooldown")
+			continue
+		}
+		if now.After(c.Until) {
+			s.client.HDel(redisCooldownsKey(), key)
+			continue
+		}
+		cooldowns = append(cooldowns, c)
+	}
+	return cooldowns, nil
+}
+
+func (s *redisStateStorage) StoreNotifySettings(owner tgbotbase.UserID, settings NotifySettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(redisNotifyKey(), strconv.FormatInt(int64(owner), 10), data).Err()
+}
+
+func (s *redisStateStorage) LoadNotifySettings() (map[tgbotbase.UserID]NotifySettings, error) {
+	fields, err := s.client.HGetAll(redisNotifyKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[tgbotbase.UserID]NotifySettings, len(fields))
+	for owner, data := range fields {
+		id, err := strconv.ParseInt(owner, 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{"owner": owner, "error": err}).Warn("Malformed owner of notification settings")
+			continue
+		}
+		var settings NotifySettings
+		if err := json.Unmarshal([]byte(data), &settings); err != nil {
+			log.WithFields(log.Fields{"owner": owner, "error": err}).Warn("Unable to decode notification settings")
+			continue
+		}
+		res[tgbotbase.UserID(id)] = settings
+	}
+	return res, nil
+}
+
+func (s *redisStateStorage) StoreProgress(progress map[tgbotbase.UserID][]Progress) error {
+	forgotten := make([]string, 0)
+	saved := make(map[string]interface{}, len(progress))
+	for userID, p := range progress {
+		field := strconv.Itoa(int(userID))
+		if len(p) == 0 {
+			forgotten = append(forgotten, field)
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		saved[field] = data
+	}
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if len(forgotten) > 0 {
+			pipe.HDel(redisProgressKey(), forgotten...)
+		}
+		if len(saved) > 0 {
+			pipe.HMSet(redisProgressKey(), saved)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStateStorage) LoadProgress() ([]Progress, error) {
+	data, err := s.client.HGetAll(redisProgressKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Progress, 0, len(data))
+	for user, d := range data {
+		var progress []Progress
+		if err := json.Unmarshal([]byte(d), &progress); err != nil {
+			log.WithFields(log.Fields{"user": user, "error": err}).Error("Malformed saved progress, skipping it")
+			continue
+		}
+		res = append(res, progress...)
+	}
+	return res, nil
+}
+
+// state keys are kept out of 'tg:quest:*' so that they are not mistaken for quests
+func redisSubmissionsKey() string {
+	return "tg:queststate:submissions"
+}
+
+func redisInviteKey(code string) string {
+	return fmt.Sprintf("tg:queststate:invite:%s", code)
+}
+
+func redisInviteUsersKey(code string) string {
+	return fmt.Sprintf("tg:queststate:invite:%s:users", code)
+}
+
+func redisCooldownsKey() string {
+	return "tg:queststate:cooldowns"
+}
+
+func redisNotifyKey() string {
+	return "tg:queststate:notify"
+}
+
+// redisProgressKey is a hash of progress by user IDs
+func redisProgressKey() string {
+	return "tg:queststate:players"
+}
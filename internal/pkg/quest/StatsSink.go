@@ -0,0 +1,266 @@
+package quest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsSink keeps attempts of all players in memory
+type StatsSink interface {
+	EventSink
+	// Report returns messages with ordered results of the quest
+	Report(questID string, policy RankingPolicy) []string
+	// Summary returns counters of attempts and the ranking of the quest
+	Summary(questID string, policy RankingPolicy) (QuestStats, bool)
+	// GetHistory returns all attempts of the user ordered by start time
+	GetHistory(userID tgbotbase.UserID) []Attempt
+	// Replay applies events which happened before the restart
+	Replay(events []Event)
+}
+
+type statsSink struct {
+	mutex sync.Mutex
+	// every start of a quest is a separate attempt
+	stats map[string]map[tgbotbase.UserID][]Attempt
+
+	usernames *sync.Map
+}
+
+func NewStatsSink(usernames *sync.Map) StatsSink {
+	return &statsSink{
+		stats:     make(map[string]map[tgbotbase.UserID][]Attempt, 0),
+		usernames: usernames}
+}
+
+func (s *statsSink) Name() string {
+	return "stats"
+}
+
+func (s *statsSink) Close() {
+}
+
+// lossless keeps mistakes and skips of attempts matching what players have done
+func (s *statsSink) lossless() {
+}
+
+func (s *statsSink) HandleEvent(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.apply(e)
+}
+
+func (s *statsSink) Replay(events []Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, e := range events {
+		s.apply(e)
+	}
+	log.WithFields(log.Fields{"events": len(events)}).Info("Stats have been restored")
+}
+
+func (s *statsSink) apply(e Event) {
+	logger := log.WithFields(log.Fields{"quest": e.QuestID, "user": e.UserID, "time": e.Time})
+	switch e.Type {
+	case EventStarted:
+		stats := s.newAttempt(e.QuestID, e.UserID, e.Time)
+		logger.WithField("attempt", stats.Number).Debug("User started a quest")
+	case EventFinished:
+		stats := s.lastAttempt(e.QuestID, e.UserID)
+		stats.Finished = e.Time
+		stats.Result = AttemptFinished
+		logger.WithField("tdiff", stats.Spent()).Debug("User finished a quest")
+	case EventAnsweredCorrectly:
+		stats := s.lastAttempt(e.QuestID, e.UserID)
+		stats.answeredTimes = append(stats.answeredTimes, e.Time)
+		logger.WithField("answerN", len(stats.answeredTimes)).Debug("User answered correctly")
+	case EventAnsweredIncorrectly:
+		stats := s.lastAttempt(e.QuestID, e.UserID)
+		stats.Mistakes++
+		logger.WithField("total_incorrect", stats.Mistakes).Debug("User answered incorrectly")
+	case EventSkipped:
+		stats := s.lastAttempt(e.QuestID, e.UserID)
+		stats.Skipped++
+		stats.Penalty += e.Penalty
+		logger.WithField("penalty", stats.Penalty).Debug("User skipped a stage")
+	case EventAbandoned:
+		stats := s.lastAttempt(e.QuestID, e.UserID)
+		stats.Finished = e.Time
+		stats.Result = AttemptAbandoned
+		logger.Debug("User abandoned a quest")
+	}
+}
+
+func (s *statsSink) GetHistory(userID tgbotbase.UserID) []Attempt {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := make([]Attempt, 0)
+	for _, users := range s.stats {
+		res = append(res, users[userID]...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Started.Before(res[j].Started)
+	})
+	return res
+}
+
+func (s *statsSink) ensureStats(questID string) {
+	if _, found := s.stats[questID]; !found {
+		s.stats[questID] = make(map[tgbotbase.UserID][]Attempt, 0)
+	}
+}
+
+// newAttempt starts a new attempt, the one in progress is considered restarted
+func (s *statsSink) newAttempt(questID string, userID tgbotbase.UserID, t time.Time) *Attempt {
+	s.ensureStats(questID)
+	attempts := s.stats[questID][userID]
+	if n := len(attempts); n > 0 && attempts[n-1].Result == AttemptInProgress {
+		attempts[n-1].Result = AttemptRestarted
+		attempts[n-1].Finished = t
+	}
+	attempts = append(attempts, Attempt{
+		Number:  len(attempts) + 1,
+		QuestID: questID,
+		Result:  AttemptInProgress,
+		Started: t})
+	s.stats[questID][userID] = attempts
+	return &attempts[len(attempts)-1]
+}
+
+// lastAttempt returns the latest attempt, the returned pointer is valid until the next newAttempt
+func (s *statsSink) lastAttempt(questID string, userID tgbotbase.UserID) *Attempt {
+	attempts := s.stats[questID][userID]
+	if len(attempts) == 0 {
+		return s.newAttempt(questID, userID, time.Time{})
+	}
+	return &attempts[len(attempts)-1]
+}
+
+// QuestStats is a machine-readable form of stats of a quest
+type QuestStats struct {
+	QuestID  string `json:"quest"`
+	Players  int    `json:"players"`
+	Attempts int    `json:"attempts"`
+	// Results counts attempts by their result
+	Results map[AttemptResult]int `json:"results"`
+	Ranking []RankEntry           `json:"ranking"`
+}
+
+type RankEntry struct {
+	UserID   tgbotbase.UserID `json:"user"`
+	Username string           `json:"username"`
+	Spent    time.Duration    `json:"spent_ns"`
+	Mistakes int              `json:"mistakes"`
+	Skipped  int              `json:"skipped"`
+	Finished time.Time        `json:"finished"`
+}
+
+func (s *statsSink) Summary(questID string, policy RankingPolicy) (QuestStats, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, found := s.stats[questID]
+	if !found {
+		return QuestStats{}, false
+	}
+	summary := QuestStats{
+		QuestID: questID,
+		Players: len(data),
+		Results: make(map[AttemptResult]int, 4),
+		Ranking: make([]RankEntry, 0, len(data))}
+	for u, attempts := range data {
+		summary.Attempts += len(attempts)
+		for _, a := range attempts {
+			summary.Results[a.Result]++
+		}
+		if a, found := rankedAttempt(attempts, policy); found {
+			summary.Ranking = append(summary.Ranking, RankEntry{
+				UserID:   u,
+				Username: username(s.usernames, u),
+				Spent:    a.Spent(),
+				Mistakes: a.Mistakes,
+				Skipped:  a.Skipped,
+				Finished: a.Finished})
+		}
+	}
+	sort.Slice(summary.Ranking, func(i, j int) bool {
+		return summary.Ranking[i].Spent < summary.Ranking[j].Spent
+	})
+	return summary, true
+}
+
+func (s *statsSink) Report(questID string, policy RankingPolicy) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, found := s.stats[questID]
+	if !found {
+		return []string{fmt.Sprintf("Quest '%s' not found for stats", questID)}
+	}
+
+	type timeRecord struct {
+		userID tgbotbase.UserID
+		t      time.Time
+	}
+
+	type tdiffRecord struct {
+		userID tgbotbase.UserID
+		tdiff  time.Duration
+	}
+
+	orderedStartTimes := make([]timeRecord, 0, len(data))
+	orderedFinishTimes := make([]timeRecord, 0, len(data))
+	orderedTdiffs := make([]tdiffRecord, 0, len(data))
+	for u, attempts := range data {
+		orderedStartTimes = append(orderedStartTimes, timeRecord{u, attempts[0].Started})
+		dat, found := rankedAttempt(attempts, policy)
+		if !found {
+			continue
+		}
+		orderedFinishTimes = append(orderedFinishTimes, timeRecord{u, dat.Finished})
+		orderedTdiffs = append(orderedTdiffs, tdiffRecord{u, dat.Spent()})
+	}
+	sort.Slice(orderedStartTimes, func(i int, j int) bool {
+		return orderedStartTimes[i].t.Before(orderedStartTimes[j].t)
+	})
+	sort.Slice(orderedFinishTimes, func(i int, j int) bool {
+		return orderedFinishTimes[i].t.Before(orderedFinishTimes[j].t)
+	})
+	sort.Slice(orderedTdiffs, func(i int, j int) bool {
+		return orderedTdiffs[i].tdiff.Nanoseconds() < orderedTdiffs[j].tdiff.Nanoseconds()
+	})
+
+	res := make([]string, 0, 3)
+	msg := fmt.Sprintf("Ordered start times for quest '%s'", questID)
+	for _, rec := range orderedStartTimes {
+		msg = fmt.Sprintf("%s\n User '%s' -> time %s", msg, username(s.usernames, rec.userID), rec.t)
+	}
+	res = append(res, msg)
+
+	msg = fmt.Sprintf("Ordered finish times for quest '%s' (%s attempt counts)", questID, policy)
+	for _, rec := range orderedFinishTimes {
+		msg = fmt.Sprintf("%s\n User '%s' -> time %s", msg, username(s.usernames, rec.userID), rec.t)
+	}
+	res = append(res, msg)
+
+	msg = fmt.Sprintf("Ordered time diffs for quest '%s' (%s attempt counts)", questID, policy)
+	for _, rec := range orderedTdiffs {
+		msg = fmt.Sprintf("%s\n User '%s' -> time %s", msg, username(s.usernames, rec.userID), rec.tdiff)
+	}
+	res = append(res, msg)
+	return res
+}
+
+func username(usernames *sync.Map, userID tgbotbase.UserID) string {
+	val, found := usernames.Load(int(userID))
+	if !found {
+		return strconv.Itoa(int(userID))
+	}
+	return val.(string)
+}
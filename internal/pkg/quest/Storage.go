@@ -2,10 +2,11 @@ package quest
 
 import "github.com/admirallarimda/tgbotbase"
 import "github.com/go-redis/redis"
+import "encoding/json"
 import "fmt"
-import "math"
 import "errors"
 import "strings"
+import "time"
 import log "github.com/sirupsen/logrus"
 
 type QuestRecord struct {
@@ -18,153 +19,419 @@ func NewQuestRecord(questID string, quest Quest) *QuestRecord {
 		questID, quest}
 }
 
+func (r QuestRecord) ID() string {
+	return r.questID
+}
+
+func (r QuestRecord) Quest() Quest {
+	return r.quest
+}
+
 type StageRecord struct {
 	stageID string
 	stage   Stage
 }
 
+func NewStageRecord(stageID string, stage Stage) StageRecord {
+	return StageRecord{stageID, stage}
+}
+
 type QuestStorage interface {
 	StoreQuest(quest QuestRecord) error
+	// StoreStage adds the stage or replaces an existing one completely in a single write
 	StoreStage(questID string, stage StageRecord) error
+	DeleteStage(questID, stageID string) error
+	// DeleteQuest removes the draft with all stages, published versions are kept
+	DeleteQuest(questID string) error
+	// ReplaceQuest stores the quest instead of the draft with all its stages in a single write
+	ReplaceQuest(quest QuestRecord) error
 
-	LoadAll() ([]QuestRecord, error)
+	// LoadAll returns all quests which can be loaded and failures of the others
+	LoadAll() ([]QuestRecord, []LoadFailure, error)
 	LoadQuest(questID string) (*Quest, error)
 	LoadStage(questID, stageID string) (*Stage, error)
 }
 
+// redisQuestStorage keeps every quest as a metadata hash and a hash per stage, all of them listed
+// in index sets so that nothing has to be found by SCAN and IDs never have to be parsed out of keys:
+//
+//	tg:quests                              set of quest IDs
+//	tg:questdef:<quest>                    hash of quest info
+//	tg:questdef:<quest>:stages             set of stage IDs
+//	tg:questdef:<quest>:stage:<stage>      hash of the stage, answers and options are JSON lists
+//
+// IDs are escaped in keys, see redisEscape. Every write is a single MULTI/EXEC transaction,
+// pictures are put into the blob store before it.
 type redisQuestStorage struct {
 	client *redis.Client
+	blobs  BlobStore
 }
 
-func NewRedisQuestStorage(pool tgbotbase.RedisPool) QuestStorage {
-	return &redisQuestStorage{client: pool.GetConnByName("quest")}
+// NewRedisQuestStorage keeps pictures in blobs, they are kept in stage hashes if blobs is nil
+func NewRedisQuestStorage(pool tgbotbase.RedisPool, blobs BlobStore) QuestStorage {
+	return &redisQuestStorage{client: pool.GetConnByName("quest"), blobs: blobs}
 }
 
-func (s *redisQuestStorage) StoreQuest(q QuestRecord) error {
-	var err error
-	for stageID, stage := range q.quest.stages {
-		err = s.StoreStage(q.questID, StageRecord{stageID, stage})
+// offloadStages puts pictures of all stages of the quest into the blob store
+func offloadStages(blobs BlobStore, q Quest) (map[string]Stage, error) {
+	stages := make(map[string]Stage, len(q.stages))
+	for stageID, stage := range q.stages {
+		stage, err := offloadPicture(blobs, stage)
 		if err != nil {
-			break
+			return nil, err
 		}
+		stages[stageID] = stage
 	}
-	return err
+	return stages, nil
 }
 
-func (s *redisQuestStorage) StoreStage(questID string, rec StageRecord) error {
-	stageKey := redisStageKey(questID, rec.stageID)
-	err := s.client.HSet(redisQuestion(stageKey), "text", rec.stage.question).Err()
+func (s *redisQuestStorage) StoreQuest(q QuestRecord) error {
+	stages, err := offloadStages(s.blobs, q.quest)
 	if err != nil {
 		return err
 	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(redisQuestIndexKey, q.questID)
+		if fields := infoFields(q.quest.info); len(fields) > 0 {
+			pipe.HMSet(redisQuestMetaKey(q.questID), fields)
+		}
+		for stageID, stage := range stages {
+			if err := storeStage(pipe, q.questID, stageID, stage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// infoFields returns only non-empty fields so that uploading a single stage keeps the description
+func infoFields(info QuestInfo) map[string]interface{} {
+	fields := make(map[string]interface{}, 4)
+	if info.Title != "" {
+		fields["title"] = info.Title
+	}
+	if info.Description != "" {
+		fields["description"] = info.Description
+	}
+	if info.Difficulty != "" {
+		fields["difficulty"] = info.Difficulty
+	}
+	if info.Visibility != "" {
+		fields["visibility"] = string(info.Visibility)
+	}
+	if info.RateLimit.Enabled() {
+		fields["ratelimit"] = info.RateLimit.String()
+	}
+	if info.Ranking != "" {
+		fields["ranking"] = string(info.Ranking)
+	}
+	if info.AllowSkip {
+		fields["skip"] = info.AllowSkip
+		fields["skippenalty"] = info.SkipPenalty.String()
+	}
+	return fields
+}
+
+// mergeInfo applies non-empty fields of the info to the stored one the way infoFields does in Redis
+func mergeInfo(stored, info QuestInfo) QuestInfo {
+	if info.Title != "" {
+		stored.Title = info.Title
+	}
+	if info.Description != "" {
+		stored.Description = info.Description
+	}
+	if info.Difficulty != "" {
+		stored.Difficulty = info.Difficulty
+	}
+	if info.Visibility != "" {
+		stored.Visibility = info.Visibility
+	}
+	if info.RateLimit.Enabled() {
+		stored.RateLimit = info.RateLimit
+	}
+	if info.Ranking != "" {
+		stored.Ranking = info.Ranking
+	}
+	if info.AllowSkip {
+		stored.AllowSkip = info.AllowSkip
+		stored.SkipPenalty = info.SkipPenalty
+	}
+	return stored
+}
 
-	if rec.stage.pic != nil {
-		err = s.client.HSet(redisQuestion(stageKey), "pic", rec.stage.pic).Err()
+func parseInfoFields(fields map[string]string) (*QuestInfo, error) {
+	visibility, err := ParseVisibility(fields["visibility"])
+	if err != nil {
+		return nil, err
+	}
+	ranking, err := ParseRankingPolicy(fields["ranking"])
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := ParseRateLimit(fields["ratelimit"])
+	if err != nil {
+		return nil, err
+	}
+	info := QuestInfo{
+		Title:       fields["title"],
+		Description: fields["description"],
+		Difficulty:  fields["difficulty"],
+		Visibility:  visibility,
+		AllowSkip:   fields["skip"] == "1",
+		Ranking:     ranking,
+		RateLimit:   rateLimit}
+	if penalty, found := fields["skippenalty"]; found {
+		info.SkipPenalty, err = time.ParseDuration(penalty)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return &info, nil
+}
 
-	answers := make([]string, 0, len(rec.stage.answers))
-	for a, _ := range rec.stage.answers {
-		answers = append(answers, a)
-	}
-	err = s.client.LPush(redisAnswers(stageKey), answers).Err()
+// storeStage queues replacing of the stage into the transaction
+func storeStage(pipe redis.Pipeliner, questID string, stageID string, stage Stage) error {
+	answers, err := json.Marshal(stage.Answers())
 	if err != nil {
 		return err
 	}
+	fields := map[string]interface{}{
+		"text":    stage.question,
+		"type":    string(stage.stageType),
+		"answers": string(answers)}
+	if stage.pic != nil {
+		fields["pic"] = stage.pic
+	}
+	if stage.picRef != "" {
+		fields["picref"] = stage.picRef
+	}
+	if stage.picID != "" {
+		fields["picid"] = stage.picID
+	}
+	if stage.stageType == StageChoice {
+		options, err := json.Marshal(stage.options)
+		if err != nil {
+			return err
+		}
+		fields["options"] = string(options)
+		fields["shuffle"] = stage.shuffleOptions
+	}
+	stageKey := redisStageKey(questID, stageID)
+	pipe.SAdd(redisQuestIndexKey, questID)
+	pipe.SAdd(redisStageIndexKey(questID), stageID)
+	pipe.Del(stageKey)
+	pipe.HMSet(stageKey, fields)
 	return nil
 }
 
-func (s *redisQuestStorage) LoadAll() ([]QuestRecord, error) {
-	questKeys, err := tgbotbase.GetAllKeys(s.client, scanQuests())
+// parseStageFields builds a stage from its hash, answers and options are passed separately
+// as the legacy layout kept them in lists
+func parseStageFields(fields map[string]string, answers []string, options []string) (*Stage, error) {
+	qtext, found := fields["text"]
+	if !found {
+		return nil, errors.New("Empty question text")
+	}
+
+	stageType, err := ParseStageType(fields["type"])
 	if err != nil {
 		return nil, err
 	}
-	uniqueQuestKeys := make(map[string]bool, len(questKeys))
-	for _, key := range questKeys {
-		parts := strings.Split(key, ":")
-		uniqueQuestKeys[parts[2]] = true
+
+	stage := NewStage(qtext, answers)
+	stage.SetType(stageType)
+	if stageType == StageChoice {
+		stage.SetOptions(options, fields["shuffle"] == "1" || fields["shuffle"] == "true")
+	}
+	if pic, found := fields["pic"]; found {
+		stage.AddPicture([]byte(pic))
 	}
-	quests := make([]QuestRecord, 0, len(uniqueQuestKeys))
-	for k := range uniqueQuestKeys {
-		quest, err := s.LoadQuest(k)
+	if picRef, found := fields["picref"]; found {
+		stage.SetPictureRef(picRef)
+	}
+	if picID, found := fields["picid"]; found {
+		stage.SetPictureID(picID)
+	}
+	return &stage, nil
+}
+
+func (s *redisQuestStorage) StoreStage(questID string, rec StageRecord) error {
+	stage, err := offloadPicture(s.blobs, rec.stage)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		return storeStage(pipe, questID, rec.stageID, stage)
+	})
+	return err
+}
+
+func (s *redisQuestStorage) DeleteStage(questID, stageID string) error {
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(redisStageIndexKey(questID), stageID)
+		pipe.Del(redisStageKey(questID, stageID))
+		return nil
+	})
+	return err
+}
+
+func (s *redisQuestStorage) DeleteQuest(questID string) error {
+	stageIDs, err := s.client.SMembers(redisStageIndexKey(questID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{redisQuestMetaKey(questID), redisStageIndexKey(questID)}
+	for _, stageID := range stageIDs {
+		keys = append(keys, redisStageKey(questID, stageID))
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(redisQuestIndexKey, questID)
+		pipe.Del(keys...)
+		return nil
+	})
+	return err
+}
+
+// ReplaceQuest deletes the draft and stores the quest in one transaction, a stage added by someone else
+// after the stages have been listed loses its index entry and is never loaded
+func (s *redisQuestStorage) ReplaceQuest(q QuestRecord) error {
+	stages, err := offloadStages(s.blobs, q.quest)
+	if err != nil {
+		return err
+	}
+	oldStageIDs, err := s.client.SMembers(redisStageIndexKey(q.questID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{redisQuestMetaKey(q.questID), redisStageIndexKey(q.questID)}
+	for _, stageID := range oldStageIDs {
+		keys = append(keys, redisStageKey(q.questID, stageID))
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(keys...)
+		pipe.SAdd(redisQuestIndexKey, q.questID)
+		if fields := infoFields(q.quest.info); len(fields) > 0 {
+			pipe.HMSet(redisQuestMetaKey(q.questID), fields)
+		}
+		for stageID, stage := range stages {
+			if err := storeStage(pipe, q.questID, stageID, stage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisQuestStorage) LoadAll() ([]QuestRecord, []LoadFailure, error) {
+	questIDs, err := s.client.SMembers(redisQuestIndexKey).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(questIDs) == 0 {
+		s.warnLegacy()
+	}
+	quests := make([]QuestRecord, 0, len(questIDs))
+	failures := make([]LoadFailure, 0)
+	for _, questID := range questIDs {
+		quest, err := s.LoadQuest(questID)
 		if err != nil {
-			log.WithFields(log.Fields{"quest": k, "error": err}).Warn("Unable to load quest")
+			log.WithFields(log.Fields{"quest": questID, "error": err}).Warn("Unable to load quest")
+			failures = append(failures, LoadFailure{questID, err})
 			continue
 		}
-		quests = append(quests, QuestRecord{k, *quest})
+		quests = append(quests, QuestRecord{questID, *quest})
+	}
+	return quests, failures, nil
+}
+
+// warnLegacy tells that quests are kept in the old layout which is not read anymore
+func (s *redisQuestStorage) warnLegacy() {
+	keys, err := tgbotbase.GetAllKeys(s.client, scanLegacyQuests())
+	if err == nil && len(keys) > 0 {
+		log.WithFields(log.Fields{"keys_n": len(keys)}).Warn("Quests are stored in the old Redis layout, run 'questupload migrate' to convert them")
 	}
-	return quests, nil
 }
 
 func (s *redisQuestStorage) LoadQuest(questID string) (*Quest, error) {
-	stageKeys, err := tgbotbase.GetAllKeys(s.client, scanStages(questID))
+	var infoCmd *redis.StringStringMapCmd
+	var stagesCmd *redis.StringSliceCmd
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		infoCmd = pipe.HGetAll(redisQuestMetaKey(questID))
+		stagesCmd = pipe.SMembers(redisStageIndexKey(questID))
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	stages := make(map[string]Stage, len(stageKeys))
-	for _, key := range stageKeys {
-		parts := strings.Split(key, ":")
-		stageID := parts[3]
+	info, err := parseInfoFields(infoCmd.Val())
+	if err != nil {
+		return nil, err
+	}
+	stages := make(map[string]Stage, len(stagesCmd.Val()))
+	for _, stageID := range stagesCmd.Val() {
 		stage, err := s.LoadStage(questID, stageID)
 		if err != nil {
 			log.WithFields(log.Fields{"quest": questID, "stage": stageID, "error": err}).Warn("Unable to load stage")
-			return nil, err
+			return nil, fmt.Errorf("Stage '%s': %s", stageID, err)
 		}
 		stages[stageID] = *stage
 	}
-	return &Quest{stages}, nil
+	return &Quest{stages: stages, info: *info}, nil
 }
 
 func (s *redisQuestStorage) LoadStage(questID, stageID string) (*Stage, error) {
-	stageKey := redisStageKey(questID, stageID)
-	fields, err := s.client.HGetAll(redisQuestion(stageKey)).Result()
+	fields, err := s.client.HGetAll(redisStageKey(questID, stageID)).Result()
 	if err != nil {
 		return nil, err
 	}
-
-	qtext, found := fields["text"]
-	if !found {
-		return nil, errors.New("Empty question text")
-	}
-
-	answers, err := s.client.LRange(redisAnswers(stageKey), 0, math.MaxInt64).Result()
-	if err != nil {
-		return nil, err
+	var answers, options []string
+	if err := json.Unmarshal([]byte(fields["answers"]), &answers); err != nil && fields["answers"] != "" {
+		return nil, fmt.Errorf("Malformed answers: %s", err)
 	}
-	if len(answers) == 0 {
-		return nil, errors.New("Empty list of answers")
+	if err := json.Unmarshal([]byte(fields["options"]), &options); err != nil && fields["options"] != "" {
+		return nil, fmt.Errorf("Malformed options: %s", err)
 	}
+	return parseStageFields(fields, answers, options)
+}
 
-	stage := NewStage(qtext, answers)
-	if pic, found := fields["pic"]; found {
-		stage.AddPicture([]byte(pic))
-	}
+// redisEscaper makes IDs safe to be put between ':' in keys and into SCAN patterns
+var redisEscaper = strings.NewReplacer(
+	"%", "%25",
+	":", "%3A",
+	"*", "%2A",
+	"?", "%3F",
+	"[", "%5B",
+	"]", "%5D",
+	"\\", "%5C")
 
-	return &stage, nil
-}
+var redisUnescaper = strings.NewReplacer(
+	"%3A", ":",
+	"%2A", "*",
+	"%3F", "?",
+	"%5B", "[",
+	"%5D", "]",
+	"%5C", "\\",
+	"%25", "%")
 
-func redisQuestKey(questID string) string {
-	return fmt.Sprintf("tg:quest:%s", questID)
+func redisEscape(id string) string {
+	return redisEscaper.Replace(id)
 }
 
-func scanQuests() string {
-	return "tg:quest:*"
+func redisUnescape(key string) string {
+	return redisUnescaper.Replace(key)
 }
 
-func scanStages(questID string) string {
-	return fmt.Sprintf("tg:quest:%s:*:question", questID)
-}
+const redisQuestIndexKey = "tg:quests"
 
-func redisStageKey(questID string, stageID string) string {
-	return fmt.Sprintf("%s:%s", redisQuestKey(questID), stageID)
+func redisQuestMetaKey(questID string) string {
+	return fmt.Sprintf("tg:questdef:%s", redisEscape(questID))
 }
 
-func redisQuestion(stageKey string) string {
-	return fmt.Sprintf("%s:question", stageKey)
+func redisStageIndexKey(questID string) string {
+	return fmt.Sprintf("%s:stages", redisQuestMetaKey(questID))
 }
 
-func redisAnswers(stageKey string) string {
-	return fmt.Sprintf("%s:answers", stageKey)
+func redisStageKey(questID string, stageID string) string {
+	return fmt.Sprintf("%s:stage:%s", redisQuestMetaKey(questID), redisEscape(stageID))
 }
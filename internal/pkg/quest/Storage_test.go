@@ -0,0 +1,219 @@
+package quest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+func TestRedisEscape(t *testing.T) {
+	tests := []struct {
+		id      string
+		escaped string
+	}{
+		{id: "plain", escaped: "plain"},
+		{id: "city:tour", escaped: "city%3Atour"},
+		{id: "a*b?c", escaped: "a%2Ab%3Fc"},
+		{id: "[x]\\y", escaped: "%5Bx%5D%5Cy"},
+		{id: "100%", escaped: "100%25"},
+		{id: "%3A", escaped: "%253A"},
+		{id: "квест", escaped: "квест"},
+	}
+	for _, tt := range tests {
+		escaped := redisEscape(tt.id)
+		if escaped != tt.escaped {
+			t.Errorf("redisEscape(%q) = %q, want %q", tt.id, escaped, tt.escaped)
+		}
+		if id := redisUnescape(escaped); id != tt.id {
+			t.Errorf("redisUnescape(%q) = %q, want %q", escaped, id, tt.id)
+		}
+	}
+}
+
+func TestSplitLegacyKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		infos    map[string]bool
+		stages   map[legacyStageKey]bool
+		warningN int
+	}{
+		{
+			name:   "simple",
+			keys:   []string{"tg:quest:q:info", "tg:quest:q:s1:question", "tg:quest:q:s1:answers", "tg:quest:q:s2:question"},
+			infos:  map[string]bool{"q": true},
+			stages: map[legacyStageKey]bool{{"q", "s1"}: true, {"q", "s2"}: true}},
+		{
+			name:   "quest ID with colon is known from info",
+			keys:   []string{"tg:quest:city:tour:info", "tg:quest:city:tour:s1:question", "tg:quest:city:tour:s1:options"},
+			infos:  map[string]bool{"city:tour": true},
+			stages: map[legacyStageKey]bool{{"city:tour", "s1"}: true}},
+		{
+			name:   "longest known quest ID wins",
+			keys:   []string{"tg:quest:a:info", "tg:quest:a:b:info", "tg:quest:a:b:s:question"},
+			infos:  map[string]bool{"a": true, "a:b": true},
+			stages: map[legacyStageKey]bool{{"a:b", "s"}: true}},
+		{
+			name:     "unknown quest is split at the last colon",
+			keys:     []string{"tg:quest:x:y:s:question"},
+			infos:    map[string]bool{},
+			stages:   map[legacyStageKey]bool{{"x:y", "s"}: true},
+			warningN: 1},
+		{
+			name:     "no stage ID",
+			keys:     []string{"tg:quest:lonely:question"},
+			infos:    map[string]bool{},
+			stages:   map[legacyStageKey]bool{},
+			warningN: 1},
+		{
+			name:   "other keys are ignored",
+			keys:   []string{"tg:quest:q:info", "tg:quest:q:something"},
+			infos:  map[string]bool{"q": true},
+			stages: map[legacyStageKey]bool{}},
+	}
+	for _, tt := range tests {
+		infos, stages, warnings := splitLegacyKeys(tt.keys)
+		if !reflect.DeepEqual(infos, tt.infos) {
+			t.Errorf("%s: infos = %v, want %v", tt.name, infos, tt.infos)
+		}
+		if !reflect.DeepEqual(stages, tt.stages) {
+			t.Errorf("%s: stages = %v, want %v", tt.name, stages, tt.stages)
+		}
+		if len(warnings) != tt.warningN {
+			t.Errorf("%s: warnings = %v, want %d", tt.name, warnings, tt.warningN)
+		}
+	}
+}
+
+func TestStoreStageReplaces(t *testing.T) {
+	fileStorages, err := NewFileStorages(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]QuestStorage{
+		"memory": NewMemoryStorages().Quests,
+		"file":   fileStorages.Quests}
+	for name, storage := range backends {
+		old := NewStage("old question", []string{"a", "b"})
+		old.SetPictureID("file-id")
+		if err := storage.StoreStage("q", NewStageRecord("s1", old)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := storage.StoreStage("q", NewStageRecord("s1", NewStage("new question", []string{"c"}))); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		q, err := storage.LoadQuest("q")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		stage, found := q.Stage("s1")
+		if !found || len(q.StageIDs()) != 1 {
+			t.Fatalf("%s: stages %v after replacing", name, q.StageIDs())
+		}
+		if stage.Question() != "new question" || !reflect.DeepEqual(stage.Answers(), []string{"c"}) || stage.PictureID() != "" {
+			t.Errorf("%s: stage has not been replaced completely: %q %v %q", name, stage.Question(), stage.Answers(), stage.PictureID())
+		}
+	}
+}
+
+func TestReplaceQuest(t *testing.T) {
+	fileStorages, err := NewFileStorages(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]QuestStorage{
+		"memory": NewMemoryStorages().Quests,
+		"file":   fileStorages.Quests}
+	for name, storage := range backends {
+		old := NewQuest()
+		old.SetInfo(QuestInfo{Title: "old", Description: "kept by StoreQuest"})
+		old.AddStage("s1", NewStage("q1", []string{"a"}))
+		old.AddStage("s2", NewStage("q2", []string{"b"}))
+		if err := storage.StoreQuest(*NewQuestRecord("q", old)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		replacement := NewQuest()
+		replacement.SetInfo(QuestInfo{Title: "new"})
+		replacement.AddStage("s3", NewStage("q3", []string{"c"}))
+		if err := storage.ReplaceQuest(*NewQuestRecord("q", replacement)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		q, err := storage.LoadQuest("q")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ids := q.StageIDs(); !reflect.DeepEqual(ids, []string{"s3"}) {
+			t.Errorf("%s: stages %v after replacing, want [s3]", name, ids)
+		}
+		if info := q.Info(); info.Title != "new" || info.Description != "" {
+			t.Errorf("%s: info %+v after replacing", name, info)
+		}
+	}
+}
+
+func TestPublishVersionOffloadsPictures(t *testing.T) {
+	dir := t.TempDir()
+	blobs := NewMemoryBlobStore()
+	versions, err := NewFileVersionStorage(dir, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := NewStage("q", []string{"a"})
+	stage.AddPicture([]byte("picture"))
+	q := NewQuest()
+	q.AddStage("s1", stage)
+	v, err := versions.PublishVersion("q", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := versions.LoadVersion("q", v.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, _ := loaded.Quest.Stage("s1")
+	if published.Picture() != nil || published.PictureRef() != BlobRef([]byte("picture")) {
+		t.Fatalf("picture of the version is not offloaded: %d bytes inline, ref %q", len(published.Picture()), published.PictureRef())
+	}
+	if pic, err := blobs.Get(published.PictureRef()); err != nil || string(pic) != "picture" {
+		t.Errorf("blob of the version = %q, %v", pic, err)
+	}
+}
+
+func TestFileProgressApartFromState(t *testing.T) {
+	dir := t.TempDir()
+	// progress saved on shutdown by older versions is in state.json
+	legacy := `{"submissions": [], "invites": [], "cooldowns": [], "notify": {}, "progress": [{"user": 1, "quest": "q", "version": 1, "current": true, "stage": 0, "order": ["s1"]}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewFileStateStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress, _ := storage.LoadProgress(); len(progress) != 1 {
+		t.Fatalf("Legacy progress is not loaded: %+v", progress)
+	}
+
+	state, _ := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	err = storage.StoreProgress(map[tgbotbase.UserID][]Progress{
+		1: nil,
+		2: {{UserID: 2, QuestID: "q", Version: 1, Current: true, StageOrder: []string{"s1"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(filepath.Join(dir, "state.json")); string(after) != string(state) {
+		t.Error("state.json is rewritten on saving progress")
+	}
+
+	reopened, err := NewFileStateStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, _ := reopened.LoadProgress()
+	if len(progress) != 1 || progress[0].UserID != 2 {
+		t.Errorf("Progress after reopening is %+v, want only user 2", progress)
+	}
+}
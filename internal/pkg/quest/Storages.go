@@ -0,0 +1,66 @@
+package quest
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/admirallarimda/tgbotbase"
+)
+
+// Storages groups everything the engine persists, quests and state come from the same backend
+// while pictures may be kept in a separate blob store
+type Storages struct {
+	Quests   QuestStorage
+	Versions VersionStorage
+	State    StateStorage
+	Blobs    BlobStore
+}
+
+// NewRedisStorages keeps pictures in Redis too if blobs is nil
+func NewRedisStorages(pool tgbotbase.RedisPool, blobs BlobStore) Storages {
+	if blobs == nil {
+		blobs = NewRedisBlobStore(pool)
+	}
+	return Storages{
+		Quests:   NewRedisQuestStorage(pool, blobs),
+		Versions: NewRedisVersionStorage(pool, blobs),
+		State:    NewRedisStateStorage(pool),
+		Blobs:    blobs}
+}
+
+// NewMemoryStorages returns storages which forget everything on exit, quests and versions keep pictures inline
+// and Blobs is an empty memory store for pictures referenced by refs, a configured blob store may replace it
+func NewMemoryStorages() Storages {
+	return Storages{
+		Quests:   NewMemoryQuestStorage(),
+		Versions: NewMemoryVersionStorage(),
+		State:    NewMemoryStateStorage(),
+		Blobs:    NewMemoryBlobStore()}
+}
+
+// NewFileStorages keeps quests, versions and state as JSON files in the directory,
+// pictures are kept in its 'blobs' subdirectory if blobs is nil
+func NewFileStorages(dir string, blobs BlobStore) (Storages, error) {
+	if dir == "" {
+		return Storages{}, fmt.Errorf("Directory of file storage is not set")
+	}
+	if blobs == nil {
+		var err error
+		if blobs, err = NewFileBlobStore(filepath.Join(dir, "blobs")); err != nil {
+			return Storages{}, err
+		}
+	}
+	quests, err := NewFileQuestStorage(dir, blobs)
+	if err != nil {
+		return Storages{}, err
+	}
+	versions, err := NewFileVersionStorage(dir, blobs)
+	if err != nil {
+		return Storages{}, err
+	}
+	state, err := NewFileStateStorage(dir)
+	if err != nil {
+		return Storages{}, err
+	}
+	return Storages{Quests: quests, Versions: versions, State: state, Blobs: blobs}, nil
+}
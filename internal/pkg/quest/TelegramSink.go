@@ -0,0 +1,220 @@
+package quest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// maxMessageLen is a limit of Telegram for a text message
+const maxMessageLen = 4096
+
+// Sender delivers messages to Telegram and tells whether they have been accepted
+type Sender interface {
+	Send(msg tgbotapi.Chattable) error
+}
+
+type playerKey struct {
+	questID string
+	userID  tgbotbase.UserID
+}
+
+type telegramSink struct {
+	sender        Sender
+	notifications OwnerNotifications
+	usernames     *sync.Map
+
+	// wrongStreaks counts wrong answers in a row and attempts counts starts,
+	// they are used only by the sink goroutine
+	wrongStreaks map[playerKey]int
+	attempts     map[playerKey]int
+
+	// digest collects notifications per chat which are sent every digestInterval
+	digestInterval time.Duration
+	digestMutex    sync.Mutex
+	digest         map[int64][]string
+	stopCh         chan struct{}
+	stoppedCh      chan struct{}
+
+	failed uint64
+}
+
+// NewTelegramSink notifies owners about quest events according to their settings,
+// zero digestInterval means that every notification is sent separately;
+// attempts are numbered continuing the stored history of events
+func NewTelegramSink(sender Sender, notifications OwnerNotifications, usernames *sync.Map, digestInterval time.Duration, history []Event) EventSink {
+	if len(notifications.Staff().Members()) == 0 {
+		log.Panic("0 owners")
+	}
+
+	s := &telegramSink{
+		sender:         sender,
+		notifications:  notifications,
+		usernames:      usernames,
+		wrongStreaks:   make(map[playerKey]int, 0),
+		attempts:       make(map[playerKey]int, 0),
+		digestInterval: digestInterval,
+		digest:         make(map[int64][]string, 0),
+		stopCh:         make(chan struct{}),
+		stoppedCh:      make(chan struct{})}
+	for _, e := range history {
+		if e.Type == EventStarted {
+			s.attempts[playerKey{e.QuestID, e.UserID}]++
+		}
+	}
+	if digestInterval > 0 {
+		go s.digestLoop()
+	} else {
+		close(s.stoppedCh)
+	}
+	return s
+}
+
+func (s *telegramSink) Name() string {
+	return "telegram"
+}
+
+func (s *telegramSink) HandleEvent(e Event) {
+	name := username(s.usernames, e.UserID)
+	key := playerKey{e.QuestID, e.UserID}
+	switch e.Type {
+	case EventStarted:
+		delete(s.wrongStreaks, key)
+		s.attempts[key]++
+		s.notify(NotifyStart, e.QuestID, fmt.Sprintf("Started '%s' by '%s' at %s", e.QuestID, name, e.Time))
+	case EventFinished:
+		delete(s.wrongStreaks, key)
+		s.notify(NotifyFinish, e.QuestID, fmt.Sprintf("Finished '%s' by '%s' at %s (attempt %d, spent %s, made %d mistakes, skipped %d stages)",
+			e.QuestID, name, e.Time, s.attempts[key], e.Spent, e.Mistakes, e.Skipped))
+	case EventAbandoned:
+		delete(s.wrongStreaks, key)
+		s.notify(NotifyAbandon, e.QuestID, fmt.Sprintf("Abandoned '%s' by '%s' at %s", e.QuestID, name, e.Time))
+	case EventAnsweredCorrectly, EventSkipped:
+		delete(s.wrongStreaks, key)
+		if e.Type == EventAnsweredCorrectly {
+			s.notify(NotifySolved, e.QuestID, fmt.Sprintf("Stage of '%s' solved by '%s' at %s", e.QuestID, name, e.Time))
+		}
+	case EventAnsweredIncorrectly:
+		s.wrongStreaks[key]++
+		s.notifyStreak(e, s.wrongStreaks[key])
+	case EventSuspicious:
+		s.notify(NotifyTimeout, e.QuestID, fmt.Sprintf("Suspicious activity in '%s' by '%s' at %s: reached %d wrong answers, answers blocked for %s", e.QuestID, name, e.Time, e.WrongN, e.Cooldown))
+	}
+}
+
+// staffChats returns chats of staff running the quest and interested in the event,
+// a group chat shared by several people is returned once
+func staffChats(notifications OwnerNotifications, questID string, wants func(member tgbotbase.UserID, settings NotifySettings) bool) []int64 {
+	res := make([]int64, 0, 1)
+	seen := make(map[int64]bool, 0)
+	staff := notifications.Staff()
+	for _, member := range staff.Members() {
+		if !staff.CanManage(member, questID) {
+			continue
+		}
+		settings := notifications.Get(member)
+		chat := settings.Chat(member)
+		if seen[chat] || !wants(member, settings) {
+			continue
+		}
+		seen[chat] = true
+		res = append(res, chat)
+	}
+	return res
+}
+
+func (s *telegramSink) notifyStreak(e Event, streak int) {
+	msg := fmt.Sprintf("'%s' gave %d wrong answers in a row in '%s' at %s", username(s.usernames, e.UserID), streak, e.QuestID, e.Time)
+	chats := staffChats(s.notifications, e.QuestID, func(member tgbotbase.UserID, settings NotifySettings) bool {
+		return settings.Wants(NotifyWrong, e.QuestID) && streak%settings.WrongStreak == 0
+	})
+	for _, chat := range chats {
+		s.notifyChat(chat, msg)
+	}
+}
+
+func (s *telegramSink) Close() {
+	if s.digestInterval > 0 {
+		close(s.stopCh)
+	}
+	<-s.stoppedCh
+}
+
+func (s *telegramSink) notify(kind NotifyEvent, questID string, msg string) {
+	chats := staffChats(s.notifications, questID, func(member tgbotbase.UserID, settings NotifySettings) bool {
+		return settings.Wants(kind, questID)
+	})
+	for _, chat := range chats {
+		s.notifyChat(chat, msg)
+	}
+}
+
+// notifyChat sends the message right away or collects it into the next digest
+func (s *telegramSink) notifyChat(chat int64, msg string) {
+	if s.digestInterval <= 0 {
+		s.send(chat, msg)
+		return
+	}
+	s.digestMutex.Lock()
+	s.digest[chat] = append(s.digest[chat], msg)
+	s.digestMutex.Unlock()
+}
+
+func (s *telegramSink) digestLoop() {
+	defer close(s.stoppedCh)
+	ticker := time.NewTicker(s.digestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flushDigest()
+		case <-s.stopCh:
+			s.flushDigest()
+			return
+		}
+	}
+}
+
+func (s *telegramSink) flushDigest() {
+	s.digestMutex.Lock()
+	digest := s.digest
+	s.digest = make(map[int64][]string, 0)
+	s.digestMutex.Unlock()
+
+	for chat, lines := range digest {
+		header := fmt.Sprintf("%d quest events:", len(lines))
+		for _, msg := range SplitMessage(header, lines) {
+			s.send(chat, msg)
+		}
+	}
+}
+
+func (s *telegramSink) send(chat int64, msg string) {
+	if err := s.sender.Send(tgbotapi.NewMessage(chat, msg)); err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		log.WithFields(log.Fields{"chat": chat, "error": err}).Error("Unable to send notification")
+	}
+}
+
+func (s *telegramSink) Failures() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+// SplitMessage joins lines into as few messages as possible keeping every message within the limit
+func SplitMessage(header string, lines []string) []string {
+	res := make([]string, 0, 1)
+	msg := header
+	for _, line := range lines {
+		if len(msg)+len(line)+1 > maxMessageLen && msg != header {
+			res = append(res, msg)
+			msg = header
+		}
+		msg = msg + "\n" + line
+	}
+	return append(res, msg)
+}
@@ -0,0 +1,89 @@
+package quest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// recordingSender keeps texts sent to every chat, chats listed in failing reject messages
+type recordingSender struct {
+	failing map[int64]bool
+	sent    map[int64][]string
+}
+
+func newRecordingSender(failing ...int64) *recordingSender {
+	s := &recordingSender{failing: make(map[int64]bool), sent: make(map[int64][]string)}
+	for _, chat := range failing {
+		s.failing[chat] = true
+	}
+	return s
+}
+
+func (s *recordingSender) Send(msg tgbotapi.Chattable) error {
+	m := msg.(tgbotapi.MessageConfig)
+	if s.failing[m.ChatID] {
+		return errors.New("chat not found")
+	}
+	s.sent[m.ChatID] = append(s.sent[m.ChatID], m.Text)
+	return nil
+}
+
+func TestTelegramSinkFinished(t *testing.T) {
+	staff := NewStaff([]tgbotbase.UserID{1})
+	staff.AddOrganizers([]tgbotbase.UserID{2}, []string{"q"}, 0)
+	notifications := NewOwnerNotifications(NewMemoryStateStorage(), staff)
+	sender := newRecordingSender(2)
+	var usernames sync.Map
+	usernames.Store(10, "player")
+
+	history := []Event{{Type: EventStarted, QuestID: "q", UserID: 10}, {Type: EventFinished, QuestID: "q", UserID: 10}}
+	sink := NewTelegramSink(sender, notifications, &usernames, 0, history)
+	at := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	sink.HandleEvent(Event{Type: EventStarted, QuestID: "q", UserID: 10, Time: at})
+	sink.HandleEvent(Event{Type: EventFinished, QuestID: "q", UserID: 10, Time: at, Spent: 90 * time.Minute, Mistakes: 3, Skipped: 1})
+	sink.Close()
+
+	want := "Finished 'q' by 'player' at " + at.String() + " (attempt 2, spent 1h30m0s, made 3 mistakes, skipped 1 stages)"
+	if got := sender.sent[1]; len(got) != 2 || got[1] != want {
+		t.Errorf("Owner got %q, want the start and %q", got, want)
+	}
+	if failures := sink.(failingSink).Failures(); failures != 2 {
+		t.Errorf("%d failed notifications, want 2 to the organizer", failures)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	line := func(c string, n int) string {
+		return strings.Repeat(c, n)
+	}
+	tests := []struct {
+		name   string
+		header string
+		lines  []string
+		want   []string
+	}{
+		{name: "no lines", header: "h", want: []string{"h"}},
+		{name: "one message", header: "h", lines: []string{"a", "b"}, want: []string{"h\na\nb"}},
+		{name: "exactly at the limit", header: "h", lines: []string{line("a", maxMessageLen-2)}, want: []string{"h\n" + line("a", maxMessageLen-2)}},
+		{name: "split", header: "h", lines: []string{line("a", 3000), line("b", 3000)}, want: []string{"h\n" + line("a", 3000), "h\n" + line("b", 3000)}},
+		{name: "long line is not split", header: "h", lines: []string{line("a", maxMessageLen+10)}, want: []string{"h\n" + line("a", maxMessageLen+10)}},
+		{name: "long line after short ones", header: "h", lines: []string{"a", line("b", maxMessageLen)}, want: []string{"h\na", "h\n" + line("b", maxMessageLen)}},
+	}
+	for _, tt := range tests {
+		got := SplitMessage(tt.header, tt.lines)
+		if !reflect.DeepEqual(got, tt.want) {
+			lens := make([]int, 0, len(got))
+			for _, msg := range got {
+				lens = append(lens, len(msg))
+			}
+			t.Errorf("%s: %d messages of lengths %v, want %d", tt.name, len(got), lens, len(tt.want))
+		}
+	}
+}
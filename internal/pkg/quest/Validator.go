@@ -0,0 +1,263 @@
+package quest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity string
+
+const (
+	// SeverityError makes a quest unplayable, such quests are not published
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// limits of Telegram for a question
+const (
+	maxQuestionLen = 4096
+	maxCaptionLen  = 1024
+	maxPictureSize = 10 * 1024 * 1024
+)
+
+// limits of Telegram for buttons, callback data of every button carries the quest ID
+const (
+	maxCallbackDataLen = 64
+	// MaxQuestIDLen leaves room for the longest prefix of callback data ("continue:") and the attempt and indexes of choice buttons,
+	// new quests cannot have longer IDs while stored ones keep loading unless their choice buttons do not fit
+	MaxQuestIDLen = 40
+	// maxAttemptLen is the longest attempt token of choice buttons, see choiceAttempt
+	maxAttemptLen = 5
+)
+
+// Issue is a problem found in a quest, StageID is empty for problems of the whole quest
+type Issue struct {
+	QuestID  string   `json:"quest"`
+	StageID  string   `json:"stage,omitempty"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+func (i Issue) String() string {
+	if i.StageID == "" {
+		return fmt.Sprintf("%s: quest '%s': %s", i.Severity, i.QuestID, i.Message)
+	}
+	return fmt.Sprintf("%s: quest '%s', stage '%s': %s", i.Severity, i.QuestID, i.StageID, i.Message)
+}
+
+// LoadFailure is a quest which could not be loaded from a storage at all
+type LoadFailure struct {
+	QuestID string
+	Err     error
+}
+
+// ValidationReport collects issues of all quests, pictures referenced by quests are checked if Blobs is set
+type ValidationReport struct {
+	Checked  int
+	Issues   []Issue
+	Failures []LoadFailure
+	Blobs    BlobStore
+}
+
+func (r *ValidationReport) Add(questID string, q Quest) []Issue {
+	issues := ValidateQuest(questID, q)
+	if r.Blobs != nil {
+		issues = append(issues, ValidatePictures(questID, q, r.Blobs)...)
+	}
+	r.Checked++
+	r.Issues = append(r.Issues, issues...)
+	return issues
+}
+
+func (r ValidationReport) HasErrors() bool {
+	return len(r.Failures) > 0 || HasErrors(r.Issues)
+}
+
+func (r ValidationReport) String() string {
+	errorsN := 0
+	for _, i := range r.Issues {
+		if i.Severity == SeverityError {
+			errorsN++
+		}
+	}
+	text := fmt.Sprintf("Checked %d quests: %d not loaded, %d errors, %d warnings", r.Checked, len(r.Failures), errorsN, len(r.Issues)-errorsN)
+	for _, f := range r.Failures {
+		text += fmt.Sprintf("\nnot loaded: quest '%s': %s", f.QuestID, f.Err)
+	}
+	for _, i := range r.Issues {
+		text += "\n" + i.String()
+	}
+	return text
+}
+
+func HasErrors(issues []Issue) bool {
+	for _, i := range issues {
+		if i.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateQuest checks that every stage of the quest can be shown and solved;
+// stages have no transitions and are shown in random order, so all of them are reachable
+// unless a stage which cannot be passed blocks players in a quest without skipping
+func ValidateQuest(questID string, q Quest) []Issue {
+	issues := make([]Issue, 0)
+	report := func(stageID string, severity Severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{QuestID: questID, StageID: stageID, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(q.stages) == 0 {
+		report("", SeverityError, "no stages")
+	}
+	if len(questID) > MaxQuestIDLen {
+		report("", SeverityWarning, "quest ID of %d bytes is longer than %d allowed for new quests, buttons may not fit", len(questID), MaxQuestIDLen)
+	}
+	if q.info.RateLimit.Enabled() && (q.info.RateLimit.Window <= 0 || q.info.RateLimit.Cooldown <= 0) {
+		report("", SeverityError, "rate limit %s must have positive window and cooldown", q.info.RateLimit)
+	}
+	if q.info.Visibility == VisibilityPublic && q.info.Title == "" {
+		report("", SeverityWarning, "public quest has no title")
+	}
+
+	// answerStages finds answers accepted by several stages: the order of stages is random so such answers are confusing
+	answerStages := make(map[string][]string, 0)
+	for _, stageID := range q.StageIDs() {
+		stage := q.stages[stageID]
+		hasPicture := len(stage.pic) > 0 || stage.picRef != "" || stage.picID != ""
+
+		if strings.TrimSpace(stage.question) == "" {
+			report(stageID, SeverityError, "empty question text")
+		}
+		if hasPicture && len(stage.question) > maxCaptionLen {
+			report(stageID, SeverityError, "question of %d bytes is too long for a picture caption (%d)", len(stage.question), maxCaptionLen)
+		} else if len(stage.question) > maxQuestionLen {
+			report(stageID, SeverityError, "question of %d bytes is too long for a message (%d)", len(stage.question), maxQuestionLen)
+		}
+		if len(stage.pic) > maxPictureSize {
+			report(stageID, SeverityError, "picture of %d bytes exceeds the limit of %d", len(stage.pic), maxPictureSize)
+		}
+		if stage.picRef != "" {
+			if _, err := blobHash(stage.picRef); err != nil {
+				report(stageID, SeverityError, "%s", err)
+			}
+		}
+
+		switch stage.stageType {
+		case StageModerated:
+			if len(stage.answers) > 0 {
+				report(stageID, SeverityWarning, "answers of a moderated stage are ignored")
+			}
+			continue
+		case StageChoice:
+			issues = append(issues, validateChoice(questID, stageID, stage, len(q.stages))...)
+		}
+
+		if len(stage.answers) == 0 {
+			report(stageID, SeverityError, "no answers, the stage cannot be solved")
+		}
+		for a := range stage.answers {
+			if strings.TrimSpace(a) == "" {
+				report(stageID, SeverityError, "empty answer")
+			}
+			answerStages[a] = append(answerStages[a], stageID)
+		}
+	}
+
+	answers := make([]string, 0, len(answerStages))
+	for a := range answerStages {
+		answers = append(answers, a)
+	}
+	sort.Strings(answers)
+	for _, a := range answers {
+		if stages := answerStages[a]; len(stages) > 1 {
+			report("", SeverityWarning, "answer '%s' is accepted by stages %s", a, strings.Join(stages, ", "))
+		}
+	}
+
+	if !q.info.AllowSkip {
+		blocking := make([]string, 0)
+		seen := make(map[string]bool, 0)
+		for _, i := range issues {
+			if i.StageID != "" && i.Severity == SeverityError && !seen[i.StageID] {
+				seen[i.StageID] = true
+				blocking = append(blocking, i.StageID)
+			}
+		}
+		if len(blocking) > 0 {
+			report("", SeverityError, "players cannot finish the quest: stages %s cannot be passed and skipping is not allowed", strings.Join(blocking, ", "))
+		}
+	}
+	return issues
+}
+
+// ValidatePictures checks that pictures referenced by stages are in the blob store and fit the limit of Telegram
+func ValidatePictures(questID string, q Quest, blobs BlobStore) []Issue {
+	issues := make([]Issue, 0)
+	report := func(stageID string, severity Severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{QuestID: questID, StageID: stageID, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+	for _, stageID := range q.StageIDs() {
+		ref := q.stages[stageID].picRef
+		if ref == "" {
+			continue
+		}
+		if _, err := blobHash(ref); err != nil {
+			// malformed refs are reported by ValidateQuest
+			continue
+		}
+		pic, err := blobs.Get(ref)
+		if err == ErrBlobNotFound {
+			report(stageID, SeverityError, "picture %s is missing in the blob store", ref)
+			continue
+		}
+		if err != nil {
+			report(stageID, SeverityWarning, "unable to check picture %s: %s", ref, err)
+			continue
+		}
+		if len(pic) > maxPictureSize {
+			report(stageID, SeverityError, "picture of %d bytes exceeds the limit of %d", len(pic), maxPictureSize)
+		}
+	}
+	return issues
+}
+
+// validateChoice checks that options are distinct, at least one of them is correct and every answer is an option
+func validateChoice(questID, stageID string, stage Stage, stagesN int) []Issue {
+	issues := make([]Issue, 0)
+	report := func(severity Severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{QuestID: questID, StageID: stageID, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(stage.options) == 0 {
+		report(SeverityError, "choice stage has no options")
+		return issues
+	}
+	longest := ChoiceData{questID, strings.Repeat("z", maxAttemptLen), stagesN - 1, len(stage.options) - 1}.String()
+	if len(longest) > maxCallbackDataLen {
+		report(SeverityError, "buttons need %d bytes of callback data which exceeds the limit of %d, the quest ID is too long", len(longest), maxCallbackDataLen)
+	}
+	seen := make(map[string]bool, len(stage.options))
+	correct := 0
+	for _, opt := range stage.options {
+		lower := strings.ToLower(opt)
+		if seen[lower] {
+			report(SeverityWarning, "duplicate option '%s'", opt)
+		}
+		seen[lower] = true
+		if stage.answers[lower] {
+			correct++
+		}
+	}
+	if correct == 0 {
+		report(SeverityError, "none of the options is a correct answer, the stage cannot be solved")
+	}
+	for a := range stage.answers {
+		if !seen[a] {
+			report(SeverityError, "answer '%s' is not among the options and cannot be chosen", a)
+		}
+	}
+	return issues
+}
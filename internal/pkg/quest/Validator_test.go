@@ -0,0 +1,114 @@
+package quest
+
+import (
+	"strings"
+	"testing"
+)
+
+// issueMessages returns "<severity> <stage>: <message>" of every issue
+func issueMessages(issues []Issue) []string {
+	res := make([]string, 0, len(issues))
+	for _, i := range issues {
+		res = append(res, string(i.Severity)+" "+i.StageID+": "+i.Message)
+	}
+	return res
+}
+
+func TestValidateQuest(t *testing.T) {
+	withStages := func(stages map[string]Stage) Quest {
+		q := NewQuest()
+		for id, stage := range stages {
+			q.AddStage(id, stage)
+		}
+		return q
+	}
+	choice := func(options []string, answers ...string) Stage {
+		stage := NewStage("pick one", answers)
+		stage.SetOptions(options, false)
+		return stage
+	}
+	moderated := NewStage("send a photo", nil)
+	moderated.SetType(StageModerated)
+	withPicture := NewStage(strings.Repeat("q", maxCaptionLen+1), []string{"a"})
+	withPicture.SetPictureID("file-id")
+	public := withStages(map[string]Stage{"s1": NewStage("q", []string{"a"})})
+	public.SetInfo(QuestInfo{Visibility: VisibilityPublic})
+	limited := withStages(map[string]Stage{"s1": NewStage("q", []string{"a"})})
+	limited.SetInfo(QuestInfo{RateLimit: RateLimit{MaxWrong: 3}})
+
+	tests := []struct {
+		name    string
+		questID string
+		quest   Quest
+		// issues are prefixes of expected issues in the order they are reported
+		issues []string
+	}{
+		{name: "valid", quest: withStages(map[string]Stage{"s1": NewStage("q", []string{"a"}), "s2": moderated})},
+		{name: "no stages", quest: NewQuest(), issues: []string{"error : no stages"}},
+		{name: "long ID", questID: strings.Repeat("q", MaxQuestIDLen+1), quest: public, issues: []string{"warning : quest ID of 41 bytes", "warning : public quest has no title"}},
+		{name: "long ID of a choice quest", questID: strings.Repeat("q", 50), quest: withStages(map[string]Stage{"s1": choice([]string{"x", "y"}, "y")}), issues: []string{"warning : quest ID of 50 bytes", "error s1: buttons need 67 bytes", "error : players cannot finish"}},
+		{name: "rate limit without cooldown", quest: limited, issues: []string{"error : rate limit"}},
+		{name: "empty question", quest: withStages(map[string]Stage{"s1": NewStage(" ", []string{"a"})}), issues: []string{"error s1: empty question", "error : players cannot finish the quest: stages s1"}},
+		{name: "long caption", quest: withStages(map[string]Stage{"s1": withPicture}), issues: []string{"error s1: question of 1025 bytes is too long for a picture caption", "error : players cannot finish the quest: stages s1"}},
+		{name: "no answers", quest: withStages(map[string]Stage{"s1": NewStage("q", nil)}), issues: []string{"error s1: no answers", "error : players cannot finish the quest: stages s1"}},
+		{name: "shared answer", quest: withStages(map[string]Stage{"s1": NewStage("q", []string{"a"}), "s2": NewStage("q", []string{"A"})}), issues: []string{"warning : answer 'a' is accepted by stages s1, s2"}},
+		{name: "choice", quest: withStages(map[string]Stage{"s1": choice([]string{"x", "y"}, "y")})},
+		{name: "choice without options", quest: withStages(map[string]Stage{"s1": choice(nil, "y")}), issues: []string{"error s1: choice stage has no options", "error : players cannot finish the quest: stages s1"}},
+		{name: "duplicate option", quest: withStages(map[string]Stage{"s1": choice([]string{"x", "X", "y"}, "y")}), issues: []string{"warning s1: duplicate option 'X'"}},
+		{name: "no correct option", quest: withStages(map[string]Stage{"s1": choice([]string{"x", "y"}, "z")}), issues: []string{"error s1: none of the options", "error s1: answer 'z' is not among the options", "error : players cannot finish the quest: stages s1"}},
+		{name: "answer not an option", quest: withStages(map[string]Stage{"s1": choice([]string{"x", "y"}, "y", "z")}), issues: []string{"error s1: answer 'z' is not among the options", "error : players cannot finish the quest: stages s1"}},
+		{name: "broken picture ref", quest: withStages(map[string]Stage{"s1": func() Stage {
+			s := NewStage("q", []string{"a"})
+			s.SetPictureRef("md5:oops")
+			return s
+		}()}), issues: []string{"error s1: ", "error : players cannot finish"}},
+		{name: "skippable broken stage", quest: func() Quest {
+			q := withStages(map[string]Stage{"s1": NewStage("q", nil), "s2": NewStage("q", []string{"a"})})
+			q.SetInfo(QuestInfo{AllowSkip: true})
+			return q
+		}(), issues: []string{"error s1: no answers"}},
+	}
+	for _, tt := range tests {
+		questID := tt.questID
+		if questID == "" {
+			questID = "quest"
+		}
+		issues := issueMessages(ValidateQuest(questID, tt.quest))
+		if len(issues) != len(tt.issues) {
+			t.Errorf("%s: issues %q, want %q", tt.name, issues, tt.issues)
+			continue
+		}
+		for i, want := range tt.issues {
+			if !strings.HasPrefix(issues[i], want) {
+				t.Errorf("%s: issue %q, want '%s...'", tt.name, issues[i], want)
+			}
+		}
+	}
+}
+
+func TestValidatePictures(t *testing.T) {
+	blobs := NewMemoryBlobStore()
+	small, _ := blobs.Put([]byte("picture"))
+	large, _ := blobs.Put(make([]byte, maxPictureSize+1))
+	withRef := func(ref string) Stage {
+		s := NewStage("q", []string{"a"})
+		s.SetPictureRef(ref)
+		return s
+	}
+	q := NewQuest()
+	q.AddStage("s1", withRef(small))
+	q.AddStage("s2", withRef(BlobRef([]byte("never stored"))))
+	q.AddStage("s3", withRef(large))
+	q.AddStage("s4", NewStage("q", []string{"b"}))
+
+	want := []string{"error s2: picture sha256:", "error s3: picture of 10485761 bytes exceeds"}
+	issues := issueMessages(ValidatePictures("quest", q, blobs))
+	if len(issues) != len(want) {
+		t.Fatalf("issues %q, want %q", issues, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(issues[i], want[i]) {
+			t.Errorf("issue %q, want '%s...'", issues[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package quest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admirallarimda/tgbotbase"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrVersionNotFound = errors.New("Quest version not found")
+
+// QuestVersion is an immutable snapshot of a quest made on publishing
+type QuestVersion struct {
+	QuestID   string    `json:"quest"`
+	Number    int       `json:"number"`
+	Published time.Time `json:"published"`
+	Quest     Quest     `json:"definition"`
+}
+
+// VersionStorage keeps published versions of quests, drafts are kept by QuestStorage
+type VersionStorage interface {
+	// PublishVersion stores the quest as the next version and makes it current
+	PublishVersion(questID string, quest Quest) (QuestVersion, error)
+	LoadVersion(questID string, number int) (*QuestVersion, error)
+	// ListVersions returns all versions of the quest ordered by number and the current one
+	ListVersions(questID string) ([]QuestVersion, int, error)
+	SetCurrentVersion(questID string, number int) error
+	// LoadCurrentVersions returns current versions of all published quests and failures of the broken ones
+	LoadCurrentVersions() ([]QuestVersion, []LoadFailure, error)
+}
+
+type redisVersionStorage struct {
+	client *redis.Client
+	blobs  BlobStore
+}
+
+// NewRedisVersionStorage keeps pictures of published versions in blobs, they are kept inline if blobs is nil
+func NewRedisVersionStorage(pool tgbotbase.RedisPool, blobs BlobStore) VersionStorage {
+	return &redisVersionStorage{client: pool.GetConnByName("quest"), blobs: blobs}
+}
+
+// publishRetries limits attempts to publish when the sequence is changed by a concurrent publication
+const publishRetries = 5
+
+// PublishVersion takes the next number, stores the version and makes it current in one transaction,
+// the sequence is watched so that concurrent publications never get the same number
+func (s *redisVersionStorage) PublishVersion(questID string, quest Quest) (QuestVersion, error) {
+	stages, err := offloadStages(s.blobs, quest)
+	if err != nil {
+		return QuestVersion{}, err
+	}
+	quest.stages = stages
+	seqKey := redisVersionSeqKey(questID)
+	for i := 0; i < publishRetries; i++ {
+		var v QuestVersion
+		err := s.client.Watch(func(tx *redis.Tx) error {
+			last, err := tx.Get(seqKey).Int64()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			number := int(last) + 1
+			quest.version = number
+			v = QuestVersion{
+				QuestID:   questID,
+				Number:    number,
+				Published: time.Now(),
+				Quest:     quest}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(seqKey, number, 0)
+				pipe.Set(redisVersionKey(questID, number), data, 0)
+				pipe.Set(redisCurrentVersionKey(questID), number, 0)
+				return nil
+			})
+			return err
+		}, seqKey)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return QuestVersion{}, err
+		}
+		return v, nil
+	}
+	return QuestVersion{}, fmt.Errorf("Quest '%s' is being published concurrently, try again", questID)
+}
+
+func (s *redisVersionStorage) LoadVersion(questID string, number int) (*QuestVersion, error) {
+	data, err := s.client.Get(redisVersionKey(questID, number)).Result()
+	if err == redis.Nil {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v QuestVersion
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return nil, fmt.Errorf("Malformed version %d of quest '%s': %s", number, questID, err)
+	}
+	v.Quest.version = v.Number
+	return &v, nil
+}
+
+func (s *redisVersionStorage) ListVersions(questID string) ([]QuestVersion, int, error) {
+	current, err := s.currentVersion(questID)
+	if err != nil {
+		return nil, 0, err
+	}
+	last, err := s.client.Get(redisVersionSeqKey(questID)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	versions := make([]QuestVersion, 0, last)
+	for n := 1; n <= int(last); n++ {
+		v, err := s.LoadVersion(questID, n)
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, current, nil
+}
+
+func (s *redisVersionStorage) SetCurrentVersion(questID string, number int) error {
+	exists, err := s.client.Exists(redisVersionKey(questID, number)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrVersionNotFound
+	}
+	return s.client.Set(redisCurrentVersionKey(questID), number, 0).Err()
+}
+
+func (s *redisVersionStorage) currentVersion(questID string) (int, error) {
+	current, err := s.client.Get(redisCurrentVersionKey(questID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return int(current), err
+}
+
+func (s *redisVersionStorage) LoadCurrentVersions() ([]QuestVersion, []LoadFailure, error) {
+	keys, err := tgbotbase.GetAllKeys(s.client, scanCurrentVersions())
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make([]QuestVersion, 0, len(keys))
+	failures := make([]LoadFailure, 0)
+	for _, key := range keys {
+		questID := redisUnescape(strings.TrimSuffix(strings.TrimPrefix(key, redisVersionPrefix), ":current"))
+		current, err := s.currentVersion(questID)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := s.LoadVersion(questID, current)
+		if err != nil {
+			log.WithFields(log.Fields{"quest": questID, "version": current, "error": err}).Error("Unable to load current version of quest")
+			failures = append(failures, LoadFailure{questID, err})
+			continue
+		}
+		versions = append(versions, *v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].QuestID < versions[j].QuestID
+	})
+	return versions, failures, nil
+}
+
+// versions are kept out of 'tg:questdef:*' where drafts live
+const redisVersionPrefix = "tg:quest-version:"
+
+func redisVersionKey(questID string, number int) string {
+	return redisVersionPrefix + redisEscape(questID) + ":" + strconv.Itoa(number)
+}
+
+func redisVersionSeqKey(questID string) string {
+	return redisVersionPrefix + redisEscape(questID) + ":seq"
+}
+
+func redisCurrentVersionKey(questID string) string {
+	return redisVersionPrefix + redisEscape(questID) + ":current"
+}
+
+func scanCurrentVersions() string {
+	return redisVersionPrefix + "*:current"
+}
@@ -0,0 +1,58 @@
+package quest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// webhookSink POSTs every event as JSON to the configured URL
+type webhookSink struct {
+	url      string
+	client   *http.Client
+	failures uint64
+}
+
+func NewWebhookSink(url string) EventSink {
+	return &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (s *webhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) HandleEvent(e Event) {
+	logger := log.WithFields(log.Fields{"url": s.url, "type": e.Type, "quest": e.QuestID, "user": e.UserID})
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.WithField("error", err).Error("Unable to encode event")
+		atomic.AddUint64(&s.failures, 1)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.WithField("error", err).Error("Unable to send event to webhook")
+		atomic.AddUint64(&s.failures, 1)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger.WithField("status", resp.Status).Error("Webhook has rejected event")
+		atomic.AddUint64(&s.failures, 1)
+	}
+}
+
+func (s *webhookSink) Failures() uint64 {
+	return atomic.LoadUint64(&s.failures)
+}
+
+func (s *webhookSink) Close() {
+}